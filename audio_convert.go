@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/gen2brain/malgo"
+)
+
+const (
+	// Discordへ送信するPCMの形式（Opusエンコーダーの入力形式）
+	outputSampleRate = 48000
+	outputChannels   = 2
+
+	// リサンプラーのフィルタ設定
+	resamplerZeroCrossings = 24  // 片側のゼロ交差数（大きいほど高品質・高負荷）
+	resamplerTablePhases   = 512 // 1サンプルあたりのフィルタテーブル分解能
+	resamplerRolloff       = 0.94
+	resamplerKaiserBeta    = 8.6
+)
+
+// formatName returns a human readable name for a malgo sample format
+func formatName(format malgo.FormatType) string {
+	switch format {
+	case malgo.FormatU8:
+		return "U8"
+	case malgo.FormatS16:
+		return "S16"
+	case malgo.FormatS24:
+		return "S24"
+	case malgo.FormatS32:
+		return "S32"
+	case malgo.FormatF32:
+		return "F32"
+	default:
+		return "Unknown"
+	}
+}
+
+// audioConverter converts raw captured audio of any device format into
+// 48kHz stereo S16 PCM suitable for the Opus encoder
+type audioConverter struct {
+	format      malgo.FormatType
+	channels    int
+	sampleRate  int
+	bytesPerSmp int
+
+	passthrough bool
+	mixMatrix   [outputChannels][]float32
+	resampler   *resampler
+
+	// 作業用バッファ（コールバックごとの再確保を避ける）
+	decoded []float32
+	stereo  []float32
+	out     []int16
+}
+
+// newAudioConverter creates a converter for the given native capture format
+func newAudioConverter(format malgo.FormatType, channels, sampleRate int) (*audioConverter, error) {
+	bytesPerSmp := 0
+	switch format {
+	case malgo.FormatU8:
+		bytesPerSmp = 1
+	case malgo.FormatS16:
+		bytesPerSmp = 2
+	case malgo.FormatS24:
+		bytesPerSmp = 3
+	case malgo.FormatS32, malgo.FormatF32:
+		bytesPerSmp = 4
+	default:
+		return nil, fmt.Errorf("unsupported sample format: %s", formatName(format))
+	}
+	if channels < 1 {
+		return nil, fmt.Errorf("invalid channel count: %d", channels)
+	}
+	if sampleRate < 1 {
+		return nil, fmt.Errorf("invalid sample rate: %d", sampleRate)
+	}
+
+	c := &audioConverter{
+		format:      format,
+		channels:    channels,
+		sampleRate:  sampleRate,
+		bytesPerSmp: bytesPerSmp,
+		passthrough: format == malgo.FormatS16 && channels == outputChannels && sampleRate == outputSampleRate,
+		mixMatrix:   downmixMatrix(channels),
+	}
+	if sampleRate != outputSampleRate {
+		c.resampler = newResampler(sampleRate, outputSampleRate, outputChannels)
+	}
+	return c, nil
+}
+
+// Describe returns a short description of the conversion performed
+func (c *audioConverter) Describe() string {
+	native := fmt.Sprintf("%s, %d ch, %d Hz", formatName(c.format), c.channels, c.sampleRate)
+	if c.passthrough {
+		return native + " (no conversion needed)"
+	}
+	return fmt.Sprintf("%s -> S16, %d ch, %d Hz", native, outputChannels, outputSampleRate)
+}
+
+// Process converts a block of raw interleaved input bytes and returns
+// interleaved 48kHz stereo S16 samples. The returned slice is reused by
+// the next call, so callers must copy it if they keep it.
+func (c *audioConverter) Process(input []byte) []int16 {
+	frameBytes := c.bytesPerSmp * c.channels
+	frames := len(input) / frameBytes
+
+	if c.passthrough {
+		c.out = growInt16(c.out, frames*outputChannels)
+		for i := range c.out {
+			c.out[i] = int16(binary.LittleEndian.Uint16(input[i*2:]))
+		}
+		return c.out
+	}
+
+	// 1. サンプル形式を float32 (-1.0〜1.0) に変換
+	c.decoded = growFloat32(c.decoded, frames*c.channels)
+	c.decodeSamples(input[:frames*frameBytes])
+
+	// 2. チャンネル数をステレオに変換（アップミックス/ダウンミックス）
+	c.stereo = growFloat32(c.stereo, frames*outputChannels)
+	for f := 0; f < frames; f++ {
+		in := c.decoded[f*c.channels : (f+1)*c.channels]
+		for out := 0; out < outputChannels; out++ {
+			var sum float32
+			for ch, gain := range c.mixMatrix[out] {
+				sum += in[ch] * gain
+			}
+			c.stereo[f*outputChannels+out] = sum
+		}
+	}
+
+	// 3. サンプルレートを48kHzに変換
+	samples := c.stereo
+	if c.resampler != nil {
+		samples = c.resampler.Process(c.stereo)
+	}
+
+	// 4. S16に変換（クリッピング付き）
+	c.out = growInt16(c.out, len(samples))
+	for i, s := range samples {
+		c.out[i] = floatToS16(s)
+	}
+	return c.out
+}
+
+// decodeSamples converts raw little-endian samples into c.decoded
+func (c *audioConverter) decodeSamples(input []byte) {
+	switch c.format {
+	case malgo.FormatU8:
+		for i := range c.decoded {
+			c.decoded[i] = (float32(input[i]) - 128) / 128
+		}
+	case malgo.FormatS16:
+		for i := range c.decoded {
+			c.decoded[i] = float32(int16(binary.LittleEndian.Uint16(input[i*2:]))) / 32768
+		}
+	case malgo.FormatS24:
+		for i := range c.decoded {
+			b := input[i*3:]
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			c.decoded[i] = float32(v) / 8388608
+		}
+	case malgo.FormatS32:
+		for i := range c.decoded {
+			c.decoded[i] = float32(float64(int32(binary.LittleEndian.Uint32(input[i*4:]))) / 2147483648)
+		}
+	case malgo.FormatF32:
+		for i := range c.decoded {
+			c.decoded[i] = math.Float32frombits(binary.LittleEndian.Uint32(input[i*4:]))
+		}
+	}
+}
+
+// downmixMatrix returns per-output-channel gains for mixing the given
+// number of input channels down (or up) to stereo.
+// Input channel order follows the common WAVE/miniaudio layout:
+// FL, FR, FC, LFE, BL, BR, SL, SR, ...
+func downmixMatrix(channels int) [outputChannels][]float32 {
+	var m [outputChannels][]float32
+	m[0] = make([]float32, channels)
+	m[1] = make([]float32, channels)
+
+	switch channels {
+	case 1:
+		// モノラルは両チャンネルに複製
+		m[0][0], m[1][0] = 1, 1
+		return m
+	case 2:
+		m[0][0], m[1][1] = 1, 1
+		return m
+	}
+
+	const center = 0.7071 // -3dB
+	m[0][0], m[1][1] = 1, 1
+	for ch := 2; ch < channels; ch++ {
+		switch {
+		case ch == 2: // FC
+			m[0][ch], m[1][ch] = center, center
+		case ch == 3: // LFE は捨てる
+		case ch%2 == 0: // 左側のサラウンド
+			m[0][ch] = center
+		default: // 右側のサラウンド
+			m[1][ch] = center
+		}
+	}
+
+	// 合計ゲインが1を超えないように正規化してクリップを防ぐ
+	for out := range m {
+		var total float32
+		for _, g := range m[out] {
+			total += g
+		}
+		if total > 1 {
+			for ch := range m[out] {
+				m[out][ch] /= total
+			}
+		}
+	}
+	return m
+}
+
+// floatToS16 converts a float sample to int16 with rounding and clipping
+func floatToS16(s float32) int16 {
+	v := math.Round(float64(s) * 32767)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+func growFloat32(buf []float32, n int) []float32 {
+	if cap(buf) < n {
+		return make([]float32, n)
+	}
+	return buf[:n]
+}
+
+func growInt16(buf []int16, n int) []int16 {
+	if cap(buf) < n {
+		return make([]int16, n)
+	}
+	return buf[:n]
+}
+
+// resampler is a streaming band-limited (windowed sinc) sample rate
+// converter for interleaved float audio
+type resampler struct {
+	channels int
+	step     float64 // 出力1サンプルあたりに進む入力サンプル数
+	halfLen  int     // フィルタの片側長（入力サンプル単位）
+	scale    float64 // フィルタテーブルのインデックス倍率
+	table    []float32
+
+	history []float32 // まだ使い切っていない入力（インターリーブ）
+	pos     float64   // 次の出力サンプルの位置（history内の入力フレーム単位）
+	out     []float32
+}
+
+// newResampler creates a resampler converting inRate to outRate
+func newResampler(inRate, outRate, channels int) *resampler {
+	step := float64(inRate) / float64(outRate)
+
+	// ダウンサンプリング時はカットオフを下げてエイリアシングを防ぐ
+	cutoff := resamplerRolloff
+	if step > 1 {
+		cutoff /= step
+	}
+	halfLen := int(math.Ceil(resamplerZeroCrossings / cutoff))
+
+	// カイザー窓付きsincのテーブル（0〜halfLenを片側のみ保持）
+	size := halfLen*resamplerTablePhases + 2
+	table := make([]float32, size)
+	i0Beta := besselI0(resamplerKaiserBeta)
+	for i := range table {
+		t := float64(i) / resamplerTablePhases
+		if t > float64(halfLen) {
+			break
+		}
+		x := t / float64(halfLen)
+		window := besselI0(resamplerKaiserBeta*math.Sqrt(1-x*x)) / i0Beta
+		table[i] = float32(cutoff * sinc(cutoff*t) * window)
+	}
+
+	r := &resampler{
+		channels: channels,
+		step:     step,
+		halfLen:  halfLen,
+		scale:    resamplerTablePhases,
+		table:    table,
+	}
+	// 先頭はフィルタ長分の無音で埋めておく
+	r.history = make([]float32, halfLen*channels)
+	r.pos = float64(halfLen)
+	return r
+}
+
+// Process resamples interleaved input and returns interleaved output.
+// The returned slice is reused by the next call.
+func (r *resampler) Process(input []float32) []float32 {
+	r.history = append(r.history, input...)
+	available := len(r.history) / r.channels
+
+	r.out = r.out[:0]
+	for {
+		center := int(r.pos)
+		if center+r.halfLen >= available {
+			break
+		}
+		frac := r.pos - float64(center)
+
+		for ch := 0; ch < r.channels; ch++ {
+			var acc float32
+			// 左側（過去方向）のタップ
+			for k := 0; k < r.halfLen && center-k >= 0; k++ {
+				acc += r.history[(center-k)*r.channels+ch] * r.kernel(frac+float64(k))
+			}
+			// 右側（未来方向）のタップ
+			for k := 1; k <= r.halfLen; k++ {
+				acc += r.history[(center+k)*r.channels+ch] * r.kernel(float64(k)-frac)
+			}
+			r.out = append(r.out, acc)
+		}
+		r.pos += r.step
+	}
+
+	// 不要になった過去の入力を捨てる
+	drop := int(r.pos) - r.halfLen
+	if drop > 0 {
+		if drop > available {
+			drop = available
+		}
+		r.history = append(r.history[:0], r.history[drop*r.channels:]...)
+		r.pos -= float64(drop)
+	}
+	return r.out
+}
+
+// kernel looks up the filter response at distance t (in input samples)
+func (r *resampler) kernel(t float64) float32 {
+	idx := t * r.scale
+	i := int(idx)
+	if i+1 >= len(r.table) {
+		return 0
+	}
+	f := float32(idx - float64(i))
+	return r.table[i] + (r.table[i+1]-r.table[i])*f
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	px := math.Pi * x
+	return math.Sin(px) / px
+}
+
+// besselI0 computes the zeroth-order modified Bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	half := x / 2
+	for k := 1; k < 50; k++ {
+		term *= (half / float64(k)) * (half / float64(k))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+// applyGain scales S16 samples in place by percent/100 with clipping
+func applyGain(pcm []int16, percent int) {
+	for i, v := range pcm {
+		scaled := int32(v) * int32(percent) / 100
+		if scaled > 32767 {
+			scaled = 32767
+		} else if scaled < -32768 {
+			scaled = -32768
+		}
+		pcm[i] = int16(scaled)
+	}
+}
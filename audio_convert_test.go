@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/gen2brain/malgo"
+)
+
+func TestResamplerKeepsFrequencyAndLevel(t *testing.T) {
+	const (
+		inRate    = 44100
+		freq      = 1000.0
+		amplitude = 0.5
+	)
+	r := newResampler(inRate, outputSampleRate, outputChannels)
+
+	// 1秒分を10msずつ入力する
+	var out []float32
+	chunk := make([]float32, inRate/100*outputChannels)
+	for pos := 0; pos < inRate; pos += inRate / 100 {
+		for i := 0; i < inRate/100; i++ {
+			v := float32(amplitude * math.Sin(2*math.Pi*freq*float64(pos+i)/inRate))
+			chunk[i*2], chunk[i*2+1] = v, v
+		}
+		out = append(out, r.Process(chunk)...)
+	}
+
+	// フィルタの遅延分を除いて、入力の長さ × 48000/44100 になる
+	frames := len(out) / outputChannels
+	if frames > outputSampleRate || frames < outputSampleRate-2*r.halfLen {
+		t.Errorf("output = %d frames for 1 s, want about %d", frames, outputSampleRate)
+	}
+
+	// 立ち上がりを除いた区間で周波数（上向きのゼロ交差）とRMSを測る
+	measured := out[outputSampleRate/4*outputChannels : frames*outputChannels]
+	crossings := 0
+	var squares float64
+	for i := 0; i+outputChannels < len(measured); i += outputChannels {
+		if measured[i] < 0 && measured[i+outputChannels] >= 0 {
+			crossings++
+		}
+		squares += float64(measured[i]) * float64(measured[i])
+	}
+	n := len(measured) / outputChannels
+	if want := float64(n) * freq / outputSampleRate; math.Abs(float64(crossings)-want) > 2 {
+		t.Errorf("%d cycles in %d samples, want %.0f (%g Hz)", crossings, n, want, freq)
+	}
+	rms := math.Sqrt(squares / float64(n))
+	if want := amplitude / math.Sqrt2; math.Abs(20*math.Log10(rms/want)) > 0.1 {
+		t.Errorf("RMS = %.4f, want %.4f", rms, want)
+	}
+}
+
+func TestDownmixMatrix(t *testing.T) {
+	// モノラルは両チャンネルに同じ音量で複製する
+	mono := downmixMatrix(1)
+	if mono[0][0] != 1 || mono[1][0] != 1 {
+		t.Errorf("mono matrix = %v, want the channel on both sides", mono)
+	}
+
+	// 5.1 (FL FR FC LFE SL SR) は合計ゲインが1以下、LFEは捨て、左右は混ざらない
+	surround := downmixMatrix(6)
+	for out, gains := range surround {
+		var total float32
+		for _, g := range gains {
+			total += g
+		}
+		if total > 1.0001 {
+			t.Errorf("output %d: total gain %.3f, want at most 1", out, total)
+		}
+		if gains[3] != 0 {
+			t.Errorf("output %d: LFE gain %.3f, want 0", out, gains[3])
+		}
+	}
+	if surround[0][1] != 0 || surround[1][0] != 0 || surround[0][5] != 0 || surround[1][4] != 0 {
+		t.Errorf("5.1 matrix mixes left and right: %v", surround)
+	}
+	if surround[0][2] != surround[1][2] || surround[0][2] == 0 {
+		t.Errorf("center gains = %.3f / %.3f, want equal on both sides", surround[0][2], surround[1][2])
+	}
+}
+
+func TestAudioConverterDecodesFormats(t *testing.T) {
+	f32 := func(values ...float32) []byte {
+		var b []byte
+		for _, v := range values {
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+		}
+		return b
+	}
+	tests := []struct {
+		name   string
+		format malgo.FormatType
+		input  []byte
+		want   []float32
+	}{
+		{"U8", malgo.FormatU8, []byte{0, 128, 255}, []float32{-1, 0, 127.0 / 128}},
+		{"S16", malgo.FormatS16, []byte{0x00, 0x80, 0xff, 0x7f}, []float32{-1, 32767.0 / 32768}},
+		// 24ビットの符号拡張: 0x800000 は -1.0
+		{"S24", malgo.FormatS24, []byte{0x00, 0x00, 0x80, 0xff, 0xff, 0xff, 0x00, 0x00, 0x40}, []float32{-1, -1.0 / 8388608, 0.5}},
+		{"S32", malgo.FormatS32, []byte{0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x40}, []float32{-1, 0.5}},
+		{"F32", malgo.FormatF32, f32(-0.25, 1.5), []float32{-0.25, 1.5}},
+	}
+	for _, tt := range tests {
+		c, err := newAudioConverter(tt.format, 1, outputSampleRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Process(tt.input)
+		if !reflect.DeepEqual(c.decoded, tt.want) {
+			t.Errorf("%s: decoded %v, want %v", tt.name, c.decoded, tt.want)
+		}
+	}
+}
+
+func TestAudioConverterMonoF32ToStereoS16(t *testing.T) {
+	c, err := newAudioConverter(malgo.FormatF32, 1, outputSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := make([]byte, 0, 12)
+	for _, v := range []float32{0.5, -2, 1.5} {
+		input = binary.LittleEndian.AppendUint32(input, math.Float32bits(v))
+	}
+	// モノラルは左右に複製され、1.0を超える値はクリップする
+	want := []int16{16384, 16384, -32768, -32768, 32767, 32767}
+	if got := c.Process(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("output = %v, want %v", got, want)
+	}
+}
+
+func TestFloatToS16Clips(t *testing.T) {
+	for in, want := range map[float32]int16{
+		0:     0,
+		0.5:   16384,
+		1:     32767,
+		1.5:   32767,
+		-1:    -32767,
+		-1.5:  -32768,
+		100:   32767,
+		-0.25: -8192,
+	} {
+		if got := floatToS16(in); got != want {
+			t.Errorf("floatToS16(%g) = %d, want %d", in, got, want)
+		}
+	}
+}
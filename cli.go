@@ -0,0 +1,292 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gen2brain/malgo"
+)
+
+const cliUsage = `Usage: consonance <command> [options]
+
+Commands:
+  run       Start the bot (default when no command is given)
+  devices   List capture and playback devices with IDs and native formats
+  check     Validate the config file and the Discord token
+  invite    Print the bot invite (OAuth2) URL
+  version   Print the version
+  help      Show this help
+
+Run "consonance <command> -h" for the options of a command.
+`
+
+// runCLI dispatches the command line to a subcommand and returns the exit code
+func runCLI(args []string) int {
+	// 引数なし、またはフラグから始まる場合は従来通りrunとして扱う
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		return runCommand(args)
+	}
+
+	command, rest := args[0], args[1:]
+	switch command {
+	case "run":
+		return runCommand(rest)
+	case "devices", "list-devices":
+		return devicesCommand(rest)
+	case "check":
+		return checkCommand(rest)
+	case "invite":
+		return inviteCommand(rest)
+	case "version":
+		fmt.Println(GetVersionString())
+		return 0
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", command, cliUsage)
+		return 2
+	}
+}
+
+// newFlagSet creates a flag set for a subcommand with the common --config flag
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", configPath, "path to the config file (default: $CONSONANCE_CONFIG, ./config.yaml or the user config directory)")
+	return fs
+}
+
+// runCommand starts the bot
+func runCommand(args []string) int {
+	fs := newFlagSet("run")
+	headlessFlag := fs.Bool("headless", false, "never prompt for input; read settings from the config file and environment variables")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	headless = *headlessFlag || headlessFromEnv()
+
+	runBot()
+	return 0
+}
+
+// devicesCommand prints the available audio devices
+func devicesCommand(args []string) int {
+	fs := newFlagSet("devices")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize malgo context: %v\n", err)
+		return 1
+	}
+	defer func() {
+		_ = ctx.Uninit()
+		ctx.Free()
+	}()
+
+	ok := true
+	for _, kind := range []struct {
+		title string
+		typ   malgo.DeviceType
+	}{
+		{"Playback devices (usable for loopback capture and two-way mode)", malgo.Playback},
+		{"Capture devices", malgo.Capture},
+	} {
+		fmt.Printf("=== %s ===\n", kind.title)
+
+		infos, err := ctx.Devices(kind.typ)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get devices: %v\n", err)
+			ok = false
+			continue
+		}
+		if len(infos) == 0 {
+			fmt.Println("(none)")
+		}
+
+		for i, info := range infos {
+			defaultMark := ""
+			if info.IsDefault > 0 {
+				defaultMark = " (Default)"
+			}
+			fmt.Printf("[%d] %s%s\n", i+1, info.Name(), defaultMark)
+			fmt.Printf("    ID:      %s\n", info.ID)
+
+			// 列挙結果にはネイティブ形式が含まれないため個別に問い合わせる
+			detail, err := ctx.DeviceInfo(kind.typ, info.ID, malgo.Shared)
+			if err != nil {
+				fmt.Printf("    Formats: unknown (%v)\n", err)
+				continue
+			}
+			fmt.Printf("    Formats: %s\n", describeFormats(detail.Formats))
+		}
+		fmt.Println()
+	}
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// describeFormats formats a list of native data formats for display
+func describeFormats(formats []malgo.DataFormat) string {
+	if len(formats) == 0 {
+		return "unknown"
+	}
+
+	parts := make([]string, 0, len(formats))
+	for _, f := range formats {
+		channels := "any ch"
+		if f.Channels > 0 {
+			channels = fmt.Sprintf("%d ch", f.Channels)
+		}
+		rate := "any rate"
+		if f.SampleRate > 0 {
+			rate = fmt.Sprintf("%d Hz", f.SampleRate)
+		}
+		format := "any format"
+		if f.Format != malgo.FormatUnknown {
+			format = formatName(f.Format)
+		}
+		parts = append(parts, fmt.Sprintf("%s %s %s", format, channels, rate))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// checkCommand validates the config file and the Discord token
+func checkCommand(args []string) int {
+	fs := newFlagSet("check")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	failed := false
+	report := func(ok bool, format string, args ...interface{}) {
+		mark := "✓"
+		if !ok {
+			mark = "✗"
+			failed = true
+		}
+		fmt.Printf("%s %s\n", mark, fmt.Sprintf(format, args...))
+	}
+
+	// 検査だけなので旧形式の移行（書き換え）は行わない
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		report(false, "Config: %v", err)
+		return 1
+	}
+	cfg, legacy, err := parseConfig(data, configPath)
+	if cerr, ok := err.(*configError); ok {
+		for _, issue := range cerr.issues {
+			report(false, "Config: %s", (&configError{file: configPath, issues: []configIssue{issue}}).issueString(0))
+		}
+		return 1
+	} else if err != nil {
+		report(false, "Config: %v", err)
+		return 1
+	}
+	if err := applyEnvironment(cfg); err != nil {
+		report(false, "Config: %v", err)
+		return 1
+	}
+	if legacy {
+		report(true, "Config: %s loaded (old flat layout; it will be migrated to version %d on the next run)", configPath, configVersion)
+	} else {
+		report(true, "Config: %s loaded (version %d)", configPath, cfg.Version)
+	}
+
+	// オーディオデバイスの存在確認
+	if cfg.Audio.DeviceName != "" {
+		if err := checkDeviceExists(cfg.Audio.DeviceName); err != nil {
+			report(false, "Audio device: %v", err)
+		} else {
+			report(true, "Audio device: %s found", cfg.Audio.DeviceName)
+		}
+	} else {
+		report(true, "Audio device: not set (will be selected at startup or default loopback device is used)")
+	}
+
+	// トークンの確認（REST APIで自分自身の情報を取得）
+	if cfg.Discord.Token == "" {
+		report(false, "Discord token: not set")
+	} else if user, err := fetchBotUser(cfg.Discord.Token); err != nil {
+		report(false, "Discord token: %v", err)
+	} else {
+		report(true, "Discord token: valid (logged in as %s, ID %s)", user.Username, user.ID)
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// inviteCommand prints the OAuth2 invite URL of the bot
+func inviteCommand(args []string) int {
+	fs := newFlagSet("invite")
+	clientID := fs.String("client-id", "", "application client ID (looked up with the token if omitted)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *clientID == "" {
+		cfg, err := readConfig(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			return 1
+		}
+		if err := applyEnvironment(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			return 1
+		}
+		if cfg.Discord.Token == "" {
+			fmt.Fprintln(os.Stderr, "Discord token is not set; pass --client-id or configure discord.token")
+			return 1
+		}
+
+		user, err := fetchBotUser(cfg.Discord.Token)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to look up the bot user: %v\n", err)
+			return 1
+		}
+		*clientID = user.ID
+	}
+
+	fmt.Println(inviteURL(*clientID))
+	return 0
+}
+
+// checkDeviceExists reports an error if no playback device has the given name
+func checkDeviceExists(deviceName string) error {
+	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to initialize malgo context: %v", err)
+	}
+	defer func() {
+		_ = ctx.Uninit()
+		ctx.Free()
+	}()
+
+	_, err = findDeviceByName(ctx, deviceName)
+	return err
+}
+
+// fetchBotUser returns the bot's own user using the REST API (no gateway connection)
+func fetchBotUser(token string) (*discordgo.User, error) {
+	s, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Discord session: %v", err)
+	}
+	user, err := s.User("@me")
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed: %v", err)
+	}
+	return user, nil
+}
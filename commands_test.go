@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// permissionSession returns a session whose state knows a guild with a
+// manager role (Manage Server) and a DJ role
+func permissionSession(t *testing.T) *discordgo.Session {
+	t.Helper()
+	state := discordgo.NewState()
+	err := state.GuildAdd(&discordgo.Guild{
+		ID:      "1",
+		OwnerID: "900",
+		Roles: []*discordgo.Role{
+			{ID: "1"}, // @everyone
+			{ID: "10", Permissions: discordgo.PermissionManageGuild},
+			{ID: "20"},
+		},
+		Channels: []*discordgo.Channel{{ID: "50", GuildID: "1", Type: discordgo.ChannelTypeGuildText}},
+		Members: []*discordgo.Member{
+			{GuildID: "1", User: &discordgo.User{ID: "100"}, Roles: []string{"10"}},
+			{GuildID: "1", User: &discordgo.User{ID: "200"}, Roles: []string{"20"}},
+			{GuildID: "1", User: &discordgo.User{ID: "300"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &discordgo.Session{State: state}
+}
+
+func TestCommandRolesDoNotLockOutManagers(t *testing.T) {
+	setupTestBot(t, &Config{Commands: CommandsConfig{AllowedRoleIDs: []string{"20"}}})
+	s := permissionSession(t)
+
+	for user, want := range map[string]bool{"100": true, "200": true, "300": false} {
+		member, err := s.State.Member("1", user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &discordgo.MessageCreate{Message: &discordgo.Message{
+			GuildID: "1", ChannelID: "50", Author: member.User, Member: member,
+		}}
+		if got := isCommandAllowed(s, currentConfig(), m); got != want {
+			t.Errorf("user %s: allowed = %v, want %v", user, got, want)
+		}
+	}
+}
@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configVersion is the current config schema version
+const configVersion = 2
+
+// Config structure
+type Config struct {
+	Version   int             `yaml:"version"`
+	Discord   DiscordConfig   `yaml:"discord"`
+	Audio     AudioConfig     `yaml:"audio"`
+	Encoder   EncoderConfig   `yaml:"encoder"`
+	Commands  CommandsConfig  `yaml:"commands"`
+	Recording RecordingConfig `yaml:"recording"`
+	Logging   LoggingConfig   `yaml:"logging"`
+
+	StreamServer StreamServerConfig `yaml:"stream_server"`
+	Outputs      OutputsConfig      `yaml:"outputs"`
+	Levels       LevelsConfig       `yaml:"levels"`
+
+	Profiles map[string]ProfileConfig `yaml:"profiles"`
+}
+
+// DiscordConfig holds the bot token and the auto-connect target
+type DiscordConfig struct {
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"` // トークンだけを別ファイルに置く場合（設定ファイルからの相対パス）
+	GuildID   string `yaml:"guild_id"`
+	ChannelID string `yaml:"channel_id"`
+}
+
+// AudioConfig holds the capture device and voice receive settings
+type AudioConfig struct {
+	DeviceName       string `yaml:"device_name"`
+	BufferPeriods    int    `yaml:"buffer_periods"`
+	ReceiveVoice     bool   `yaml:"receive_voice"`      // ミュート解除で参加して受信した音声をデコード
+	ReturnAudio      bool   `yaml:"return_audio"`       // 受信した音声をローカルの再生デバイスで鳴らす（双方向モード）
+	ReturnDeviceName string `yaml:"return_device_name"` // "" = default playback device
+	Profile          string `yaml:"profile"`            // 参加時に使うプロファイル（"" = このセクションの設定）
+
+	Stereo StereoConfig `yaml:"stereo"`
+	DSP    DSPConfig    `yaml:"dsp"`
+}
+
+// StereoConfig rearranges the channels of the capture before encoding
+type StereoConfig struct {
+	Mode    string `yaml:"mode"`    // stereo (default), swap, mono, left or right
+	Balance int    `yaml:"balance"` // -100 (left only) to 100 (right only), 0 = center
+	Width   int    `yaml:"width"`   // percent of the side signal (1-200), 0 = 100
+}
+
+// DSPConfig is the filter chain between the capture and the encoder
+type DSPConfig struct {
+	Bypass     bool             `yaml:"bypass"`      // 設定を残したままチェーン全体を止める
+	HighPassHz float64          `yaml:"highpass_hz"` // 0 = off
+	LowPassHz  float64          `yaml:"lowpass_hz"`  // 0 = off
+	NotchHz    float64          `yaml:"notch_hz"`    // hum frequency (50 or 60), its harmonics are removed too, 0 = off
+	EQ         []EQBand         `yaml:"eq"`
+	Compressor CompressorConfig `yaml:"compressor"`
+}
+
+// EQBand is one band of the parametric EQ
+type EQBand struct {
+	Freq   float64 `yaml:"freq"`    // center frequency in Hz
+	GainDB float64 `yaml:"gain_db"` // -24 to 24
+	Q      float64 `yaml:"q"`       // 0 = 1
+}
+
+// CompressorConfig holds the compressor at the end of the DSP chain
+type CompressorConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	ThresholdDB float64 `yaml:"threshold_db"` // dBFS, 0 = -18
+	Ratio       float64 `yaml:"ratio"`        // 0 = 4
+	AttackMS    float64 `yaml:"attack_ms"`    // 0 = 10
+	ReleaseMS   float64 `yaml:"release_ms"`   // 0 = 200
+	MakeupDB    float64 `yaml:"makeup_db"`
+}
+
+// EncoderConfig holds the Opus encoder settings
+type EncoderConfig struct {
+	BitrateKbps     int    `yaml:"bitrate_kbps"` // 0 = encoder default
+	Application     string `yaml:"application"`  // audio, voip or lowdelay
+	ConstantBitrate bool   `yaml:"constant_bitrate"`
+}
+
+// CommandsConfig holds the chat command settings
+type CommandsConfig struct {
+	Prefix         string   `yaml:"prefix"`           // "" = mention only
+	AllowedRoleIDs []string `yaml:"allowed_role_ids"` // empty = everyone
+	Language       string   `yaml:"language"`         // reply language when the server has none (ja, en)
+}
+
+// RecordingConfig holds the stream recording settings
+type RecordingConfig struct {
+	Dir        string `yaml:"dir"`
+	Format     string `yaml:"format"`      // ogg or wav
+	AutoStart  bool   `yaml:"auto_start"`  // 接続時に自動で録音を開始
+	MaxMinutes int    `yaml:"max_minutes"` // 0 = no limit
+	MaxSizeMB  int    `yaml:"max_size_mb"` // 0 = no limit
+}
+
+// StreamServerConfig holds the embedded HTTP server that serves the stream as Ogg Opus
+type StreamServerConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Listen       string `yaml:"listen"`        // address to listen on
+	Path         string `yaml:"path"`          // URL path of the stream
+	MaxListeners int    `yaml:"max_listeners"` // 0 = 20
+}
+
+// OutputsConfig holds the additional outputs of the raw PCM stream (OBS, ffmpeg)
+type OutputsConfig struct {
+	Pipe      PipeOutputConfig      `yaml:"pipe"`
+	WebSocket WebSocketOutputConfig `yaml:"websocket"`
+}
+
+// PipeOutputConfig writes the PCM stream to a named pipe
+type PipeOutputConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"` // FIFO path, or \\.\pipe\<name> on Windows
+}
+
+// WebSocketOutputConfig serves the PCM stream to local WebSocket clients
+type WebSocketOutputConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"`
+	Path    string `yaml:"path"`
+}
+
+// LevelsConfig holds the console level meter and the clipping / silence alerts
+type LevelsConfig struct {
+	ConsoleMeter        bool `yaml:"console_meter"`         // 配信中、コンソールの最終行にレベルメーターを表示
+	ClipAlertSeconds    int  `yaml:"clip_alert_seconds"`    // 0 = no clipping alert
+	SilenceAlertSeconds int  `yaml:"silence_alert_seconds"` // 0 = no silence alert
+}
+
+// LoggingConfig holds the log output settings
+type LoggingConfig struct {
+	Level      string `yaml:"level"`  // debug, info, warn or error
+	Format     string `yaml:"format"` // text (logfmt) or json
+	Dir        string `yaml:"dir"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`  // 新しいファイルに切り替えるサイズ
+	MaxAgeDays int    `yaml:"max_age_days"` // これより古いファイルは削除
+	MaxFiles   int    `yaml:"max_files"`    // 残す古いファイルの数
+}
+
+// ProfileConfig is a named set of capture and encoder settings switched with
+// "@Bot profile <name>". Unset values fall back to the audio and encoder sections.
+type ProfileConfig struct {
+	Devices       []ProfileDevice `yaml:"devices"`        // empty = audio.device_name
+	BufferPeriods int             `yaml:"buffer_periods"` // 0 = audio.buffer_periods
+	Encoder       *EncoderConfig  `yaml:"encoder"`        // nil = encoder section
+	Stereo        *StereoConfig   `yaml:"stereo"`         // nil = audio.stereo
+	DSP           *DSPConfig      `yaml:"dsp"`            // nil = audio.dsp
+}
+
+// ProfileDevice is one capture source of a profile; several sources are mixed
+type ProfileDevice struct {
+	Name   string `yaml:"name"`   // "" = default device
+	Mode   string `yaml:"mode"`   // loopback (default), capture (microphone, line in), http, tcp or udp
+	Volume int    `yaml:"volume"` // percent, 0 = 100
+
+	// ネットワーク入力（mode: http / tcp / udp）
+	URL      string `yaml:"url"`       // http: Ogg Opus stream (Icecast)
+	Listen   string `yaml:"listen"`    // tcp / udp: address to listen on, e.g. 127.0.0.1:7000
+	Format   string `yaml:"format"`    // tcp / udp: pcm (48kHz stereo S16LE, default) or opus
+	BufferMS int    `yaml:"buffer_ms"` // jitter buffer, 0 = 100
+}
+
+// defaultProfileName selects the audio and encoder sections instead of a named profile
+const defaultProfileName = "default"
+
+// legacyConfig is the flat config layout used before schema version 2
+type legacyConfig struct {
+	DiscordToken       string `yaml:"discord_token"`
+	ChannelID          string `yaml:"channel_id"`
+	GuildID            string `yaml:"guild_id"`
+	AudioDeviceName    string `yaml:"audio_device_name"`
+	AudioBufferPeriods int    `yaml:"audio_buffer_periods"`
+	RecordingsDir      string `yaml:"recordings_dir"`
+	RecordFormat       string `yaml:"record_format"`
+	AutoRecord         bool   `yaml:"auto_record"`
+	RecordMaxMinutes   int    `yaml:"record_max_minutes"`
+	RecordMaxSizeMB    int    `yaml:"record_max_size_mb"`
+	ReceiveVoice       bool   `yaml:"receive_voice"`
+	ReturnAudio        bool   `yaml:"return_audio"`
+	ReturnDeviceName   string `yaml:"return_device_name"`
+}
+
+// migrate converts the flat layout to the current schema
+func (l *legacyConfig) migrate() *Config {
+	return &Config{
+		Version: configVersion,
+		Discord: DiscordConfig{
+			Token:     l.DiscordToken,
+			GuildID:   l.GuildID,
+			ChannelID: l.ChannelID,
+		},
+		Audio: AudioConfig{
+			DeviceName:       l.AudioDeviceName,
+			BufferPeriods:    l.AudioBufferPeriods,
+			ReceiveVoice:     l.ReceiveVoice,
+			ReturnAudio:      l.ReturnAudio,
+			ReturnDeviceName: l.ReturnDeviceName,
+		},
+		Recording: RecordingConfig{
+			Dir:        l.RecordingsDir,
+			Format:     l.RecordFormat,
+			AutoStart:  l.AutoRecord,
+			MaxMinutes: l.RecordMaxMinutes,
+			MaxSizeMB:  l.RecordMaxSizeMB,
+		},
+	}
+}
+
+// applyDefaults fills unset values with their defaults
+func (c *Config) applyDefaults() {
+	if c.Version == 0 {
+		c.Version = configVersion
+	}
+	if c.Audio.BufferPeriods == 0 {
+		c.Audio.BufferPeriods = 4
+	}
+	if c.Encoder.Application == "" {
+		c.Encoder.Application = "audio"
+	}
+	if c.Commands.Language == "" {
+		c.Commands.Language = "ja"
+	}
+	if c.Recording.Dir == "" {
+		c.Recording.Dir = "recordings"
+	}
+	if c.Recording.Format == "" {
+		c.Recording.Format = "ogg"
+	}
+	if c.Logging.Level == "" {
+		c.Logging.Level = "info"
+	}
+	if c.Logging.Format == "" {
+		c.Logging.Format = "text"
+	}
+	if c.Logging.Dir == "" {
+		c.Logging.Dir = "logs"
+	}
+	// ログがディスクを埋めないよう、0 でも上限を設ける
+	if c.Logging.MaxSizeMB == 0 {
+		c.Logging.MaxSizeMB = 10
+	}
+	if c.Logging.MaxAgeDays == 0 {
+		c.Logging.MaxAgeDays = 30
+	}
+	if c.Logging.MaxFiles == 0 {
+		c.Logging.MaxFiles = 20
+	}
+	if c.StreamServer.Listen == "" {
+		c.StreamServer.Listen = "127.0.0.1:8090"
+	}
+	if c.StreamServer.Path == "" {
+		c.StreamServer.Path = "/stream.opus"
+	}
+	if c.StreamServer.MaxListeners == 0 {
+		c.StreamServer.MaxListeners = 20
+	}
+	if c.Outputs.Pipe.Path == "" {
+		c.Outputs.Pipe.Path = defaultPipePath
+	}
+	if c.Outputs.WebSocket.Listen == "" {
+		c.Outputs.WebSocket.Listen = "127.0.0.1:8091"
+	}
+	if c.Outputs.WebSocket.Path == "" {
+		c.Outputs.WebSocket.Path = "/pcm"
+	}
+	for name, profile := range c.Profiles {
+		if profile.Encoder != nil && profile.Encoder.Application == "" {
+			encoder := *profile.Encoder
+			encoder.Application = "audio"
+			profile.Encoder = &encoder
+			c.Profiles[name] = profile
+		}
+	}
+}
+
+// configIssue is a single problem found in the config file
+type configIssue struct {
+	line int // 0 = unknown
+	path string
+	msg  string
+}
+
+// configError reports every problem found in a config file
+type configError struct {
+	file   string
+	issues []configIssue
+}
+
+func (e *configError) Error() string {
+	lines := make([]string, 0, len(e.issues))
+	for i := range e.issues {
+		lines = append(lines, e.issueString(i))
+	}
+	return fmt.Sprintf("invalid config (%d problem(s)):\n  %s", len(e.issues), strings.Join(lines, "\n  "))
+}
+
+// issueString formats one issue as "file:line: path: message"
+func (e *configError) issueString(i int) string {
+	issue := e.issues[i]
+	location := e.file
+	if issue.line > 0 {
+		location = fmt.Sprintf("%s:%d", e.file, issue.line)
+	}
+	if issue.path == "" {
+		return fmt.Sprintf("%s: %s", location, issue.msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, issue.path, issue.msg)
+}
+
+// parseConfig decodes, checks and validates config file contents.
+// legacy is true if the data used the old flat layout and was migrated in memory.
+func parseConfig(data []byte, file string) (cfg *Config, legacy bool, err error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, false, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+
+	// 空のファイルはデフォルト値のみ
+	if len(doc.Content) == 0 {
+		cfg = &Config{}
+		cfg.applyDefaults()
+		return cfg, false, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, false, &configError{file, []configIssue{{line: root.Line, msg: "top level must be a mapping of settings"}}}
+	}
+
+	// 問題はまとめて報告するため、途中で見つかっても最後まで検査を続ける
+	var issues []configIssue
+
+	// versionがなく旧形式のキーを含む場合は旧形式として読み込んで移行する
+	var lines map[string]int
+	if mappingValue(root, "version") == nil && isLegacyLayout(root) {
+		var old legacyConfig
+		issues = append(issues, checkKnownKeys(root, reflect.TypeOf(old), "", nil)...)
+		if err := root.Decode(&old); err != nil {
+			issues = append(issues, decodeIssues(err)...)
+		}
+		cfg = old.migrate()
+		legacy = true
+	} else {
+		lines = make(map[string]int)
+		issues = append(issues, checkKnownKeys(root, reflect.TypeOf(Config{}), "", lines)...)
+		cfg = &Config{}
+		if err := root.Decode(cfg); err != nil {
+			issues = append(issues, decodeIssues(err)...)
+		}
+		if cfg.Version > configVersion {
+			return nil, false, &configError{file, []configIssue{{line: lines["version"], path: "version",
+				msg: fmt.Sprintf("schema version %d is newer than supported (%d); please update ConsoNance", cfg.Version, configVersion)}}}
+		}
+	}
+
+	cfg.applyDefaults()
+	issues = append(issues, cfg.validate(lines)...)
+	if len(issues) > 0 {
+		return nil, legacy, &configError{file, issues}
+	}
+	return cfg, legacy, nil
+}
+
+// isLegacyLayout reports whether the mapping uses keys of the flat layout
+func isLegacyLayout(root *yaml.Node) bool {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		switch root.Content[i].Value {
+		case "discord", "audio", "encoder", "commands", "recording":
+			return false
+		}
+	}
+	return len(root.Content) > 0
+}
+
+// mappingValue returns the value node for key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// checkKnownKeys reports keys that do not exist in the struct type t and
+// records the line of every known key in lines (keyed by dotted path)
+func checkKnownKeys(node *yaml.Node, t reflect.Type, prefix string, lines map[string]int) []configIssue {
+	if node.Kind != yaml.MappingNode {
+		return []configIssue{{line: node.Line, path: strings.TrimSuffix(prefix, "."), msg: "must be a section (key: value mapping)"}}
+	}
+
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = f
+		}
+	}
+
+	var issues []configIssue
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		path := prefix + key.Value
+
+		field, ok := fields[key.Value]
+		if !ok {
+			msg := "unknown key"
+			if prefix == "" {
+				msg = fmt.Sprintf("unknown key (known keys: %s)", knownKeyList(fields))
+			}
+			issues = append(issues, configIssue{line: key.Line, path: path, msg: msg})
+			continue
+		}
+		if seen[key.Value] {
+			issues = append(issues, configIssue{line: key.Line, path: path, msg: "duplicate key"})
+			continue
+		}
+		seen[key.Value] = true
+		if lines != nil {
+			lines[path] = value.Line
+		}
+
+		// 空のセクション（"audio:" のみ）は許可する
+		if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+			continue
+		}
+		issues = append(issues, checkNestedKeys(value, field.Type, path, lines)...)
+	}
+	return issues
+}
+
+// checkNestedKeys checks the keys of a value whose type contains structs:
+// a section, a map of sections (profiles) or a list of sections (devices)
+func checkNestedKeys(node *yaml.Node, t reflect.Type, path string, lines map[string]int) []configIssue {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct:
+		return checkKnownKeys(node, t, path+".", lines)
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		var issues []configIssue
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			entryPath := path + "." + node.Content[i].Value
+			if lines != nil {
+				lines[entryPath] = node.Content[i+1].Line
+			}
+			issues = append(issues, checkNestedKeys(node.Content[i+1], t.Elem(), entryPath, lines)...)
+		}
+		return issues
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		var issues []configIssue
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if lines != nil {
+				lines[itemPath] = item.Line
+			}
+			issues = append(issues, checkNestedKeys(item, t.Elem(), itemPath, lines)...)
+		}
+		return issues
+	}
+	return nil
+}
+
+func knownKeyList(fields map[string]reflect.StructField) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// decodeIssues converts yaml decode errors (which carry line numbers) into issues
+func decodeIssues(err error) []configIssue {
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		issues := make([]configIssue, 0, len(typeErr.Errors))
+		for _, msg := range typeErr.Errors {
+			// "line 9: cannot unmarshal ..." の行番号を取り出す
+			var line int
+			if _, err := fmt.Sscanf(msg, "line %d:", &line); err == nil {
+				msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+			}
+			issues = append(issues, configIssue{line: line, msg: msg})
+		}
+		return issues
+	}
+	return []configIssue{{msg: err.Error()}}
+}
+
+// validate checks value ranges. lines maps dotted paths to line numbers (may be nil).
+func (c *Config) validate(lines map[string]int) []configIssue {
+	var issues []configIssue
+	add := func(path, format string, args ...interface{}) {
+		issues = append(issues, configIssue{line: lines[path], path: path, msg: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Discord.Token != "" && c.Discord.TokenFile != "" {
+		add("discord.token_file", "set either discord.token or discord.token_file, not both")
+	}
+	if c.Discord.GuildID != "" && !isSnowflake(c.Discord.GuildID) {
+		add("discord.guild_id", "must be a numeric Discord ID (got %q)", c.Discord.GuildID)
+	}
+	if c.Discord.ChannelID != "" && !isSnowflake(c.Discord.ChannelID) {
+		add("discord.channel_id", "must be a numeric Discord ID (got %q)", c.Discord.ChannelID)
+	}
+	if c.Discord.ChannelID != "" && c.Discord.GuildID == "" {
+		add("discord.channel_id", "is set but discord.guild_id is empty")
+	}
+
+	if c.Audio.BufferPeriods < 1 || c.Audio.BufferPeriods > 32 {
+		add("audio.buffer_periods", "must be between 1 and 32 (got %d)", c.Audio.BufferPeriods)
+	}
+	if c.Audio.ReturnAudio && c.Audio.ReturnDeviceName != "" && c.Audio.ReturnDeviceName == c.Audio.DeviceName {
+		add("audio.return_device_name", "must differ from audio.device_name to avoid echo")
+	}
+
+	c.Encoder.validate("encoder.", add)
+	c.Audio.Stereo.validate("audio.stereo.", add)
+	c.Audio.DSP.validate("audio.dsp.", add)
+
+	if c.Audio.Profile != "" && c.Audio.Profile != defaultProfileName {
+		if _, ok := c.Profiles[c.Audio.Profile]; !ok {
+			add("audio.profile", "profile %q is not defined in profiles", c.Audio.Profile)
+		}
+	}
+	for _, name := range c.profileNames() {
+		profile := c.Profiles[name]
+		prefix := "profiles." + name + "."
+		if name == defaultProfileName || strings.ContainsAny(name, " \t\n") {
+			add(strings.TrimSuffix(prefix, "."), "%q cannot be used as a profile name", name)
+		}
+		if profile.BufferPeriods != 0 && (profile.BufferPeriods < 1 || profile.BufferPeriods > 32) {
+			add(prefix+"buffer_periods", "must be 0 (audio.buffer_periods) or between 1 and 32 (got %d)", profile.BufferPeriods)
+		}
+		if profile.Encoder != nil {
+			profile.Encoder.validate(prefix+"encoder.", add)
+		}
+		if profile.Stereo != nil {
+			profile.Stereo.validate(prefix+"stereo.", add)
+		}
+		if profile.DSP != nil {
+			profile.DSP.validate(prefix+"dsp.", add)
+		}
+		for i, device := range profile.Devices {
+			path := fmt.Sprintf("%sdevices[%d].", prefix, i)
+			switch device.Mode {
+			case "", "loopback", "capture":
+			case "http":
+				if u, err := url.Parse(device.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					add(path+"url", "must be an http:// or https:// URL (got %q)", device.URL)
+				}
+			case "tcp", "udp":
+				if _, port, err := net.SplitHostPort(device.Listen); err != nil || port == "" {
+					add(path+"listen", "must be host:port, e.g. 127.0.0.1:7000 (got %q)", device.Listen)
+				}
+				switch device.Format {
+				case "", "pcm", "opus":
+				default:
+					add(path+"format", "must be pcm or opus (got %q)", device.Format)
+				}
+			default:
+				add(path+"mode", "must be loopback, capture, http, tcp or udp (got %q)", device.Mode)
+			}
+			if device.BufferMS != 0 && (device.BufferMS < 20 || device.BufferMS > 2000) {
+				add(path+"buffer_ms", "must be 0 (100ms) or between 20 and 2000 (got %d)", device.BufferMS)
+			}
+			if device.Volume < 0 || device.Volume > 200 {
+				add(path+"volume", "must be 0 (100%%) or between 1 and 200 (got %d)", device.Volume)
+			}
+		}
+	}
+
+	for _, id := range c.Commands.AllowedRoleIDs {
+		if !isSnowflake(id) {
+			add("commands.allowed_role_ids", "must contain numeric role IDs (got %q)", id)
+		}
+	}
+	if strings.ContainsAny(c.Commands.Prefix, " \t\n") {
+		add("commands.prefix", "must not contain spaces (got %q)", c.Commands.Prefix)
+	}
+	if languageOfLocale(c.Commands.Language) != c.Commands.Language {
+		add("commands.language", "must be one of %s (got %q)", strings.Join(supportedLanguages, ", "), c.Commands.Language)
+	}
+
+	switch strings.ToLower(c.Recording.Format) {
+	case "ogg", "wav":
+	default:
+		add("recording.format", "must be ogg or wav (got %q)", c.Recording.Format)
+	}
+	if c.Recording.MaxMinutes < 0 {
+		add("recording.max_minutes", "must be 0 or greater (got %d)", c.Recording.MaxMinutes)
+	}
+	if c.Recording.MaxSizeMB < 0 {
+		add("recording.max_size_mb", "must be 0 or greater (got %d)", c.Recording.MaxSizeMB)
+	}
+
+	if _, port, err := net.SplitHostPort(c.StreamServer.Listen); err != nil || port == "" {
+		add("stream_server.listen", "must be host:port, e.g. 127.0.0.1:8090 (got %q)", c.StreamServer.Listen)
+	}
+	if p := c.StreamServer.Path; !strings.HasPrefix(p, "/") || p == "/" || strings.ContainsAny(p, " {}?#") {
+		add("stream_server.path", "must be a path below /, e.g. /stream.opus (got %q)", p)
+	}
+	if c.StreamServer.MaxListeners < 0 {
+		add("stream_server.max_listeners", "must be 0 (20) or greater (got %d)", c.StreamServer.MaxListeners)
+	}
+	if err := checkPipePath(c.Outputs.Pipe.Path); c.Outputs.Pipe.Enabled && err != nil {
+		add("outputs.pipe.path", "%v (got %q)", err, c.Outputs.Pipe.Path)
+	}
+	if _, port, err := net.SplitHostPort(c.Outputs.WebSocket.Listen); err != nil || port == "" {
+		add("outputs.websocket.listen", "must be host:port, e.g. 127.0.0.1:8091 (got %q)", c.Outputs.WebSocket.Listen)
+	}
+	if p := c.Outputs.WebSocket.Path; !strings.HasPrefix(p, "/") || strings.ContainsAny(p, " {}?#") {
+		add("outputs.websocket.path", "must be a path such as /pcm (got %q)", p)
+	}
+	if c.Levels.ClipAlertSeconds < 0 {
+		add("levels.clip_alert_seconds", "must be 0 (off) or greater (got %d)", c.Levels.ClipAlertSeconds)
+	}
+	if c.Levels.SilenceAlertSeconds < 0 {
+		add("levels.silence_alert_seconds", "must be 0 (off) or greater (got %d)", c.Levels.SilenceAlertSeconds)
+	}
+
+	if _, ok := logLevels[c.Logging.Level]; !ok {
+		add("logging.level", "must be debug, info, warn or error (got %q)", c.Logging.Level)
+	}
+	switch c.Logging.Format {
+	case "text", "json":
+	default:
+		add("logging.format", "must be text or json (got %q)", c.Logging.Format)
+	}
+	if c.Logging.MaxSizeMB < 0 {
+		add("logging.max_size_mb", "must be 0 (default) or greater (got %d)", c.Logging.MaxSizeMB)
+	}
+	if c.Logging.MaxAgeDays < 0 {
+		add("logging.max_age_days", "must be 0 (default) or greater (got %d)", c.Logging.MaxAgeDays)
+	}
+	if c.Logging.MaxFiles < 0 {
+		add("logging.max_files", "must be 0 (default) or greater (got %d)", c.Logging.MaxFiles)
+	}
+
+	return issues
+}
+
+// validate checks the encoder settings; prefix is the dotted path of the section
+func (e *EncoderConfig) validate(prefix string, add func(path, format string, args ...interface{})) {
+	if e.BitrateKbps != 0 && (e.BitrateKbps < 6 || e.BitrateKbps > 510) {
+		add(prefix+"bitrate_kbps", "must be 0 (default) or between 6 and 510 (got %d)", e.BitrateKbps)
+	}
+	switch e.Application {
+	case "audio", "voip", "lowdelay":
+	default:
+		add(prefix+"application", "must be audio, voip or lowdelay (got %q)", e.Application)
+	}
+}
+
+func (s *StereoConfig) validate(prefix string, add func(path, format string, args ...interface{})) {
+	switch s.Mode {
+	case "", "stereo", "swap", "mono", "left", "right":
+	default:
+		add(prefix+"mode", "must be %s (got %q)", strings.Join(stereoModes, ", "), s.Mode)
+	}
+	if s.Balance < -100 || s.Balance > 100 {
+		add(prefix+"balance", "must be between -100 (left) and 100 (right) (got %d)", s.Balance)
+	}
+	if s.Width < 0 || s.Width > 200 {
+		add(prefix+"width", "must be 0 (100%%) or between 1 and 200 (got %d)", s.Width)
+	}
+}
+
+func (d *DSPConfig) validate(prefix string, add func(path, format string, args ...interface{})) {
+	// フィルタはナイキスト周波数 (24kHz) 未満でないと係数が壊れる
+	frequency := func(path string, hz float64) {
+		if hz != 0 && (hz < 10 || hz > 20000) {
+			add(prefix+path, "must be 0 (off) or between 10 and 20000 Hz (got %g)", hz)
+		}
+	}
+	frequency("highpass_hz", d.HighPassHz)
+	frequency("lowpass_hz", d.LowPassHz)
+	if d.HighPassHz > 0 && d.LowPassHz > 0 && d.LowPassHz <= d.HighPassHz {
+		add(prefix+"lowpass_hz", "must be above highpass_hz (got %g <= %g)", d.LowPassHz, d.HighPassHz)
+	}
+	if d.NotchHz != 0 && (d.NotchHz < 20 || d.NotchHz > 1000) {
+		add(prefix+"notch_hz", "must be 0 (off) or between 20 and 1000 Hz, usually 50 or 60 (got %g)", d.NotchHz)
+	}
+	for i, band := range d.EQ {
+		path := fmt.Sprintf("eq[%d].", i)
+		if band.Freq < 10 || band.Freq > 20000 {
+			add(prefix+path+"freq", "must be between 10 and 20000 Hz (got %g)", band.Freq)
+		}
+		if band.GainDB < -24 || band.GainDB > 24 {
+			add(prefix+path+"gain_db", "must be between -24 and 24 (got %g)", band.GainDB)
+		}
+		if band.Q != 0 && (band.Q < 0.1 || band.Q > 20) {
+			add(prefix+path+"q", "must be 0 (1) or between 0.1 and 20 (got %g)", band.Q)
+		}
+	}
+
+	c := d.Compressor
+	if c.ThresholdDB != 0 && (c.ThresholdDB < -60 || c.ThresholdDB > -1) {
+		add(prefix+"compressor.threshold_db", "must be 0 (-18) or between -60 and -1 (got %g)", c.ThresholdDB)
+	}
+	if c.Ratio != 0 && (c.Ratio < 1 || c.Ratio > 20) {
+		add(prefix+"compressor.ratio", "must be 0 (4) or between 1 and 20 (got %g)", c.Ratio)
+	}
+	if c.AttackMS < 0 || c.AttackMS > 1000 {
+		add(prefix+"compressor.attack_ms", "must be 0 (10) or up to 1000 (got %g)", c.AttackMS)
+	}
+	if c.ReleaseMS < 0 || c.ReleaseMS > 5000 {
+		add(prefix+"compressor.release_ms", "must be 0 (200) or up to 5000 (got %g)", c.ReleaseMS)
+	}
+	if c.MakeupDB < 0 || c.MakeupDB > 24 {
+		add(prefix+"compressor.makeup_db", "must be between 0 and 24 (got %g)", c.MakeupDB)
+	}
+}
+
+// profileNames returns the names of all profiles in sorted order
+func (c *Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isSnowflake reports whether s looks like a Discord ID
+func isSnowflake(s string) bool {
+	if len(s) < 15 || len(s) > 21 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// loadOrCreateConfig loads config.yaml or creates it if it doesn't exist
+func loadOrCreateConfig() (*Config, error) {
+	// config.yamlが存在するか確認
+	if _, err := os.Stat(configPath); os.IsNotExist(err) && headless {
+		// ヘッドレスモードでは作成せず環境変数だけで動作させる
+		log.Printf("%s not found, using environment variables only", configPath)
+		cfg := &Config{}
+		cfg.applyDefaults()
+		return cfg, nil
+	} else if os.IsNotExist(err) {
+		// 存在しない場合は、テンプレートから作成
+		log.Printf("%s not found. Creating a new one...", configPath)
+		if err := createDefaultConfig(); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %v", configPath, err)
+		}
+		log.Printf("✓ Created %s", configPath)
+	}
+
+	return loadConfig(configPath)
+}
+
+// loadConfig reads the config file at path and migrates an old flat layout in place
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	cfg, legacy, err := parseConfig(data, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy {
+		// 旧形式のファイルはバックアップを残して新形式で書き直す
+		backup := path + ".v1.bak"
+		out, err := renderConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate %s: %v", path, err)
+		}
+		if err := writeFileAtomic(path, out, backup); err != nil {
+			return nil, fmt.Errorf("failed to migrate %s: %v", path, err)
+		}
+		log.Printf("Migrated %s to config schema version %d (old file saved as %s)", path, configVersion, backup)
+	}
+
+	return cfg, nil
+}
+
+// readConfig reads the config file at path without modifying it
+func readConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	cfg, _, err := parseConfig(data, path)
+	return cfg, err
+}
+
+// defaultConfigTemplate is written when no config file exists
+const defaultConfigTemplate = `# ConsoNance Configuration File
+# This file was automatically generated
+
+# Config schema version (do not change)
+version: 2
+
+discord:
+  # Discord Bot Token (REQUIRED)
+  # Get your token from https://discord.com/developers/applications
+  token: ""
+  # Or read the token from a separate file (relative to this file) so that
+  # this config can be shared without the secret, e.g. "discord_token.txt"
+  token_file: ""
+
+  # Auto-connect Settings (Optional)
+  # If you want the bot to automatically join a voice channel on startup,
+  # fill in these values:
+  guild_id: ""
+  channel_id: ""
+
+audio:
+  # Audio Device Settings (Optional)
+  # If not specified, you'll be prompted to select a device from a list at startup
+  # To use a specific device, set the device name:
+  # device_name: "Speakers (Realtek High Definition Audio)"
+  device_name: ""
+
+  # Number of audio buffer periods (affects latency and stability)
+  # 1-32, higher values = more stable but more latency. Recommended: 3-6
+  buffer_periods: 4
+
+  # Join undeafened and decode players' voices. While recording, each speaker
+  # is written to a separate WAV track aligned with the stream recording.
+  receive_voice: false
+
+  # Two-way mode: play the players' voices on a local playback device.
+  # The return device must differ from the loopback capture device.
+  return_audio: false
+  return_device_name: ""
+
+  # Profile used when joining (see profiles below; "" = the settings above)
+  profile: ""
+
+  # Channel layout of the capture (profiles can override it; see README)
+  stereo:
+    mode: "stereo"   # stereo, swap (L/R), mono, left or right (one channel on both)
+    balance: 0       # -100 (left only) to 100 (right only)
+    width: 100       # stereo width in percent (1-200)
+
+  # Filter chain for noisy sources, edited live with "@Bot dsp" (profiles can
+  # override it; see README). 0 / empty = stage off
+  dsp:
+    bypass: false
+    highpass_hz: 0     # cut rumble below this frequency (e.g. 80)
+    lowpass_hz: 0      # cut harsh highs above this frequency (e.g. 12000)
+    notch_hz: 0        # mains hum: 50 or 60 (harmonics are removed too)
+    eq: []             # e.g. [{freq: 3000, gain_db: -4, q: 1.5}]
+    compressor:
+      enabled: false
+      threshold_db: -18
+      ratio: 4
+      attack_ms: 10
+      release_ms: 200
+      makeup_db: 0
+
+encoder:
+  # Opus bitrate in kbps (0 = encoder default, 6-510)
+  bitrate_kbps: 0
+  # audio (music), voip (speech) or lowdelay
+  application: "audio"
+  # Use constant bitrate instead of variable bitrate
+  constant_bitrate: false
+
+commands:
+  # Optional text prefix that works in addition to mentioning the bot (e.g. "!cn")
+  prefix: ""
+  # Role IDs allowed to use commands (empty = everyone)
+  allowed_role_ids: []
+  # Reply language (ja or en) for servers that set none with "@Bot config set language"
+  # and whose community language is neither
+  language: "ja"
+
+recording:
+  # Record the outgoing stream with "@Bot record start" / "@Bot record stop"
+  dir: "recordings"
+  # ogg (Opus frames as sent) or wav (PCM)
+  format: "ogg"
+  # Start recording automatically on join
+  auto_start: false
+  # Start a new file after this many minutes / megabytes (0 = no limit)
+  max_minutes: 0
+  max_size_mb: 0
+
+logging:
+  # debug, info, warn or error (changes apply on reload)
+  level: "info"
+  # text (logfmt) or json, for the log file and the console in headless mode
+  format: "text"
+  # Directory of consonance.log and the rotated consonance_<time>.log files
+  dir: "logs"
+  # Start a new file after this size and every day; delete files older than
+  # max_age_days and keep at most max_files rotated files (0 = default)
+  max_size_mb: 10
+  max_age_days: 30
+  max_files: 20
+
+stream_server:
+  # Serve the stream sent to Discord as Ogg Opus over HTTP for listeners
+  # outside the voice channel (browser, VLC). Changes apply on reload.
+  enabled: false
+  # Use 0.0.0.0:8090 to allow other machines; there is no authentication
+  listen: "127.0.0.1:8090"
+  path: "/stream.opus"
+  max_listeners: 20
+
+outputs:
+  # Raw PCM (48kHz stereo S16LE) of the stream for OBS / ffmpeg (see README).
+  # Changes apply on reload.
+  pipe:
+    enabled: false
+    # FIFO created by the bot (default consonance.pcm, \\.\pipe\consonance on Windows)
+    # path: "consonance.pcm"
+  websocket:
+    enabled: false
+    listen: "127.0.0.1:8091"
+    path: "/pcm"
+
+levels:
+  # Live level meter on the last console line while streaming (not in headless mode)
+  console_meter: true
+  # Warn in the log and the control channel (see README) when the stream
+  # clips for this many seconds in a row / stays silent this long. 0 = off
+  clip_alert_seconds: 3
+  silence_alert_seconds: 60
+
+# Named audio profiles, switched with "@Bot profile <name>" (see README)
+# Each profile can capture from several devices, which are mixed together.
+# Unset values fall back to the audio and encoder sections.
+# profiles:
+#   game:
+#     devices:
+#       - name: "Speakers (Realtek High Definition Audio)"
+#   mic_music:
+#     buffer_periods: 6
+#     devices:
+#       - name: "Speakers (Realtek High Definition Audio)"  # loopback (music player)
+#       - name: "Microphone (USB Audio)"
+#         mode: capture                                    # microphone / line in
+#         volume: 120                                      # percent
+#     encoder:
+#       bitrate_kbps: 96
+#       application: "voip"
+#     stereo:
+#       mode: mono                                         # the microphone is on the left only
+#     dsp:
+#       highpass_hz: 80
+#       notch_hz: 50                                       # hum of the microphone preamp
+#       eq:
+#         - {freq: 250, gain_db: -3, q: 1}                 # less boom
+#       compressor:
+#         enabled: true
+#   remote:
+#     devices:
+#       - mode: http                                       # Icecast / HTTP Ogg Opus stream
+#         url: "http://192.168.1.20:8000/live.opus"
+#       - mode: udp                                        # raw audio from another machine
+#         listen: "0.0.0.0:7000"
+#         format: pcm                                      # pcm (48kHz stereo S16LE) or opus
+#         buffer_ms: 100                                   # jitter buffer
+profiles: {}
+`
+
+// createDefaultConfig creates a default config.yaml file
+func createDefaultConfig() error {
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	return writeFileAtomic(configPath, []byte(defaultConfigTemplate), "")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// envPrefix starts the override variable of every config field,
+	// e.g. audio.buffer_periods is CONSONANCE_AUDIO_BUFFER_PERIODS
+	envPrefix = "CONSONANCE_"
+
+	envConfigPath   = "CONSONANCE_CONFIG"
+	envDiscordToken = "CONSONANCE_DISCORD_TOKEN"
+	envAudioDevice  = "CONSONANCE_AUDIO_DEVICE_NAME"
+)
+
+// defaultConfigPath returns the config file used when --config is not given:
+// CONSONANCE_CONFIG, then ./config.yaml if it exists (older setups), then the
+// per-user config directory ($XDG_CONFIG_HOME/consonance on Linux,
+// %AppData%\consonance on Windows, ~/Library/Application Support/consonance on macOS)
+func defaultConfigPath() string {
+	if v := os.Getenv(envConfigPath); v != "" {
+		return v
+	}
+	if _, err := os.Stat("config.yaml"); err == nil {
+		return "config.yaml"
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "config.yaml"
+	}
+	return filepath.Join(dir, "consonance", "config.yaml")
+}
+
+// applyEnvironment overrides config fields from CONSONANCE_* environment
+// variables and reads the token from discord.token_file when it is not set
+func applyEnvironment(cfg *Config) error {
+	var issues []configIssue
+	applied := applyEnvOverrides(reflect.ValueOf(cfg).Elem(), envPrefix, &issues)
+	if len(issues) > 0 {
+		return &configError{"environment", issues}
+	}
+
+	// 環境変数のトークンはtoken_fileより優先する
+	if os.Getenv(envDiscordToken) != "" {
+		cfg.Discord.TokenFile = ""
+	}
+
+	// 環境変数で値が変わった場合は範囲などを再検証する
+	if applied {
+		if issues := cfg.validate(nil); len(issues) > 0 {
+			return &configError{"environment", issues}
+		}
+	}
+
+	if cfg.Discord.Token == "" && cfg.Discord.TokenFile != "" {
+		data, err := os.ReadFile(tokenFilePath(cfg))
+		if err != nil {
+			return fmt.Errorf("failed to read discord.token_file: %v", err)
+		}
+		cfg.Discord.Token = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// applyEnvOverrides sets every field of the struct v that has a variable named
+// prefix + its upper-cased yaml path. It reports whether anything was set.
+func applyEnvOverrides(v reflect.Value, prefix string, issues *[]configIssue) bool {
+	applied := false
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" || key == "version" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if applyEnvOverrides(field, name+"_", issues) {
+				applied = true
+			}
+			continue
+		}
+		if field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.Struct {
+			// 未設定 (nil) のセクションは変数があるときだけ作る
+			section := reflect.New(field.Type().Elem())
+			if !field.IsNil() {
+				section.Elem().Set(field.Elem())
+			}
+			if applyEnvOverrides(section.Elem(), name+"_", issues) {
+				field.Set(section)
+				applied = true
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := setFieldFromString(field, value); err != nil {
+			*issues = append(*issues, configIssue{path: name, msg: err.Error()})
+			continue
+		}
+		applied = true
+	}
+	return applied
+}
+
+// setFieldFromString parses an environment variable value into a config field.
+// Lists are comma separated. Maps and lists of sections (profiles, EQ bands)
+// can only be set in the config file.
+func setFieldFromString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be an integer (got %q)", value)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a non-negative integer (got %q)", value)
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), field.Type().Bits())
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("must be a number (got %q)", value)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("must be true or false (got %q)", value)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("is a list of sections and can only be set in the config file")
+		}
+		items := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = reflect.Append(items, reflect.ValueOf(item).Convert(field.Type().Elem()))
+			}
+		}
+		field.Set(items)
+	case reflect.Pointer:
+		// 未設定 (nil) の値は新しく作ってから設定する
+		elem := reflect.New(field.Type().Elem())
+		if err := setFieldFromString(elem.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(elem)
+	default:
+		return fmt.Errorf("can only be set in the config file")
+	}
+	return nil
+}
+
+// tokenFilePath resolves discord.token_file relative to the config file
+func tokenFilePath(cfg *Config) string {
+	path := cfg.Discord.TokenFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(configPath), path)
+	}
+	return path
+}
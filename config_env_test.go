@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// envLeaf is a config field that has its own override variable
+type envLeaf struct {
+	name string
+	path []string // Go field names from Config
+	typ  reflect.Type
+}
+
+// envLeaves lists every leaf field of the struct type t, following sections
+// the same way applyEnvOverrides does
+func envLeaves(t reflect.Type, prefix string, path []string) []envLeaf {
+	var leaves []envLeaf
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" || key == "version" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		fieldPath := append(append([]string(nil), path...), f.Name)
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			leaves = append(leaves, envLeaves(f.Type, name+"_", fieldPath)...)
+		case f.Type.Kind() == reflect.Pointer && f.Type.Elem().Kind() == reflect.Struct:
+			leaves = append(leaves, envLeaves(f.Type.Elem(), name+"_", fieldPath)...)
+		default:
+			leaves = append(leaves, envLeaf{name, fieldPath, f.Type})
+		}
+	}
+	return leaves
+}
+
+// envSample returns a variable value for a field of type t and how the field
+// prints after it is set; ok is false for types that only the config file sets
+func envSample(t reflect.Type) (value, want string, ok bool) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "x", "x", true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "7", "7", true
+	case reflect.Float32, reflect.Float64:
+		return "1.5", "1.5", true
+	case reflect.Bool:
+		return "true", "true", true
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return "a, b", "[a b]", true
+		}
+	}
+	return "x", "", false
+}
+
+func TestEnvOverridesEveryField(t *testing.T) {
+	leaves := envLeaves(reflect.TypeOf(Config{}), envPrefix, nil)
+	for _, leaf := range leaves {
+		value, _, _ := envSample(leaf.typ)
+		t.Setenv(leaf.name, value)
+	}
+
+	var cfg Config
+	var issues []configIssue
+	applyEnvOverrides(reflect.ValueOf(&cfg).Elem(), envPrefix, &issues)
+	rejected := make(map[string]bool)
+	for _, issue := range issues {
+		rejected[issue.path] = true
+	}
+
+	for _, leaf := range leaves {
+		_, want, ok := envSample(leaf.typ)
+		if !ok {
+			if !rejected[leaf.name] {
+				t.Errorf("%s (%s): no error for a field the environment cannot set", leaf.name, leaf.typ)
+			}
+			continue
+		}
+		if rejected[leaf.name] {
+			t.Errorf("%s (%s): rejected", leaf.name, leaf.typ)
+			continue
+		}
+		v := reflect.ValueOf(cfg)
+		for _, name := range leaf.path {
+			v = reflect.Indirect(v).FieldByName(name)
+		}
+		if got := fmt.Sprint(reflect.Indirect(v).Interface()); got != want {
+			t.Errorf("%s = %s, want %s", leaf.name, got, want)
+		}
+	}
+}
+
+func TestEnvOverrideInvalidValues(t *testing.T) {
+	t.Setenv("CONSONANCE_AUDIO_BUFFER_PERIODS", "six")
+	t.Setenv("CONSONANCE_RECORDING_AUTO_START", "maybe")
+	t.Setenv("CONSONANCE_PROFILES", "game")
+
+	var cfg Config
+	var issues []configIssue
+	applyEnvOverrides(reflect.ValueOf(&cfg).Elem(), envPrefix, &issues)
+	var paths []string
+	for _, issue := range issues {
+		paths = append(paths, issue.path)
+	}
+	want := []string{"CONSONANCE_AUDIO_BUFFER_PERIODS", "CONSONANCE_RECORDING_AUTO_START", "CONSONANCE_PROFILES"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("issues at %v, want %v", paths, want)
+	}
+}
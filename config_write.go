@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configBackupSuffix is appended to the config path for the copy kept before each write
+const configBackupSuffix = ".bak"
+
+// editConfigFile applies edit to the YAML node tree of the config file and
+// writes it back. Comments and key order are kept; the result is validated
+// before it replaces the file, so a bad edit never reaches the disk.
+func editConfigFile(path string, edit func(root *yaml.Node) error) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	doc, err := parseConfigNode(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if err := edit(doc.Content[0]); err != nil {
+		return err
+	}
+
+	out, err := encodeConfigNode(doc)
+	if err != nil {
+		return err
+	}
+	if _, _, err := parseConfig(out, path); err != nil {
+		return fmt.Errorf("refusing to write %s: %v", path, err)
+	}
+
+	backup := ""
+	if data != nil {
+		backup = path + configBackupSuffix
+	}
+	return writeFileAtomic(path, out, backup)
+}
+
+// parseConfigNode parses config file contents into a document node whose
+// root is a mapping. An empty file starts from the default template.
+func parseConfigNode(data []byte) (*yaml.Node, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte(defaultConfigTemplate)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("top level must be a mapping of settings")
+	}
+	return &doc, nil
+}
+
+// encodeConfigNode renders a document node with the indentation used by the template
+func encodeConfigNode(doc *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// setConfigValue sets the value at a dotted path (e.g. "audio.device_name"),
+// creating missing sections. Comments and the quoting style of an existing
+// scalar are kept.
+func setConfigValue(root *yaml.Node, path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+	node := root
+	for i, key := range keys {
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s is not a section", strings.Join(keys[:i], "."))
+		}
+
+		child := mappingValue(node, key)
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+		}
+
+		if i == len(keys)-1 {
+			return replaceNodeValue(child, value)
+		}
+		node = child
+	}
+	return nil
+}
+
+// replaceNodeValue encodes value into node in place
+func replaceNodeValue(node *yaml.Node, value interface{}) error {
+	var encoded yaml.Node
+	if err := encoded.Encode(value); err != nil {
+		return fmt.Errorf("failed to encode config value: %v", err)
+	}
+
+	// 既存のコメントと引用符のスタイルは引き継ぐ
+	encoded.HeadComment = node.HeadComment
+	encoded.LineComment = node.LineComment
+	encoded.FootComment = node.FootComment
+	if node.Kind == yaml.ScalarNode && encoded.Kind == yaml.ScalarNode && encoded.Tag == "!!str" &&
+		(node.Style == yaml.DoubleQuotedStyle || node.Style == yaml.SingleQuotedStyle) {
+		encoded.Style = node.Style
+	}
+	*node = encoded
+	return nil
+}
+
+// mergeConfigValues copies every value of src (a mapping) into dst, keeping
+// the comments and order of dst and appending keys that dst lacks
+func mergeConfigValues(dst, src *yaml.Node) error {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		target := mappingValue(dst, key.Value)
+
+		if target != nil && target.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			if err := mergeConfigValues(target, value); err != nil {
+				return err
+			}
+			continue
+		}
+		if target == nil {
+			dst.Content = append(dst.Content, key, value)
+			continue
+		}
+		if err := replaceNodeValue(target, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderConfig renders cfg on top of the commented default template
+func renderConfig(cfg *Config) ([]byte, error) {
+	doc, err := parseConfigNode(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var values yaml.Node
+	if err := values.Encode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %v", err)
+	}
+	if err := mergeConfigValues(doc.Content[0], &values); err != nil {
+		return nil, err
+	}
+	return encodeConfigNode(doc)
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory and a rename, so a crash never leaves a half-written file.
+// If backup is not empty the previous contents are kept there.
+func writeFileAtomic(path string, data []byte, backup string) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %v", path, err)
+	}
+	tmpPath := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		return fail(fmt.Errorf("failed to write %s: %v", tmpPath, err))
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync %s: %v", tmpPath, err))
+	}
+
+	// 元のファイルのパーミッションを引き継ぐ（トークンを含むため）
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return fail(fmt.Errorf("failed to set permissions of %s: %v", tmpPath, err))
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close %s: %v", tmpPath, err)
+	}
+
+	if backup != "" {
+		if err := copyFile(path, backup, mode); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to back up %s: %v", path, err)
+		}
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	return nil
+}
+
+// copyFile copies src to dst, replacing dst
+func copyFile(src, dst string, mode os.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, mode)
+}
+
+// saveDeviceToConfig saves the selected audio device to the config file
+func saveDeviceToConfig(deviceName string) error {
+	return editConfigFile(configPath, func(root *yaml.Node) error {
+		return setConfigValue(root, "audio.device_name", deviceName)
+	})
+}
+
+// saveTokenToConfig saves the Discord token to the config file,
+// or to discord.token_file if one is configured
+func saveTokenToConfig(token string) error {
+	if config != nil && config.Discord.TokenFile != "" {
+		path := tokenFilePath(config)
+		if err := writeFileAtomic(path, []byte(token+"\n"), ""); err != nil {
+			return err
+		}
+		// トークンファイルは本人以外読めないようにする
+		return os.Chmod(path, 0600)
+	}
+
+	return editConfigFile(configPath, func(root *yaml.Node) error {
+		return setConfigValue(root, "discord.token", token)
+	})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// testToneAmplitude is the level of the test signals (-12 dBFS)
+	testToneAmplitude = 0.25
+
+	// diagDuration is how long "@Bot diag" measures the stream
+	diagDuration = 10 * time.Second
+
+	// diagLateInterval is the gap between frames counted as a late frame
+	diagLateInterval = 30 * time.Millisecond
+
+	// diagSilentDB is the peak level below which the stream counts as silent
+	diagSilentDB = -50.0
+
+	// diagColorIssues is the embed color of a report with problems
+	diagColorIssues = 0xe67e22
+)
+
+var (
+	// errDiagBusy is returned when a measurement is already running
+	errDiagBusy = newUserError("diag_busy")
+
+	// errDiagStopped is returned when the stream stops during a measurement
+	errDiagStopped = newUserError("diag_stopped")
+)
+
+// testSignal is a generated diagnostic signal that replaces the captured
+// audio frame by frame, so it goes through the same encoder and outputs
+type testSignal struct {
+	name  string
+	total int // 長さ（1チャンネルあたりのサンプル数）
+	pos   int
+	// sample returns the left and right value (-1..1) at sample position n
+	sample func(n int) (left, right float64)
+}
+
+// Fill writes the next 20ms of the signal into pcm. It returns false once the signal has ended.
+func (t *testSignal) Fill(pcm []int16) bool {
+	if t.pos >= t.total {
+		return false
+	}
+	frames := len(pcm) / outputChannels
+	for i := 0; i < frames; i++ {
+		var l, r float64
+		if t.pos+i < t.total {
+			l, r = t.sample(t.pos + i)
+		}
+		pcm[i*2] = int16(l * 32767)
+		pcm[i*2+1] = int16(r * 32767)
+	}
+	t.pos += frames
+	return true
+}
+
+func secondsToSamples(seconds float64) int {
+	return int(seconds * outputSampleRate)
+}
+
+// newToneSignal is a sine of freq Hz on both channels
+func newToneSignal(freq, seconds float64) *testSignal {
+	return &testSignal{
+		name:  fmt.Sprintf("tone %.0f Hz, %.1f s", freq, seconds),
+		total: secondsToSamples(seconds),
+		sample: func(n int) (float64, float64) {
+			v := testToneAmplitude * math.Sin(2*math.Pi*freq*float64(n)/outputSampleRate)
+			return v, v
+		},
+	}
+}
+
+// newChannelSignal identifies the channels: 440 Hz on the left only, then
+// 880 Hz on the right only, twice, with short pauses in between
+func newChannelSignal() *testSignal {
+	const cycle = 3 * outputSampleRate // 左1秒・無音0.5秒・右1秒・無音0.5秒
+	return &testSignal{
+		name:  "left / right",
+		total: 2 * cycle,
+		sample: func(n int) (float64, float64) {
+			t := n % cycle
+			switch {
+			case t < outputSampleRate:
+				return testToneAmplitude * math.Sin(2*math.Pi*440*float64(n)/outputSampleRate), 0
+			case t >= outputSampleRate*3/2 && t < outputSampleRate*5/2:
+				return 0, testToneAmplitude * math.Sin(2*math.Pi*880*float64(n)/outputSampleRate)
+			}
+			return 0, 0
+		},
+	}
+}
+
+// newSweepSignal is a logarithmic sweep from 20 Hz to 20 kHz
+func newSweepSignal(seconds float64) *testSignal {
+	const f0, f1 = 20.0, 20000.0
+	k := math.Log(f1 / f0)
+	return &testSignal{
+		name:  fmt.Sprintf("sweep 20 Hz - 20 kHz, %.1f s", seconds),
+		total: secondsToSamples(seconds),
+		sample: func(n int) (float64, float64) {
+			t := float64(n) / outputSampleRate
+			phase := 2 * math.Pi * f0 * seconds / k * (math.Exp(t/seconds*k) - 1)
+			v := testToneAmplitude * math.Sin(phase)
+			return v, v
+		},
+	}
+}
+
+// newClickSignal is a 10ms click every second for checking audio/video sync.
+// Every fourth click is higher (2 kHz instead of 1 kHz) to count bars.
+func newClickSignal(seconds float64) *testSignal {
+	const clickLength = outputSampleRate / 100 // 10ms
+	return &testSignal{
+		name:  fmt.Sprintf("sync click, %.1f s", seconds),
+		total: secondsToSamples(seconds),
+		sample: func(n int) (float64, float64) {
+			t := n % outputSampleRate
+			if t >= clickLength {
+				return 0, 0
+			}
+			freq := 1000.0
+			if n/outputSampleRate%4 == 0 {
+				freq = 2000
+			}
+			// 立ち上がりを揃えるため常に位相0から始める
+			v := 2 * testToneAmplitude * math.Sin(2*math.Pi*freq*float64(t)/outputSampleRate)
+			return v, v
+		},
+	}
+}
+
+// testSignalPlayer holds the test signal that replaces the stream audio
+type testSignalPlayer struct {
+	mu     sync.Mutex
+	signal *testSignal
+}
+
+// testSignals is the test signal player of the stream
+var testSignals = &testSignalPlayer{}
+
+// Start replaces the stream audio with the signal, ending any earlier one
+func (p *testSignalPlayer) Start(signal *testSignal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.signal = signal
+	log.Printf("Test signal started: %s", signal.name)
+}
+
+// Stop ends the current signal. It reports whether one was playing.
+func (p *testSignalPlayer) Stop() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	playing := p.signal != nil
+	p.signal = nil
+	return playing
+}
+
+// Apply replaces the frame with the test signal while one is playing.
+// It is called from the audio callback for every frame.
+func (p *testSignalPlayer) Apply(frame []int16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.signal == nil {
+		return
+	}
+	if !p.signal.Fill(frame) {
+		log.Printf("Test signal finished: %s", p.signal.name)
+		p.signal = nil
+	}
+}
+
+// diagProbe measures the frames of the pipeline while a diagnosis runs
+type diagProbe struct {
+	active atomic.Bool
+
+	mu        sync.Mutex
+	frames    int
+	last      time.Time
+	intervals []time.Duration
+}
+
+// diagnostics is the probe of the stream
+var diagnostics = &diagProbe{}
+
+// observe records the arrival of one captured frame. The level is collected
+// by levels. It is called from the audio callback for every frame.
+func (d *diagProbe) observe() {
+	if !d.active.Load() {
+		return
+	}
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.frames++
+	if !d.last.IsZero() {
+		d.intervals = append(d.intervals, now.Sub(d.last))
+	}
+	d.last = now
+}
+
+// begin starts a measurement; it returns false when one is already running
+func (d *diagProbe) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active.Load() {
+		return false
+	}
+	d.frames, d.last, d.intervals = 0, time.Time{}, d.intervals[:0]
+	levels.startProbe()
+	d.active.Store(true)
+	return true
+}
+
+// end stops the measurement and fills the frame and level results of report
+func (d *diagProbe) end(report *diagReport) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active.Store(false)
+
+	report.frames = d.frames
+	measured := levels.stopProbe()
+	level := measured.total()
+	report.peakDB, report.rmsDB = level.peakDB, level.rmsDB
+	report.clipped = measured.clipped
+
+	if len(d.intervals) == 0 {
+		return
+	}
+	var sum, sumSquares float64
+	report.minInterval = d.intervals[0]
+	for _, iv := range d.intervals {
+		ms := float64(iv) / float64(time.Millisecond)
+		sum += ms
+		sumSquares += ms * ms
+		report.minInterval = min(report.minInterval, iv)
+		report.maxInterval = max(report.maxInterval, iv)
+		if iv > diagLateInterval {
+			report.lateFrames++
+		}
+	}
+	n := float64(len(d.intervals))
+	report.meanIntervalMS = sum / n
+	report.jitterMS = math.Sqrt(max(sumSquares/n-report.meanIntervalMS*report.meanIntervalMS, 0))
+}
+
+// diagReport is the result of "@Bot diag"
+type diagReport struct {
+	duration      time.Duration
+	frames        int
+	framesSent    uint64
+	framesDropped uint64
+	bufferLatency time.Duration
+
+	meanIntervalMS float64
+	jitterMS       float64
+	minInterval    time.Duration
+	maxInterval    time.Duration
+	lateFrames     int
+
+	peakDB  float64
+	rmsDB   float64
+	clipped int
+}
+
+// expectedFrames is the number of 20ms frames in the measured time
+func (r diagReport) expectedFrames() int {
+	return int(r.duration / (20 * time.Millisecond))
+}
+
+// runDiagnostics measures the running stream for duration. It fails when
+// the stream stops or restarts in the meantime.
+func runDiagnostics(ctx context.Context, duration time.Duration) (diagReport, error) {
+	before := stats.snapshot()
+	if !before.running {
+		return diagReport{}, errDiagStopped
+	}
+	if !diagnostics.begin() {
+		return diagReport{}, errDiagBusy
+	}
+	// 途中で失敗しても計測は必ず止める
+	report := diagReport{duration: duration}
+	defer diagnostics.end(&diagReport{})
+
+	deadline := time.NewTimer(duration)
+	defer deadline.Stop()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-ctx.Done():
+			return diagReport{}, ctx.Err()
+		case <-deadline.C:
+			waiting = false
+		case <-ticker.C:
+			if now := stats.snapshot(); !now.running || !now.startedAt.Equal(before.startedAt) {
+				return diagReport{}, errDiagStopped
+			}
+		}
+	}
+
+	after := stats.snapshot()
+	if !after.startedAt.Equal(before.startedAt) {
+		return diagReport{}, errDiagStopped
+	}
+	diagnostics.end(&report)
+	report.framesSent = after.framesSent - before.framesSent
+	report.framesDropped = after.framesDropped - before.framesDropped
+	report.bufferLatency = after.bufferLatency
+	return report, nil
+}
+
+// issues returns the problems found in the report as localized lines
+func (r diagReport) issues(lang string) []string {
+	var issues []string
+	if r.framesDropped > 0 {
+		issues = append(issues, tr(lang, "diag_issue_dropped", r.framesDropped))
+	}
+	if expected := r.expectedFrames(); r.frames < expected*95/100 {
+		issues = append(issues, tr(lang, "diag_issue_slow", r.frames, expected))
+	}
+	if r.maxInterval > 3*diagLateInterval {
+		issues = append(issues, tr(lang, "diag_issue_jitter", r.maxInterval.Milliseconds()))
+	}
+	if r.peakDB < diagSilentDB {
+		issues = append(issues, tr(lang, "diag_issue_silent"))
+	}
+	if r.clipped > 0 {
+		issues = append(issues, tr(lang, "diag_issue_clipping", r.clipped))
+	}
+	return issues
+}
+
+// embed formats the report for Discord
+func (r diagReport) embed(lang string) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title:     tr(lang, "diag_title", int(r.duration.Seconds())),
+		Color:     statusColorStreaming,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+
+	issues := r.issues(lang)
+	if len(issues) == 0 {
+		embed.Description = tr(lang, "diag_ok")
+	} else {
+		embed.Color = diagColorIssues
+		for _, issue := range issues {
+			embed.Description += "⚠️ " + issue + "\n"
+		}
+	}
+
+	embed.Fields = []*discordgo.MessageEmbedField{
+		{Name: tr(lang, "diag_frames"), Value: fmt.Sprintf("%d / %d", r.frames, r.expectedFrames()), Inline: true},
+		{Name: tr(lang, "status_frames"), Value: fmt.Sprintf("%d / %d", r.framesSent, r.framesDropped), Inline: true},
+		{Name: tr(lang, "status_buffer"), Value: fmt.Sprintf("~%d ms", r.bufferLatency.Milliseconds()), Inline: true},
+		{Name: tr(lang, "diag_cadence"), Value: fmt.Sprintf("%.1f ms ± %.1f ms (%d–%d ms)",
+			r.meanIntervalMS, r.jitterMS, r.minInterval.Milliseconds(), r.maxInterval.Milliseconds())},
+		{Name: tr(lang, "diag_late"), Value: fmt.Sprintf("%d", r.lateFrames), Inline: true},
+		{Name: tr(lang, "diag_clipped"), Value: fmt.Sprintf("%d", r.clipped), Inline: true},
+		{Name: tr(lang, "diag_level"), Value: fmt.Sprintf("`%s` %s / %s dBFS",
+			levelBar(r.peakDB, 20), formatDB(r.peakDB), formatDB(r.rmsDB))},
+	}
+	return embed
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// framePeak returns the loudest sample of each channel
+func framePeak(pcm []int16) (left, right int) {
+	for i := 0; i < len(pcm); i += 2 {
+		left = max(left, int(math.Abs(float64(pcm[i]))))
+		right = max(right, int(math.Abs(float64(pcm[i+1]))))
+	}
+	return left, right
+}
+
+func TestTestSignalEnds(t *testing.T) {
+	signal := newToneSignal(1000, 0.05) // 2.5フレーム分
+	frame := make([]int16, 960*outputChannels)
+
+	for i := 0; i < 3; i++ {
+		if !signal.Fill(frame) {
+			t.Fatalf("signal ended after %d frames, want 3", i)
+		}
+	}
+	// 最後のフレームは後半が無音になる
+	if l, _ := framePeak(frame[:960]); l < 8000 {
+		t.Errorf("first half of the last frame peaks at %d", l)
+	}
+	if l, r := framePeak(frame[960:]); l != 0 || r != 0 {
+		t.Errorf("second half of the last frame = %d/%d, want silence", l, r)
+	}
+	if signal.Fill(frame) {
+		t.Error("signal still playing after its length")
+	}
+}
+
+func TestChannelSignalSeparatesChannels(t *testing.T) {
+	signal := newChannelSignal()
+	frame := make([]int16, 960*outputChannels)
+
+	// 0〜1秒は左だけ、1.5〜2.5秒は右だけ
+	for i := 0; i < 150; i++ {
+		signal.Fill(frame)
+		l, r := framePeak(frame)
+		switch {
+		case i < 50 && (l < 8000 || r != 0):
+			t.Fatalf("frame %d (left tone) = %d/%d", i, l, r)
+		case i >= 75 && i < 125 && (l != 0 || r < 8000):
+			t.Fatalf("frame %d (right tone) = %d/%d", i, l, r)
+		case (i >= 50 && i < 75 || i >= 125) && (l != 0 || r != 0):
+			t.Fatalf("frame %d (pause) = %d/%d", i, l, r)
+		}
+	}
+}
+
+func TestTestSignalReplacesStream(t *testing.T) {
+	setupTestBot(t, nil)
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "captured audio", func() bool { return levels.snapshot().total.peakDB > -7 })
+
+	// 合成音源 (-6 dBFS) の代わりにテストトーン (-12 dBFS) が流れる
+	testSignals.Start(newToneSignal(1000, 5))
+	waitFor(t, 3*time.Second, "the test tone", func() bool {
+		db := levels.snapshot().total.peakDB
+		return db > -13 && db < -11
+	})
+
+	if !testSignals.Stop() {
+		t.Fatal("Stop reported no playing signal")
+	}
+	waitFor(t, 3*time.Second, "captured audio after stop", func() bool { return levels.snapshot().total.peakDB > -7 })
+}
+
+func TestDiagnosticsMeasuresStream(t *testing.T) {
+	setupTestBot(t, nil)
+	if _, err := runDiagnostics(context.Background(), time.Second); err != errDiagStopped {
+		t.Fatalf("diagnostics while idle: %v, want errDiagStopped", err)
+	}
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "the pipeline", func() bool { return stats.snapshot().running })
+
+	done := make(chan struct{})
+	var report diagReport
+	var err error
+	go func() {
+		defer close(done)
+		report, err = runDiagnostics(context.Background(), time.Second)
+	}()
+	waitFor(t, time.Second, "the measurement", diagnostics.active.Load)
+	if _, busy := runDiagnostics(context.Background(), time.Second); busy != errDiagBusy {
+		t.Errorf("second measurement: %v, want errDiagBusy", busy)
+	}
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.expectedFrames() != 50 || report.frames < 40 || report.frames > 55 {
+		t.Errorf("frames = %d / %d, want about 50", report.frames, report.expectedFrames())
+	}
+	if report.meanIntervalMS < 15 || report.meanIntervalMS > 25 {
+		t.Errorf("mean interval = %.1f ms, want about 20", report.meanIntervalMS)
+	}
+	if report.peakDB < -7 || report.peakDB > -5 {
+		t.Errorf("peak = %.1f dBFS, want about -6", report.peakDB)
+	}
+	if report.clipped != 0 {
+		t.Errorf("clipped = %d, want 0", report.clipped)
+	}
+	for _, issue := range report.issues("en") {
+		if issue == tr("en", "diag_issue_silent") {
+			t.Errorf("a -6 dBFS sine was reported silent")
+		}
+	}
+}
+
+func TestDiagnosticsStopsWithStream(t *testing.T) {
+	setupTestBot(t, nil)
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "the pipeline", func() bool { return stats.snapshot().running })
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := runDiagnostics(context.Background(), 10*time.Second)
+		errs <- err
+	}()
+	waitFor(t, time.Second, "the measurement", diagnostics.active.Load)
+	leaveVoiceChannel()
+
+	select {
+	case err := <-errs:
+		if err != errDiagStopped {
+			t.Errorf("err = %v, want errDiagStopped", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("diagnostics kept running after the bot left")
+	}
+	if diagnostics.active.Load() {
+		t.Error("probe still active after the measurement failed")
+	}
+}
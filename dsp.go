@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// dspNotchQ is the quality of the hum notches (narrow, so music is barely touched)
+	dspNotchQ = 10
+
+	// dspNotchHarmonics is how many multiples of notch_hz are removed (50, 100, 150 Hz)
+	dspNotchHarmonics = 3
+
+	// dspFilterQ is the Q of the high-pass and low-pass filters (Butterworth)
+	dspFilterQ = math.Sqrt2 / 2
+)
+
+// q returns the bandwidth of an EQ band
+func (b EQBand) q() float64 {
+	if b.Q == 0 {
+		return 1
+	}
+	return b.Q
+}
+
+// withDefaults fills in the unset compressor values
+func (c CompressorConfig) withDefaults() CompressorConfig {
+	if c.ThresholdDB == 0 {
+		c.ThresholdDB = -18
+	}
+	if c.Ratio == 0 {
+		c.Ratio = 4
+	}
+	if c.AttackMS == 0 {
+		c.AttackMS = 10
+	}
+	if c.ReleaseMS == 0 {
+		c.ReleaseMS = 200
+	}
+	return c
+}
+
+// String formats the chain for logs and chat, e.g. "HPF 80 Hz → notch 50 Hz → comp -18 dB 4:1"
+func (c DSPConfig) String() string {
+	var stages []string
+	if c.HighPassHz > 0 {
+		stages = append(stages, fmt.Sprintf("HPF %g Hz", c.HighPassHz))
+	}
+	if c.NotchHz > 0 {
+		stages = append(stages, fmt.Sprintf("notch %g Hz", c.NotchHz))
+	}
+	for _, band := range c.EQ {
+		stages = append(stages, fmt.Sprintf("EQ %g Hz %+g dB Q%g", band.Freq, band.GainDB, band.q()))
+	}
+	if c.LowPassHz > 0 {
+		stages = append(stages, fmt.Sprintf("LPF %g Hz", c.LowPassHz))
+	}
+	if c.Compressor.Enabled {
+		comp := c.Compressor.withDefaults()
+		text := fmt.Sprintf("comp %g dB %g:1", comp.ThresholdDB, comp.Ratio)
+		if comp.MakeupDB != 0 {
+			text += fmt.Sprintf(" %+g dB", comp.MakeupDB)
+		}
+		stages = append(stages, text)
+	}
+	if len(stages) == 0 {
+		return "off"
+	}
+	text := strings.Join(stages, " → ")
+	if c.Bypass {
+		text = "bypass (" + text + ")"
+	}
+	return text
+}
+
+// clone returns a copy that does not share the EQ bands
+func (c DSPConfig) clone() DSPConfig {
+	c.EQ = append([]EQBand(nil), c.EQ...)
+	return c
+}
+
+// biquad is a second-order IIR filter with separate state for both channels
+// (coefficients from the RBJ Audio EQ Cookbook)
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     [2]float64
+}
+
+// newBiquad normalizes the cookbook coefficients by a0
+func newBiquad(b0, b1, b2, a0, a1, a2 float64) *biquad {
+	return &biquad{b0: b0 / a0, b1: b1 / a0, b2: b2 / a0, a1: a1 / a0, a2: a2 / a0}
+}
+
+// filterParams returns cos(w0) and alpha of a filter at freq with quality q
+func filterParams(freq, q float64) (cosw, alpha float64) {
+	w0 := 2 * math.Pi * freq / outputSampleRate
+	return math.Cos(w0), math.Sin(w0) / (2 * q)
+}
+
+func newHighPass(freq float64) *biquad {
+	cosw, alpha := filterParams(freq, dspFilterQ)
+	return newBiquad((1+cosw)/2, -(1 + cosw), (1+cosw)/2, 1+alpha, -2*cosw, 1-alpha)
+}
+
+func newLowPass(freq float64) *biquad {
+	cosw, alpha := filterParams(freq, dspFilterQ)
+	return newBiquad((1-cosw)/2, 1-cosw, (1-cosw)/2, 1+alpha, -2*cosw, 1-alpha)
+}
+
+func newNotch(freq, q float64) *biquad {
+	cosw, alpha := filterParams(freq, q)
+	return newBiquad(1, -2*cosw, 1, 1+alpha, -2*cosw, 1-alpha)
+}
+
+func newPeaking(freq, gainDB, q float64) *biquad {
+	cosw, alpha := filterParams(freq, q)
+	a := math.Pow(10, gainDB/40)
+	return newBiquad(1+alpha*a, -2*cosw, 1-alpha*a, 1+alpha/a, -2*cosw, 1-alpha/a)
+}
+
+// process filters one sample of channel ch
+func (f *biquad) process(ch int, x float64) float64 {
+	y := f.b0*x + f.b1*f.x1[ch] + f.b2*f.x2[ch] - f.a1*f.y1[ch] - f.a2*f.y2[ch]
+	f.x2[ch], f.x1[ch] = f.x1[ch], x
+	f.y2[ch], f.y1[ch] = f.y1[ch], y
+	return y
+}
+
+// compressor is a stereo-linked feed-forward compressor
+type compressor struct {
+	thresholdDB float64
+	ratio       float64
+	makeup      float64 // 倍率
+	attack      float64 // エンベロープの追従係数
+	release     float64
+	envelope    float64 // 0〜1 (フルスケール)
+	reductionDB float64 // 直近のゲインリダクション（表示用）
+}
+
+func newCompressor(cfg CompressorConfig) *compressor {
+	cfg = cfg.withDefaults()
+	coefficient := func(ms float64) float64 {
+		return math.Exp(-1 / (ms / 1000 * outputSampleRate))
+	}
+	return &compressor{
+		thresholdDB: cfg.ThresholdDB,
+		ratio:       cfg.Ratio,
+		makeup:      math.Pow(10, cfg.MakeupDB/20),
+		attack:      coefficient(cfg.AttackMS),
+		release:     coefficient(cfg.ReleaseMS),
+	}
+}
+
+// gain returns the gain for one stereo sample pair
+func (c *compressor) gain(l, r float64) float64 {
+	level := max(math.Abs(l), math.Abs(r)) / 32768
+	coefficient := c.release
+	if level > c.envelope {
+		coefficient = c.attack
+	}
+	c.envelope = coefficient*c.envelope + (1-coefficient)*level
+
+	c.reductionDB = 0
+	if c.envelope > 0 {
+		if over := 20*math.Log10(c.envelope) - c.thresholdDB; over > 0 {
+			c.reductionDB = over * (1 - 1/c.ratio)
+		}
+	}
+	return math.Pow(10, -c.reductionDB/20) * c.makeup
+}
+
+// dspChain is the filter chain between the capture and the encoder:
+// high-pass → hum notches → EQ bands → low-pass → compressor.
+// It is configured per profile and can be edited while streaming.
+type dspChain struct {
+	mu      sync.Mutex
+	cfg     DSPConfig
+	filters []*biquad
+	comp    *compressor
+}
+
+// audioDSP is the DSP chain of the stream
+var audioDSP = &dspChain{}
+
+// Set rebuilds the chain from cfg. The filter state starts over, which is
+// inaudible apart from a possible click.
+func (d *dspChain) Set(cfg DSPConfig) {
+	cfg = cfg.clone()
+	var filters []*biquad
+	if cfg.HighPassHz > 0 {
+		filters = append(filters, newHighPass(cfg.HighPassHz))
+	}
+	for i := 1; cfg.NotchHz > 0 && i <= dspNotchHarmonics; i++ {
+		// ナイキスト周波数を超える倍音は作らない
+		if freq := cfg.NotchHz * float64(i); freq < outputSampleRate/2 {
+			filters = append(filters, newNotch(freq, dspNotchQ))
+		}
+	}
+	for _, band := range cfg.EQ {
+		filters = append(filters, newPeaking(band.Freq, band.GainDB, band.q()))
+	}
+	if cfg.LowPassHz > 0 {
+		filters = append(filters, newLowPass(cfg.LowPassHz))
+	}
+	var comp *compressor
+	if cfg.Compressor.Enabled {
+		comp = newCompressor(cfg.Compressor)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cfg, d.filters, d.comp = cfg, filters, comp
+}
+
+// Get returns a copy of the current chain settings
+func (d *dspChain) Get() DSPConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cfg.clone()
+}
+
+// GainReduction returns the current gain reduction of the compressor in dB
+func (d *dspChain) GainReduction() float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.comp == nil || d.cfg.Bypass {
+		return 0
+	}
+	return d.comp.reductionDB
+}
+
+// Process runs an interleaved stereo frame through the chain in place.
+// It is called from the audio callback for every frame.
+func (d *dspChain) Process(pcm []int16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cfg.Bypass || (len(d.filters) == 0 && d.comp == nil) {
+		return
+	}
+	for i := 0; i+1 < len(pcm); i += 2 {
+		l, r := float64(pcm[i]), float64(pcm[i+1])
+		for _, f := range d.filters {
+			l, r = f.process(0, l), f.process(1, r)
+		}
+		if d.comp != nil {
+			gain := d.comp.gain(l, r)
+			l, r = l*gain, r*gain
+		}
+		pcm[i], pcm[i+1] = clampSample(l), clampSample(r)
+	}
+}
+
+// setDSPOverride keeps cfg in place of the configured chain until it is called
+// with nil, and applies it to the running stream. It returns the chain now in effect.
+func setDSPOverride(cfg *DSPConfig) DSPConfig {
+	botState.Lock()
+	defer botState.Unlock()
+	botState.dspOverride = cfg
+	settings := botState.audioSettingsLocked()
+	if botState.streamRunningLocked() {
+		audioDSP.Set(settings.dsp)
+	}
+	return settings.dsp
+}
+
+// editDSP applies the arguments of "@Bot dsp" (except reset) to cfg. The result
+// is checked with the same rules as the config file.
+func editDSP(cfg DSPConfig, args []string) (DSPConfig, error) {
+	usage := newUserError("dsp_usage")
+	if len(args) == 0 {
+		return cfg, usage
+	}
+	cfg = cfg.clone()
+
+	// 数値の引数（"80Hz" や "-3dB" のような単位付きも受け付ける）
+	number := func(i int) (float64, bool) {
+		if i >= len(args) {
+			return 0, false
+		}
+		text := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(args[i]), "hz"), "db")
+		if text == "off" {
+			return 0, true
+		}
+		v, err := strconv.ParseFloat(text, 64)
+		return v, err == nil && !math.IsNaN(v) && !math.IsInf(v, 0)
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+		cfg.Bypass = false
+	case "off", "bypass":
+		cfg.Bypass = true
+	case "highpass", "hpf", "lowpass", "lpf", "notch":
+		v, ok := number(1)
+		if !ok {
+			return cfg, usage
+		}
+		switch strings.ToLower(args[0]) {
+		case "highpass", "hpf":
+			cfg.HighPassHz = v
+		case "lowpass", "lpf":
+			cfg.LowPassHz = v
+		default:
+			cfg.NotchHz = v
+		}
+	case "eq":
+		if len(args) < 2 {
+			return cfg, usage
+		}
+		switch strings.ToLower(args[1]) {
+		case "add":
+			freq, ok1 := number(2)
+			gain, ok2 := number(3)
+			if !ok1 || !ok2 {
+				return cfg, usage
+			}
+			band := EQBand{Freq: freq, GainDB: gain}
+			if len(args) > 4 {
+				q, ok := number(4)
+				if !ok {
+					return cfg, usage
+				}
+				band.Q = q
+			}
+			cfg.EQ = append(cfg.EQ, band)
+		case "remove":
+			n, ok := number(2)
+			if !ok || n < 1 || int(n) > len(cfg.EQ) || n != math.Trunc(n) {
+				return cfg, newUserError("dsp_no_band", len(cfg.EQ))
+			}
+			cfg.EQ = append(cfg.EQ[:int(n)-1], cfg.EQ[int(n):]...)
+		case "clear":
+			cfg.EQ = nil
+		default:
+			return cfg, usage
+		}
+	case "comp", "compressor":
+		if len(args) < 2 {
+			return cfg, usage
+		}
+		comp := &cfg.Compressor
+		params := map[string]*float64{
+			"threshold": &comp.ThresholdDB,
+			"ratio":     &comp.Ratio,
+			"attack":    &comp.AttackMS,
+			"release":   &comp.ReleaseMS,
+			"makeup":    &comp.MakeupDB,
+		}
+		switch name := strings.ToLower(args[1]); name {
+		case "on":
+			comp.Enabled = true
+		case "off":
+			comp.Enabled = false
+		default:
+			param, ok := params[name]
+			if !ok || len(args) < 3 {
+				return cfg, usage
+			}
+			if strings.ToLower(args[2]) == "default" {
+				*param = 0
+				break
+			}
+			v, valid := number(2)
+			if !valid {
+				return cfg, usage
+			}
+			// 設定ファイルと同じく 0 は既定値の意味になるので、数値としての 0 は受け付けない
+			if v == 0 && name != "makeup" {
+				return cfg, newUserError("dsp_comp_zero", name)
+			}
+			*param = v
+		}
+	default:
+		return cfg, usage
+	}
+
+	var issues []string
+	cfg.validate("", func(path, format string, args ...interface{}) {
+		issues = append(issues, path+" "+fmt.Sprintf(format, args...))
+	})
+	if len(issues) > 0 {
+		return cfg, newUserError("dsp_invalid", issues[0])
+	}
+	return cfg, nil
+}
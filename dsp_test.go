@@ -0,0 +1,311 @@
+package main
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dspResponse passes one second of a sine at freq through a chain of cfg and
+// returns the output level relative to the input in dB
+func dspResponse(cfg DSPConfig, freq, amplitude float64) float64 {
+	d := &dspChain{}
+	d.Set(cfg)
+
+	var in, out float64
+	pcm := make([]int16, 960*outputChannels)
+	for frame := 0; frame < 50; frame++ {
+		for i := 0; i < 960; i++ {
+			v := int16(amplitude * 32767 * math.Sin(2*math.Pi*freq*float64(frame*960+i)/outputSampleRate))
+			pcm[i*2], pcm[i*2+1] = v, v
+		}
+		// フィルタが落ち着くまでの前半は測らない
+		measure := frame >= 25
+		for i := 0; measure && i < len(pcm); i += 2 {
+			in += float64(pcm[i]) * float64(pcm[i])
+		}
+		d.Process(pcm)
+		for i := 0; measure && i < len(pcm); i += 2 {
+			out += float64(pcm[i]) * float64(pcm[i])
+		}
+	}
+	return 10 * math.Log10(out/in)
+}
+
+func TestDSPFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      DSPConfig
+		freq     float64
+		min, max float64
+	}{
+		{"high-pass cuts rumble", DSPConfig{HighPassHz: 200}, 30, math.Inf(-1), -20},
+		{"high-pass keeps voice", DSPConfig{HighPassHz: 200}, 2000, -0.5, 0.5},
+		{"low-pass cuts highs", DSPConfig{LowPassHz: 2000}, 15000, math.Inf(-1), -20},
+		{"low-pass keeps voice", DSPConfig{LowPassHz: 8000}, 500, -0.5, 0.5},
+		{"notch removes hum", DSPConfig{NotchHz: 50}, 50, math.Inf(-1), -30},
+		{"notch removes harmonics", DSPConfig{NotchHz: 60}, 180, math.Inf(-1), -30},
+		{"notch keeps music", DSPConfig{NotchHz: 50}, 440, -0.5, 0.5},
+		{"eq boost", DSPConfig{EQ: []EQBand{{Freq: 1000, GainDB: 6}}}, 1000, 5.5, 6.5},
+		{"eq cut", DSPConfig{EQ: []EQBand{{Freq: 3000, GainDB: -6, Q: 2}}}, 3000, -6.5, -5.5},
+		{"eq off band", DSPConfig{EQ: []EQBand{{Freq: 3000, GainDB: -6, Q: 4}}}, 200, -0.5, 0.5},
+		{"bypass", DSPConfig{Bypass: true, HighPassHz: 200}, 30, -0.1, 0.1},
+	}
+	for _, tt := range tests {
+		if got := dspResponse(tt.cfg, tt.freq, 0.3); got < tt.min || got > tt.max {
+			t.Errorf("%s (%s at %g Hz): %.1f dB, want %g to %g", tt.name, tt.cfg, tt.freq, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestDSPCompressor(t *testing.T) {
+	cfg := DSPConfig{Compressor: CompressorConfig{Enabled: true, ThresholdDB: -20, Ratio: 4}}
+
+	// -6 dBFS のピークはしきい値を約14 dB超えるので約10 dB下がる
+	if got := dspResponse(cfg, 440, 0.5); got < -11.5 || got > -9 {
+		t.Errorf("loud sine: %.1f dB, want about -10.5", got)
+	}
+	if got := dspResponse(cfg, 440, 0.05); got < -0.5 || got > 0.5 {
+		t.Errorf("quiet sine: %.1f dB, want unchanged", got)
+	}
+
+	cfg.Compressor.MakeupDB = 6
+	if got := dspResponse(cfg, 440, 0.05); got < 5.5 || got > 6.5 {
+		t.Errorf("quiet sine with makeup: %.1f dB, want +6", got)
+	}
+}
+
+func TestDSPChainEmptyLeavesAudio(t *testing.T) {
+	d := &dspChain{}
+	d.Set(DSPConfig{})
+	pcm := []int16{1000, -2000, 3, 4}
+	d.Process(pcm)
+	if !reflect.DeepEqual(pcm, []int16{1000, -2000, 3, 4}) {
+		t.Errorf("got %v, want the input", pcm)
+	}
+}
+
+func TestDSPConfigString(t *testing.T) {
+	tests := []struct {
+		cfg  DSPConfig
+		want string
+	}{
+		{DSPConfig{}, "off"},
+		{DSPConfig{HighPassHz: 80, NotchHz: 50}, "HPF 80 Hz → notch 50 Hz"},
+		{DSPConfig{EQ: []EQBand{{Freq: 3000, GainDB: -4, Q: 1.5}}, LowPassHz: 12000}, "EQ 3000 Hz -4 dB Q1.5 → LPF 12000 Hz"},
+		{DSPConfig{Compressor: CompressorConfig{Enabled: true, MakeupDB: 3}}, "comp -18 dB 4:1 +3 dB"},
+		{DSPConfig{Bypass: true, NotchHz: 60}, "bypass (notch 60 Hz)"},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.String(); got != tt.want {
+			t.Errorf("%+v = %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestEditDSP(t *testing.T) {
+	cfg := DSPConfig{}
+	for _, args := range [][]string{
+		{"highpass", "80Hz"},
+		{"notch", "50"},
+		{"eq", "add", "3000", "-4dB", "1.5"},
+		{"eq", "add", "250", "-3"},
+		{"eq", "remove", "1"},
+		{"comp", "on"},
+		{"comp", "threshold", "-24"},
+		{"off"},
+	} {
+		var err error
+		if cfg, err = editDSP(cfg, args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	want := DSPConfig{
+		Bypass:     true,
+		HighPassHz: 80,
+		NotchHz:    50,
+		EQ:         []EQBand{{Freq: 250, GainDB: -3}},
+		Compressor: CompressorConfig{Enabled: true, ThresholdDB: -24},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+
+	for _, args := range [][]string{
+		{"highpass", "5"},
+		{"lowpass", "40"},
+		{"eq", "add", "1000", "30"},
+		{"eq", "remove", "2"},
+		{"comp", "ratio", "abc"},
+		{"reverb"},
+	} {
+		if _, err := editDSP(cfg, args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+	// 0 は既定値の意味になるので数値では指定できず、default で戻す
+	for _, args := range [][]string{{"comp", "threshold", "0dB"}, {"comp", "attack", "0"}, {"comp", "release", "off"}} {
+		if _, err := editDSP(cfg, args); err == nil || !strings.Contains(err.Error(), "default") || strings.Contains(err.Error(), "Usage") {
+			t.Errorf("%v: %v, want dsp_comp_zero", args, err)
+		}
+	}
+	if got, err := editDSP(cfg, []string{"comp", "threshold", "default"}); err != nil || got.Compressor.ThresholdDB != 0 {
+		t.Errorf("threshold default: %+v, %v", got.Compressor, err)
+	}
+	if got, err := editDSP(cfg, []string{"comp", "makeup", "0"}); err != nil || got.Compressor.MakeupDB != 0 {
+		t.Errorf("makeup 0: %+v, %v", got.Compressor, err)
+	}
+
+	if _, err := editDSP(cfg, []string{"lowpass", "40"}); err == nil || !strings.Contains(err.Error(), "lowpass_hz") {
+		t.Errorf("lowpass below highpass: %v", err)
+	}
+}
+
+func TestDSPConfigValidation(t *testing.T) {
+	cfg := DSPConfig{
+		HighPassHz: 30000,
+		NotchHz:    5,
+		EQ:         []EQBand{{Freq: 1000, GainDB: 0, Q: 50}},
+		Compressor: CompressorConfig{ThresholdDB: 3, Ratio: 0.5},
+	}
+	var paths []string
+	cfg.validate("audio.dsp.", func(path, format string, args ...interface{}) {
+		paths = append(paths, path)
+	})
+	want := []string{
+		"audio.dsp.highpass_hz",
+		"audio.dsp.notch_hz",
+		"audio.dsp.eq[0].q",
+		"audio.dsp.compressor.threshold_db",
+		"audio.dsp.compressor.ratio",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("issues at %v, want %v", paths, want)
+	}
+}
+
+func TestProfileDSPOverridesAudio(t *testing.T) {
+	cfg := &Config{
+		Audio: AudioConfig{DSP: DSPConfig{HighPassHz: 80}},
+		Profiles: map[string]ProfileConfig{
+			"mic":  {DSP: &DSPConfig{NotchHz: 50}},
+			"game": {},
+		},
+	}
+	for profile, want := range map[string]string{"": "HPF 80 Hz", "mic": "notch 50 Hz", "game": "HPF 80 Hz"} {
+		if got := resolveAudioSettings(cfg, profile, "").dsp.String(); got != want {
+			t.Errorf("profile %q: dsp %q, want %q", profile, got, want)
+		}
+	}
+}
+
+func TestReloadAppliesDSPWithoutRestart(t *testing.T) {
+	tb := setupTestBot(t, nil)
+	if err := os.WriteFile(configPath, []byte("version: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "the pipeline", func() bool { return stats.snapshot().running })
+
+	yaml := "version: 2\naudio:\n  dsp:\n    notch_hz: 60\n    eq:\n      - {freq: 3000, gain_db: -4}\n"
+	if err := os.WriteFile(configPath, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := DSPConfig{NotchHz: 60, EQ: []EQBand{{Freq: 3000, GainDB: -4}}}
+	if got := audioDSP.Get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dsp after reload = %+v, want %+v", got, want)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(tb.capture.Opened()); n != 1 {
+		t.Errorf("capture opened %d times, want 1 (no restart)", n)
+	}
+}
+
+func TestDSPEnvironmentOverrides(t *testing.T) {
+	for name, value := range map[string]string{
+		"CONSONANCE_AUDIO_DSP_BYPASS":                  "true",
+		"CONSONANCE_AUDIO_DSP_HIGHPASS_HZ":             "80",
+		"CONSONANCE_AUDIO_DSP_LOWPASS_HZ":              "12000",
+		"CONSONANCE_AUDIO_DSP_NOTCH_HZ":                "50",
+		"CONSONANCE_AUDIO_DSP_COMPRESSOR_ENABLED":      "true",
+		"CONSONANCE_AUDIO_DSP_COMPRESSOR_THRESHOLD_DB": "-20.5",
+		"CONSONANCE_AUDIO_DSP_COMPRESSOR_RATIO":        "3",
+		"CONSONANCE_AUDIO_DSP_COMPRESSOR_ATTACK_MS":    "5",
+		"CONSONANCE_AUDIO_DSP_COMPRESSOR_RELEASE_MS":   "150",
+		"CONSONANCE_AUDIO_DSP_COMPRESSOR_MAKEUP_DB":    "2",
+	} {
+		t.Setenv(name, value)
+	}
+	cfg, _, err := parseConfig([]byte("version: 2\n"), "config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnvironment(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := DSPConfig{
+		Bypass:     true,
+		HighPassHz: 80,
+		LowPassHz:  12000,
+		NotchHz:    50,
+		Compressor: CompressorConfig{Enabled: true, ThresholdDB: -20.5, Ratio: 3, AttackMS: 5, ReleaseMS: 150, MakeupDB: 2},
+	}
+	if !reflect.DeepEqual(cfg.Audio.DSP, want) {
+		t.Errorf("audio.dsp = %+v, want %+v", cfg.Audio.DSP, want)
+	}
+
+	// EQバンドのリストは設定ファイルでのみ指定できる
+	t.Setenv("CONSONANCE_AUDIO_DSP_EQ", "3000")
+	cfg, _, err = parseConfig([]byte("version: 2\n"), "config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnvironment(cfg); err == nil || !strings.Contains(err.Error(), "CONSONANCE_AUDIO_DSP_EQ") {
+		t.Errorf("CONSONANCE_AUDIO_DSP_EQ: %v, want an error", err)
+	}
+}
+
+func TestDSPOverrideSurvivesRestart(t *testing.T) {
+	tb := setupTestBot(t, &Config{Audio: AudioConfig{DSP: DSPConfig{HighPassHz: 80}}})
+
+	// 配信していなくても編集でき、次の配信開始から使われる
+	edited, err := editDSP(DSPConfig{HighPassHz: 80}, []string{"notch", "50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setDSPOverride(&edited)
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "the pipeline", func() bool { return stats.snapshot().running })
+	want := DSPConfig{HighPassHz: 80, NotchHz: 50}
+	if got := audioDSP.Get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dsp after join = %+v, want %+v", got, want)
+	}
+
+	restartStreaming()
+	waitFor(t, 2*time.Second, "the restarted pipeline", func() bool { return len(tb.capture.Opened()) == 2 && stats.snapshot().running })
+	if got := audioDSP.Get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dsp after restart = %+v, want %+v", got, want)
+	}
+
+	// reset で設定ファイルの内容に戻る
+	if got := setDSPOverride(nil); !reflect.DeepEqual(got, DSPConfig{HighPassHz: 80}) {
+		t.Errorf("reset returned %+v", got)
+	}
+	if got := audioDSP.Get(); !reflect.DeepEqual(got, DSPConfig{HighPassHz: 80}) {
+		t.Errorf("dsp after reset = %+v, want the config", got)
+	}
+}
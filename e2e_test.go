@@ -0,0 +1,227 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"layeh.com/gopus"
+)
+
+func TestJoinStreamLeave(t *testing.T) {
+	tb := setupTestBot(t, nil)
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatalf("joinVoiceChannel: %v", err)
+	}
+
+	voices := tb.gateway.Voices()
+	if len(voices) != 1 {
+		t.Fatalf("joins = %d, want 1", len(voices))
+	}
+	v := voices[0]
+	if v.guildID != "100" || v.channelID != "200" {
+		t.Errorf("joined %s/%s, want 100/200", v.guildID, v.channelID)
+	}
+	if !v.deaf {
+		t.Error("joined undeafened without receive_voice")
+	}
+
+	waitFor(t, 2*time.Second, "10 frames", func() bool { return len(v.Frames()) >= 10 })
+
+	// 送られたフレームはデコードすると元のサイン波の音量になる
+	decoder, err := gopus.NewDecoder(outputSampleRate, outputChannels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peak := 0
+	for _, frame := range v.Frames() {
+		pcm, err := decoder.Decode(frame, 960, false)
+		if err != nil {
+			t.Fatalf("sent frame does not decode: %v", err)
+		}
+		if len(pcm) != 960*outputChannels {
+			t.Fatalf("decoded %d samples, want %d", len(pcm), 960*outputChannels)
+		}
+		for _, s := range pcm {
+			if int(s) > peak {
+				peak = int(s)
+			}
+		}
+	}
+	if peak < 8000 {
+		t.Errorf("peak of decoded stream = %d, want about 16000", peak)
+	}
+
+	leaveVoiceChannel()
+
+	if got := v.Speakings(); !reflect.DeepEqual(got, []bool{true, false}) {
+		t.Errorf("Speaking calls = %v, want [true false]", got)
+	}
+	if !v.Disconnected() {
+		t.Error("voice connection was not disconnected")
+	}
+	if state := botState.State(); state != stateIdle {
+		t.Errorf("state after leave = %s, want Idle", state)
+	}
+}
+
+func TestJoinFailure(t *testing.T) {
+	tb := setupTestBot(t, nil)
+	tb.gateway.joinErr = errJoinRefused
+
+	if err := joinVoiceChannel("100", "200"); err == nil {
+		t.Fatal("joinVoiceChannel succeeded with a refusing gateway")
+	}
+
+	if state := botState.State(); state != stateIdle {
+		t.Errorf("state after a failed join = %s, want Idle", state)
+	}
+	if len(tb.capture.Opened()) != 0 {
+		t.Error("capture started after a failed join")
+	}
+}
+
+func TestRejoinMovesToNewChannel(t *testing.T) {
+	tb := setupTestBot(t, nil)
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	if err := joinVoiceChannel("100", "201"); err != nil {
+		t.Fatal(err)
+	}
+
+	voices := tb.gateway.Voices()
+	if len(voices) != 2 {
+		t.Fatalf("joins = %d, want 2", len(voices))
+	}
+	if !voices[0].Disconnected() {
+		t.Error("first connection was not disconnected")
+	}
+	waitFor(t, 2*time.Second, "frames on the new channel", func() bool { return len(voices[1].Frames()) >= 5 })
+}
+
+func TestProfileMixesDevices(t *testing.T) {
+	cfg := &Config{
+		Audio: AudioConfig{Profile: "mix"},
+		Profiles: map[string]ProfileConfig{
+			"mix": {Devices: []ProfileDevice{{Name: "Music"}, {Name: "Mic", Mode: "capture"}}},
+		},
+	}
+	tb := setupTestBot(t, cfg)
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	v := tb.gateway.Voices()[0]
+	waitFor(t, 2*time.Second, "frames", func() bool { return len(v.Frames()) >= 5 })
+
+	opened := tb.capture.Opened()
+	if len(opened) != 1 || len(opened[0]) != 2 {
+		t.Fatalf("opened devices = %v, want one run with 2 devices", opened)
+	}
+	if opened[0][0].Name != "Music" || opened[0][1].Name != "Mic" {
+		t.Errorf("opened devices = %v", opened[0])
+	}
+
+	snap := stats.snapshot()
+	if snap.settings.profile != "mix" || snap.framesSent == 0 {
+		t.Errorf("stats profile = %q, frames sent = %d", snap.settings.profile, snap.framesSent)
+	}
+}
+
+func TestProfileMixKeepsRunningWhenFirstDeviceStalls(t *testing.T) {
+	cfg := &Config{
+		Audio: AudioConfig{Profile: "mix"},
+		Profiles: map[string]ProfileConfig{
+			"mix": {Devices: []ProfileDevice{{Name: "Music"}, {Name: "Mic", Mode: "capture"}}},
+		},
+	}
+	tb := setupTestBot(t, cfg)
+	tb.capture.stalled = map[int]bool{0: true}
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	// 1台目が音声を渡さなくても、2台目の音声が独自のクロックで送られる
+	v := tb.gateway.Voices()[0]
+	waitFor(t, 2*time.Second, "frames", func() bool { return len(v.Frames()) >= 5 })
+	waitFor(t, 2*time.Second, "the second device", func() bool { return levels.snapshot().total.peakDB > -7 })
+}
+
+func TestLeaveSendsSilenceTrailer(t *testing.T) {
+	tb := setupTestBot(t, nil)
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	v := tb.gateway.Voices()[0]
+	waitFor(t, 2*time.Second, "frames", func() bool { return len(v.Frames()) >= 5 })
+
+	leaveVoiceChannel()
+
+	waitFor(t, time.Second, "silence trailer", func() bool {
+		frames := v.Frames()
+		if len(frames) < silenceTrailerFrames {
+			return false
+		}
+		for _, frame := range frames[len(frames)-silenceTrailerFrames:] {
+			if !reflect.DeepEqual(frame, opusSilenceFrame) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestLeaveAfterCaptureFailure(t *testing.T) {
+	tb := setupTestBot(t, nil)
+	tb.capture.openErr = errCaptureFailed
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "stream to fail", func() bool { return botState.State() == stateReady })
+
+	// 以前はエラー終了したgoroutineに停止を送ろうとして止まっていた
+	done := make(chan struct{})
+	go func() {
+		leaveVoiceChannel()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("leaveVoiceChannel blocked after the stream failed")
+	}
+	if !tb.gateway.Voices()[0].Disconnected() {
+		t.Error("voice connection was not disconnected")
+	}
+}
+
+func TestShutdownDisconnectsWithinTimeout(t *testing.T) {
+	tb := setupTestBot(t, nil)
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	v := tb.gateway.Voices()[0]
+	waitFor(t, 2*time.Second, "frames", func() bool { return len(v.Frames()) >= 5 })
+
+	start := time.Now()
+	shutdown(2 * time.Second)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+
+	if got := v.Speakings(); !reflect.DeepEqual(got, []bool{true, false}) {
+		t.Errorf("Speaking calls = %v, want [true false]", got)
+	}
+	if !v.Disconnected() {
+		t.Error("voice connection was not disconnected")
+	}
+	if botState.ctx.Err() == nil {
+		t.Error("bot context was not cancelled")
+	}
+}
@@ -5,10 +5,9 @@ go 1.25.1
 require (
 	github.com/bwmarrin/discordgo v0.29.0
 	github.com/gen2brain/malgo v0.11.24
+	github.com/gorilla/websocket v1.4.2
 	gopkg.in/yaml.v3 v3.0.1
 	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32
 )
 
-require github.com/gorilla/websocket v1.4.2 // indirect
-
 replace github.com/bwmarrin/discordgo => github.com/pgDora56/richy-discordgo v0.0.0-20251123191524-2672c0ec4dca
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// guildSettingsFileName is stored next to the config file
+const guildSettingsFileName = "guild_settings.json"
+
+// supportedLanguages are the values accepted for the language setting
+var supportedLanguages = []string{"ja", "en"}
+
+// GuildSettings are the settings a server can change with "@Bot config set"
+type GuildSettings struct {
+	DefaultChannelID string   `json:"default_channel_id,omitempty"`
+	Volume           int      `json:"volume,omitempty"` // percent, 0 = 100
+	AllowedRoleIDs   []string `json:"allowed_role_ids,omitempty"`
+	Language         string   `json:"language,omitempty"`
+	Profile          string   `json:"profile,omitempty"` // 参加時に使う音声プロファイル
+	AlertChannelID   string   `json:"alert_channel_id,omitempty"`
+}
+
+// volume returns the output volume in percent
+func (g GuildSettings) volume() int {
+	if g.Volume == 0 {
+		return 100
+	}
+	return g.Volume
+}
+
+// guildStore keeps the settings of every guild in a JSON file
+type guildStore struct {
+	mu     sync.Mutex
+	path   string
+	guilds map[string]*GuildSettings
+}
+
+var guildSettings *guildStore
+
+// streamVolume is the output volume in percent of the guild being streamed to.
+// The audio callback reads it for every frame, so it is kept outside botState's lock.
+var streamVolume atomic.Int32
+
+// guildSettingsPath returns the settings file next to the config file
+func guildSettingsPath() string {
+	return filepath.Join(filepath.Dir(configPath), guildSettingsFileName)
+}
+
+// loadGuildStore reads the settings file; a missing file is an empty store
+func loadGuildStore(path string) (*guildStore, error) {
+	store := &guildStore{path: path, guilds: make(map[string]*GuildSettings)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, &store.guilds); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// Get returns a copy of the settings of a guild (zero values if none are stored)
+func (g *guildStore) Get(guildID string) GuildSettings {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	settings, ok := g.guilds[guildID]
+	if !ok {
+		return GuildSettings{}
+	}
+	copied := *settings
+	copied.AllowedRoleIDs = append([]string(nil), settings.AllowedRoleIDs...)
+	return copied
+}
+
+// Update changes the settings of a guild and saves the file.
+// Nothing is saved if update returns an error.
+func (g *guildStore) Update(guildID string, update func(settings *GuildSettings) error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	settings, ok := g.guilds[guildID]
+	if !ok {
+		settings = &GuildSettings{}
+	}
+	updated := *settings
+	if err := update(&updated); err != nil {
+		return err
+	}
+
+	// 空になったギルドはファイルから消す
+	guilds := make(map[string]*GuildSettings, len(g.guilds)+1)
+	for id, s := range g.guilds {
+		guilds[id] = s
+	}
+	if updated.DefaultChannelID == "" && updated.Volume == 0 && len(updated.AllowedRoleIDs) == 0 && updated.Language == "" && updated.Profile == "" && updated.AlertChannelID == "" {
+		delete(guilds, guildID)
+	} else {
+		guilds[guildID] = &updated
+	}
+
+	data, err := json.MarshalIndent(guilds, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode guild settings: %v", err)
+	}
+	if err := writeFileAtomic(g.path, append(data, '\n'), ""); err != nil {
+		return err
+	}
+	g.guilds = guilds
+	return nil
+}
+
+// guildSettingKeys lists the keys of "@Bot config" in display order
+var guildSettingKeys = []string{"default_channel", "volume", "allowed_roles", "language", "profile", "alert_channel"}
+
+// formatGuildSetting returns the display value of one setting
+func formatGuildSetting(lang string, settings GuildSettings, key string) string {
+	switch key {
+	case "default_channel":
+		if settings.DefaultChannelID == "" {
+			return tr(lang, "config_not_set")
+		}
+		return "<#" + settings.DefaultChannelID + ">"
+	case "volume":
+		return fmt.Sprintf("%d%%", settings.volume())
+	case "allowed_roles":
+		if len(settings.AllowedRoleIDs) == 0 {
+			return tr(lang, "config_roles_default")
+		}
+		roles := make([]string, len(settings.AllowedRoleIDs))
+		for i, id := range settings.AllowedRoleIDs {
+			roles[i] = "<@&" + id + ">"
+		}
+		return strings.Join(roles, " ")
+	case "language":
+		if settings.Language == "" {
+			return tr(lang, "config_lang_default")
+		}
+		return settings.Language
+	case "profile":
+		if settings.Profile == "" {
+			return tr(lang, "config_prof_default")
+		}
+		return settings.Profile
+	case "alert_channel":
+		if settings.AlertChannelID == "" {
+			return tr(lang, "config_alert_default")
+		}
+		return "<#" + settings.AlertChannelID + ">"
+	}
+	return ""
+}
+
+// setGuildSetting parses a value given in chat and stores it in settings
+func setGuildSetting(s *discordgo.Session, guildID string, settings *GuildSettings, key string, args []string) error {
+	switch key {
+	case "default_channel":
+		channelID, _, err := resolveVoiceChannel(s, guildID, args)
+		if err != nil {
+			return err
+		}
+		settings.DefaultChannelID = channelID
+	case "volume":
+		v, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+		if err != nil || v < 1 || v > 200 {
+			return newUserError("invalid_volume")
+		}
+		settings.Volume = v
+	case "allowed_roles":
+		var roles []string
+		for _, arg := range args {
+			for _, id := range strings.Split(arg, ",") {
+				id = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<@&"), ">")
+				if id == "" {
+					continue
+				}
+				if !isSnowflake(id) {
+					return newUserError("invalid_role", id)
+				}
+				roles = append(roles, id)
+			}
+		}
+		sort.Strings(roles)
+		settings.AllowedRoleIDs = roles
+	case "language":
+		lang := strings.ToLower(args[0])
+		for _, supported := range supportedLanguages {
+			if lang == supported {
+				settings.Language = lang
+				return nil
+			}
+		}
+		return newUserError("invalid_language", strings.Join(supportedLanguages, ", "))
+	case "profile":
+		if _, ok := currentConfig().Profiles[args[0]]; !ok {
+			return newUserError("profile_not_found", args[0])
+		}
+		settings.Profile = args[0]
+	case "alert_channel":
+		id := strings.TrimSuffix(strings.TrimPrefix(args[0], "<#"), ">")
+		if !isSnowflake(id) {
+			return newUserError("invalid_text_channel", args[0])
+		}
+		settings.AlertChannelID = id
+	default:
+		return newUserError("config_unknown_key", key, strings.Join(guildSettingKeys, "`, `"))
+	}
+	return nil
+}
+
+// unsetGuildSetting resets one setting to its default
+func unsetGuildSetting(settings *GuildSettings, key string) error {
+	switch key {
+	case "default_channel":
+		settings.DefaultChannelID = ""
+	case "volume":
+		settings.Volume = 0
+	case "allowed_roles":
+		settings.AllowedRoleIDs = nil
+	case "language":
+		settings.Language = ""
+	case "profile":
+		settings.Profile = ""
+	case "alert_channel":
+		settings.AlertChannelID = ""
+	default:
+		return newUserError("config_unknown_key", key, strings.Join(guildSettingKeys, "`, `"))
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeVoice is a voice connection that records what the bot does with it
+type fakeVoice struct {
+	guildID   string
+	channelID string
+	deaf      bool
+
+	send  chan []byte
+	recv  chan *discordgo.Packet
+	done  chan struct{}
+	ready atomic.Bool
+
+	mu           sync.Mutex
+	speaking     []bool
+	frames       [][]byte
+	disconnected bool
+	handlers     []func(ssrc uint32, userID string)
+}
+
+func newFakeVoice(guildID, channelID string, deaf bool) *fakeVoice {
+	v := &fakeVoice{
+		guildID:   guildID,
+		channelID: channelID,
+		deaf:      deaf,
+		send:      make(chan []byte, 2), // discordgo と同じバッファ
+		recv:      make(chan *discordgo.Packet, 2),
+		done:      make(chan struct{}),
+	}
+	v.ready.Store(true)
+	// Discord の送信ループの代わりに送られたフレームを記録する
+	go func() {
+		for {
+			select {
+			case <-v.done:
+				return
+			case frame := <-v.send:
+				v.mu.Lock()
+				v.frames = append(v.frames, frame)
+				v.mu.Unlock()
+			}
+		}
+	}()
+	return v
+}
+
+func (v *fakeVoice) Ready() bool { return v.ready.Load() }
+
+// SetReady simulates the voice connection dropping (false) and coming back (true)
+func (v *fakeVoice) SetReady(ready bool) { v.ready.Store(ready) }
+
+func (v *fakeVoice) Speaking(speaking bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.speaking = append(v.speaking, speaking)
+	return nil
+}
+
+func (v *fakeVoice) OpusSend() chan<- []byte { return v.send }
+
+func (v *fakeVoice) OpusRecv() <-chan *discordgo.Packet { return v.recv }
+
+func (v *fakeVoice) OnSpeakingUpdate(handler func(ssrc uint32, userID string)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.handlers = append(v.handlers, handler)
+}
+
+func (v *fakeVoice) Disconnect() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.disconnected {
+		v.disconnected = true
+		close(v.done)
+	}
+	return nil
+}
+
+// Frames returns a copy of the frames sent so far
+func (v *fakeVoice) Frames() [][]byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([][]byte(nil), v.frames...)
+}
+
+// Speakings returns the Speaking calls so far
+func (v *fakeVoice) Speakings() []bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]bool(nil), v.speaking...)
+}
+
+// Disconnected reports whether Disconnect was called
+func (v *fakeVoice) Disconnected() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.disconnected
+}
+
+// fakeGateway records the voice joins and hands out fake connections
+type fakeGateway struct {
+	mu      sync.Mutex
+	voices  []*fakeVoice
+	joinErr error
+	// readyAfter delays the voice connection becoming ready
+	readyAfter time.Duration
+}
+
+func (g *fakeGateway) JoinVoice(guildID, channelID string, mute, deaf bool) (voiceConn, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.joinErr != nil {
+		return nil, g.joinErr
+	}
+	v := newFakeVoice(guildID, channelID, deaf)
+	if g.readyAfter > 0 {
+		v.SetReady(false)
+		time.AfterFunc(g.readyAfter, func() { v.SetReady(true) })
+	}
+	g.voices = append(g.voices, v)
+	return v, nil
+}
+
+func (g *fakeGateway) DisconnectAll() {
+	for _, v := range g.Voices() {
+		v.Disconnect()
+	}
+}
+
+// Voices returns the connections created so far
+func (g *fakeGateway) Voices() []*fakeVoice {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*fakeVoice(nil), g.voices...)
+}
+
+// syntheticCapture is a capture backend that generates a sine wave on every
+// device in 20ms chunks, like a real device callback
+type syntheticCapture struct {
+	frequency float64
+	amplitude float64
+
+	mu      sync.Mutex
+	opened  [][]ProfileDevice
+	openErr error
+	stalled map[int]bool // 音声を渡さないデバイス（止まったデバイスの再現）
+}
+
+func (c *syntheticCapture) open(devices []ProfileDevice, bufferPeriods int, onPCM func(index int, pcm []int16)) (func(), error) {
+	c.mu.Lock()
+	c.opened = append(c.opened, devices)
+	err := c.openErr
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		pos := 0
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for index := range devices {
+				c.mu.Lock()
+				stalled := c.stalled[index]
+				c.mu.Unlock()
+				if stalled {
+					continue
+				}
+				pcm := make([]int16, 960*outputChannels)
+				for i := 0; i < 960; i++ {
+					v := int16(c.amplitude * 32767 * math.Sin(2*math.Pi*c.frequency*float64(pos+i)/outputSampleRate))
+					pcm[i*2], pcm[i*2+1] = v, v
+				}
+				onPCM(index, pcm)
+			}
+			pos += 960
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}, nil
+}
+
+// Opened returns the device lists of every pipeline run
+func (c *syntheticCapture) Opened() [][]ProfileDevice {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]ProfileDevice(nil), c.opened...)
+}
+
+// testBot is a bot wired to a fake gateway and a synthetic capture source
+type testBot struct {
+	gateway *fakeGateway
+	capture *syntheticCapture
+}
+
+// setupTestBot replaces the globals of the bot for one test
+func setupTestBot(t *testing.T, cfg *Config) *testBot {
+	t.Helper()
+
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	cfg.applyDefaults()
+	dir := t.TempDir()
+	cfg.Recording.Dir = filepath.Join(dir, "recordings")
+
+	store, err := loadGuildStore(filepath.Join(dir, guildSettingsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tb := &testBot{
+		gateway: &fakeGateway{},
+		capture: &syntheticCapture{frequency: 440, amplitude: 0.5},
+	}
+
+	oldConfig, oldConfigPath, oldGuildSettings := config, configPath, guildSettings
+	oldBotState, oldGateway, oldCapture := botState, gateway, openCapture
+	t.Cleanup(func() {
+		leaveVoiceChannel()
+		config, configPath, guildSettings = oldConfig, oldConfigPath, oldGuildSettings
+		botState, gateway, openCapture = oldBotState, oldGateway, oldCapture
+	})
+
+	config = cfg
+	configPath = filepath.Join(dir, "config.yaml")
+	guildSettings = store
+	botState = newBotState("", "Test Device")
+	gateway = tb.gateway
+	openCapture = tb.capture.open
+	streamVolume.Store(100)
+	return tb
+}
+
+// recordStates collects the state changes of the bot until the test ends
+func recordStates(t *testing.T) func() []stateChange {
+	changes, cancel := botState.ObserveState()
+	var mu sync.Mutex
+	var seen []stateChange
+	go func() {
+		for c := range changes {
+			mu.Lock()
+			seen = append(seen, c)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(cancel)
+	return func() []stateChange {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]stateChange(nil), seen...)
+	}
+}
+
+// statesOf returns the target states of the changes
+func statesOf(changes []stateChange) []connState {
+	states := make([]connState, len(changes))
+	for i, c := range changes {
+		states[i] = c.to
+	}
+	return states
+}
+
+// waitFor polls cond until it is true or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var (
+	// errJoinRefused is returned by a fake gateway that refuses to join
+	errJoinRefused = errors.New("join refused")
+	// errCaptureFailed is returned by a synthetic capture that fails to open
+	errCaptureFailed = errors.New("capture device unavailable")
+)
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// headless is true when the bot must never wait for console input
+// (systemd, Docker, scheduled tasks). Enabled by --headless or CONSONANCE_HEADLESS.
+var headless bool
+
+// envHeadless enables the headless mode like --headless
+const envHeadless = "CONSONANCE_HEADLESS"
+
+// headlessFromEnv reports whether CONSONANCE_HEADLESS is set to a true value
+func headlessFromEnv() bool {
+	v, ok := os.LookupEnv(envHeadless)
+	if !ok {
+		return false
+	}
+	if v == "" {
+		return true
+	}
+	b, err := strconv.ParseBool(v)
+	return err == nil && b
+}
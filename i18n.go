@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// catalog holds every chat reply in each supported language.
+// Keys missing in a language fall back to Japanese.
+var catalog = map[string]map[string]string{
+	"ja": {
+		"no_permission":       "⛔ このコマンドを実行する権限がありません。",
+		"no_command":          "コマンドを指定してください！ `@Bot help` でヘルプを表示できます。",
+		"unknown_command":     "不明なコマンド: `%s`\n`@Bot help` でヘルプを表示できます。",
+		"join_no_channel":     "チャンネル名またはメンションを指定してください！\n例: `@Bot join #雑談部屋`\n（`@Bot config set default_channel #チャンネル` で既定のチャンネルを設定できます）",
+		"join_failed":         "ボイスチャンネルへの接続に失敗しました: %v",
+		"join_ok":             "✅ ボイスチャンネル `%s` に接続しました！",
+		"channel_info_failed": "チャンネル情報の取得に失敗しました: %v",
+		"channel_list_failed": "チャンネル一覧の取得に失敗しました: %v",
+		"channel_not_found":   "ボイスチャンネル `%s` が見つかりませんでした。",
+		"leave_not_connected": "現在、どのボイスチャンネルにも接続していません。",
+		"leave_ok":            "✅ ボイスチャンネルから退出しました。",
+		"status_disconnected": "ボイスチャンネルに接続していません",
+		"status_title":        "📊 Status",
+		"state_idle":          "未接続",
+		"state_joining":       "接続中…",
+		"state_ready":         "配信停止中",
+		"state_streaming":     "配信中",
+		"state_reconnecting":  "再接続中…",
+		"state_leaving":       "切断中…",
+		"status_uptime":       "接続時間",
+		"status_gateway_ping": "Gateway応答時間 (ping)",
+		"status_buffer":       "バッファ遅延",
+		"status_bitrate":      "ビットレート",
+		"status_target":       "設定",
+		"status_frames":       "送信 / 破棄フレーム",
+		"status_profile":      "プロファイル",
+		"status_stereo":       "ステレオ",
+		"status_dsp":          "フィルタ",
+		"status_level":        "レベル (ピーク / RMS)",
+		"status_devices":      "オーディオデバイス",
+		"status_listeners":    "HTTP視聴者",
+		"status_live_footer":  "%d秒ごとに自動更新",
+		"status_live_stopped": "⏹ ステータスの自動更新を停止しました",
+		"status_live_none":    "自動更新中のステータスはありません",
+		"status_usage":        "使い方: `@Bot status` / `@Bot status live` / `@Bot status stop`",
+
+		"record_none":          "⏺ 現在録音していません。`@Bot record start` で録音を開始できます。",
+		"record_current":       "⏺ 録音中 (%s): `%s`",
+		"record_start_failed":  "録音の開始に失敗しました: %v",
+		"record_started":       "⏺ 録音を開始しました: `%s`",
+		"record_stop_failed":   "録音の停止に失敗しました: %v",
+		"record_stopped":       "⏹ 録音を停止しました。\n保存先: `%s`",
+		"record_usage":         "使い方: `@Bot record start [ogg|wav]` / `@Bot record stop` / `@Bot record`",
+		"guild_only":           "サーバーのテキストチャンネルで実行してください。",
+		"config_title":         "⚙️ **サーバー設定**",
+		"config_unknown_key":   "不明な設定: `%s`\n設定項目: `%s`",
+		"config_need_manage":   "⛔ 設定の変更には「サーバー管理」権限が必要です。",
+		"config_set_usage":     "使い方: `@Bot config set <項目> <値>` / `@Bot config unset <項目>`\n設定項目: `%s`",
+		"config_usage":         "使い方: `@Bot config get [項目]` / `@Bot config set <項目> <値>` / `@Bot config unset <項目>`",
+		"config_failed":        "❌ %v",
+		"config_updated":       "✅ `%s`: %s",
+		"config_not_set":       "(未設定)",
+		"config_roles_default": "(設定ファイルの commands.allowed_role_ids)",
+		"config_lang_default":  "(サーバーの言語)",
+		"config_prof_default":  "(設定ファイルの audio.profile)",
+		"invalid_volume":       "音量は 1〜200 (%) で指定してください",
+		"invalid_role":         "ロールはメンションまたはIDで指定してください: `%s`",
+		"invalid_language":     "対応している言語: %s",
+		"profile_not_found":    "プロファイル `%s` は設定ファイルにありません。`@Bot profile` で一覧を表示できます。",
+		"profile_title":        "🎛️ **Audio Profiles**",
+		"profile_hint":         "`@Bot profile <名前>` で切り替えます",
+		"profile_switched":     "🎛️ プロファイル `%s` に切り替えました",
+		"profile_echo":         "⚠️ 双方向モードの再生を止めました: %v",
+		"profile_selected":     "🎛️ プロファイル `%s` を選択しました（次の配信から使われます）",
+		"reload_failed":        "❌ 設定ファイルにエラーがあるため、現在の設定を維持します\n```\n%v\n```",
+		"reload_unchanged":     "🔄 設定を再読み込みしました（変更はありません）",
+		"reload_done":          "🔄 設定を再読み込みしました\n```\n%s```",
+
+		"level_clipping":         "⚠️ 配信の音声がクリップ（音割れ）しています。入力レベルか `@Bot config set volume` を下げてください。",
+		"level_clipping_cleared": "✅ 配信の音割れは解消しました",
+		"level_silence":          "🔇 配信の音声が無音のままです。キャプチャデバイスや再生中の音声を確認してください。",
+		"level_silence_cleared":  "✅ 配信の音声が戻りました",
+		"status_clipped":         "クリップしたフレーム: %d",
+		"status_clipping":        "⚠️ クリップが続いています",
+		"status_silent":          "🔇 無音が続いています",
+		"config_alert_default":   "(`@Bot join` を使ったチャンネル)",
+		"invalid_text_channel":   "テキストチャンネルはメンションまたはIDで指定してください: `%s`",
+
+		"stereo_usage":           "使い方: `@Bot stereo [stereo|swap|mono|left|right]` / `@Bot stereo balance <-100〜100>` / `@Bot stereo width <1〜200>` / `@Bot stereo reset`",
+		"stereo_current":         "🎚️ ステレオ設定: `%s`",
+		"stereo_changed":         "🎚️ ステレオ設定を変更しました: `%s`（`@Bot stereo reset` まで設定ファイルより優先）",
+		"stereo_reset":           "🎚️ ステレオ設定を設定ファイルの内容に戻しました: `%s`",
+		"stereo_invalid_balance": "バランスは -100（左のみ）〜 100（右のみ）で指定してください",
+		"stereo_invalid_width":   "広がりは 1〜200 (%) で指定してください",
+
+		"dsp_usage":     "使い方: `@Bot dsp on|off` / `@Bot dsp highpass|lowpass|notch <Hz|off>` / `@Bot dsp eq add <Hz> <dB> [Q]` / `@Bot dsp eq remove <番号>` / `@Bot dsp eq clear` / `@Bot dsp comp on|off` / `@Bot dsp comp threshold|ratio|attack|release|makeup <値|default>` / `@Bot dsp reset`",
+		"dsp_current":   "🎛️ フィルタ: `%s`",
+		"dsp_reduction": "コンプレッサーのゲインリダクション: %.1f dB",
+		"dsp_changed":   "🎛️ フィルタを変更しました: `%s`（`@Bot dsp reset` まで設定ファイルより優先）",
+		"dsp_reset":     "🎛️ フィルタを設定ファイルの内容に戻しました: `%s`",
+		"dsp_invalid":   "設定できない値です: %s",
+		"dsp_no_band":   "EQバンドの番号は 1〜%d で指定してください",
+		"dsp_comp_zero": "%[1]s に 0 は指定できません（0 は既定値の意味になります）。既定値に戻すには `@Bot dsp comp %[1]s default` を使ってください",
+
+		"test_usage":          "使い方: `@Bot test tone [周波数Hz] [秒]` / `@Bot test lr` / `@Bot test sweep [秒]` / `@Bot test click [秒]` / `@Bot test stop`",
+		"test_not_streaming":  "配信中のみテスト信号を流せます。先に `@Bot join` してください。",
+		"test_invalid":        "周波数は 20〜20000 Hz、長さは 0.1〜30 秒で指定してください",
+		"test_tone":           "🔊 %.0f Hz のテストトーンを %.1f 秒流します",
+		"test_lr":             "🔊 左チャンネル (440 Hz) → 右チャンネル (880 Hz) の順に2回流します",
+		"test_sweep":          "🔊 20 Hz → 20 kHz のスイープを %.1f 秒流します",
+		"test_click":          "🔊 同期確認用のクリックを %.1f 秒流します（1秒ごと、4回に1回は高い音）",
+		"test_stopped":        "🔇 テスト信号を停止しました",
+		"test_none":           "再生中のテスト信号はありません",
+		"diag_not_streaming":  "配信中のみ診断できます。先に `@Bot join` してください。",
+		"diag_started":        "🩺 配信を %d 秒間計測しています…",
+		"diag_busy":           "既に診断を実行中です",
+		"diag_stopped":        "計測中に配信が停止しました",
+		"diag_failed":         "❌ 診断に失敗しました: %v",
+		"diag_title":          "🩺 診断結果（%d 秒間）",
+		"diag_ok":             "✅ 問題は見つかりませんでした",
+		"diag_frames":         "キャプチャしたフレーム / 予定",
+		"diag_cadence":        "フレーム間隔 (平均 ± 標準偏差, 最小–最大)",
+		"diag_late":           "遅れたフレーム (>30ms)",
+		"diag_clipped":        "クリップしたサンプル",
+		"diag_level":          "配信レベル (ピーク / RMS)",
+		"diag_issue_dropped":  "%d フレームが破棄されました（Discordへの送信が詰まっています）",
+		"diag_issue_slow":     "キャプチャしたフレームが予定より少なくなっています（%d / %d）",
+		"diag_issue_jitter":   "フレーム間隔が最大 %d ms まで乱れています",
+		"diag_issue_silent":   "配信がほぼ無音です。デバイス・音量・再生中の音声を確認してください",
+		"diag_issue_clipping": "%d サンプルがクリップしています。入力レベルを下げてください",
+
+		"help_title":   "**%s - Commands**",
+		"help_join":    "`@Bot join #チャンネル名` - 指定したボイスチャンネルに接続します",
+		"help_join2":   "`@Bot join チャンネル名` - チャンネル名で検索して接続します",
+		"help_leave":   "`@Bot leave` - 現在のボイスチャンネルから退出します",
+		"help_status":  "`@Bot status [live|stop]` - 現在の接続状態を表示します（live: 数秒ごとに自動更新）",
+		"help_rec":     "`@Bot record start [ogg|wav]` - 配信中の音声の録音を開始します",
+		"help_recstop": "`@Bot record stop` - 録音を停止します",
+		"help_reload":  "`@Bot reload` - 設定ファイルを再読み込みします",
+		"help_profile": "`@Bot profile [名前]` - 音声プロファイルの一覧表示・切り替えをします",
+		"help_cfg_get": "`@Bot config get [項目]` - このサーバーの設定を表示します",
+		"help_cfg_set": "`@Bot config set <項目> <値>` - このサーバーの設定を変更します（%s）",
+		"help_stereo":  "`@Bot stereo [モード|balance|width|reset]` - 左右入れ替え・モノラル化・バランス・広がりを変更します",
+		"help_dsp":     "`@Bot dsp [on|off|highpass|lowpass|notch|eq|comp|reset]` - ハム除去・EQ・コンプレッサーなどのフィルタを変更します",
+		"help_test":    "`@Bot test tone|lr|sweep|click|stop` - テスト信号を配信に流します",
+		"help_diag":    "`@Bot diag` - 配信を10秒間計測して問題を診断します",
+		"help_help":    "`@Bot help` - このヘルプを表示します",
+	},
+	"en": {
+		"no_permission":       "⛔ You are not allowed to use this command.",
+		"no_command":          "Please give a command! Use `@Bot help` to see the help.",
+		"unknown_command":     "Unknown command: `%s`\nUse `@Bot help` to see the help.",
+		"join_no_channel":     "Please give a channel name or mention!\nExample: `@Bot join #general`\n(You can set a default channel with `@Bot config set default_channel #channel`)",
+		"join_failed":         "Failed to join the voice channel: %v",
+		"join_ok":             "✅ Joined voice channel `%s`!",
+		"channel_info_failed": "Failed to get the channel: %v",
+		"channel_list_failed": "Failed to get the channel list: %v",
+		"channel_not_found":   "Voice channel `%s` was not found.",
+		"leave_not_connected": "I'm not connected to any voice channel.",
+		"leave_ok":            "✅ Left the voice channel.",
+		"status_disconnected": "Not connected to a voice channel",
+		"status_title":        "📊 Status",
+		"state_idle":          "Not connected",
+		"state_joining":       "Joining…",
+		"state_ready":         "Not streaming",
+		"state_streaming":     "Streaming",
+		"state_reconnecting":  "Reconnecting…",
+		"state_leaving":       "Leaving…",
+		"status_uptime":       "Uptime",
+		"status_gateway_ping": "Gateway ping",
+		"status_buffer":       "Buffer latency",
+		"status_bitrate":      "Bitrate",
+		"status_target":       "target",
+		"status_frames":       "Frames sent / dropped",
+		"status_profile":      "Profile",
+		"status_stereo":       "Stereo",
+		"status_dsp":          "Filters",
+		"status_level":        "Level (peak / RMS)",
+		"status_devices":      "Audio devices",
+		"status_listeners":    "HTTP listeners",
+		"status_live_footer":  "updates every %d seconds",
+		"status_live_stopped": "⏹ Stopped updating the status",
+		"status_live_none":    "No status is being updated",
+		"status_usage":        "Usage: `@Bot status` / `@Bot status live` / `@Bot status stop`",
+
+		"record_none":          "⏺ Not recording. Use `@Bot record start` to start recording.",
+		"record_current":       "⏺ Recording (%s): `%s`",
+		"record_start_failed":  "Failed to start recording: %v",
+		"record_started":       "⏺ Recording started: `%s`",
+		"record_stop_failed":   "Failed to stop recording: %v",
+		"record_stopped":       "⏹ Recording stopped.\nSaved to: `%s`",
+		"record_usage":         "Usage: `@Bot record start [ogg|wav]` / `@Bot record stop` / `@Bot record`",
+		"guild_only":           "Please use this command in a server text channel.",
+		"config_title":         "⚙️ **Server Settings**",
+		"config_unknown_key":   "Unknown setting: `%s`\nSettings: `%s`",
+		"config_need_manage":   "⛔ Changing settings requires the \"Manage Server\" permission.",
+		"config_set_usage":     "Usage: `@Bot config set <setting> <value>` / `@Bot config unset <setting>`\nSettings: `%s`",
+		"config_usage":         "Usage: `@Bot config get [setting]` / `@Bot config set <setting> <value>` / `@Bot config unset <setting>`",
+		"config_failed":        "❌ %v",
+		"config_updated":       "✅ `%s`: %s",
+		"config_not_set":       "(not set)",
+		"config_roles_default": "(commands.allowed_role_ids in the config file)",
+		"config_lang_default":  "(server language)",
+		"config_prof_default":  "(audio.profile in the config file)",
+		"invalid_volume":       "Volume must be between 1 and 200 (%)",
+		"invalid_role":         "Give roles as mentions or IDs: `%s`",
+		"invalid_language":     "Supported languages: %s",
+		"profile_not_found":    "Profile `%s` is not in the config file. Use `@Bot profile` to list the profiles.",
+		"profile_title":        "🎛️ **Audio Profiles**",
+		"profile_hint":         "Switch with `@Bot profile <name>`",
+		"profile_switched":     "🎛️ Switched to profile `%s`",
+		"profile_echo":         "⚠️ Two-way playback stopped: %v",
+		"profile_selected":     "🎛️ Selected profile `%s` (used from the next stream)",
+		"reload_failed":        "❌ The config file has errors, keeping the current settings\n```\n%v\n```",
+		"reload_unchanged":     "🔄 Config reloaded (no changes)",
+		"reload_done":          "🔄 Config reloaded\n```\n%s```",
+
+		"level_clipping":         "⚠️ The stream is clipping. Lower the input level or `@Bot config set volume`.",
+		"level_clipping_cleared": "✅ The stream is no longer clipping",
+		"level_silence":          "🔇 The stream has been silent for a while. Check the capture device and what is playing.",
+		"level_silence_cleared":  "✅ The stream audio is back",
+		"status_clipped":         "Clipped frames: %d",
+		"status_clipping":        "⚠️ Clipping continuously",
+		"status_silent":          "🔇 Silent",
+		"config_alert_default":   "(the channel `@Bot join` was used in)",
+		"invalid_text_channel":   "Give the text channel as a mention or ID: `%s`",
+
+		"stereo_usage":           "Usage: `@Bot stereo [stereo|swap|mono|left|right]` / `@Bot stereo balance <-100..100>` / `@Bot stereo width <1..200>` / `@Bot stereo reset`",
+		"stereo_current":         "🎚️ Stereo: `%s`",
+		"stereo_changed":         "🎚️ Stereo changed to `%s` (used instead of the config file until `@Bot stereo reset`)",
+		"stereo_reset":           "🎚️ Stereo back to the config file: `%s`",
+		"stereo_invalid_balance": "Balance must be between -100 (left only) and 100 (right only)",
+		"stereo_invalid_width":   "Width must be between 1 and 200 (%)",
+
+		"dsp_usage":     "Usage: `@Bot dsp on|off` / `@Bot dsp highpass|lowpass|notch <Hz|off>` / `@Bot dsp eq add <Hz> <dB> [Q]` / `@Bot dsp eq remove <number>` / `@Bot dsp eq clear` / `@Bot dsp comp on|off` / `@Bot dsp comp threshold|ratio|attack|release|makeup <value|default>` / `@Bot dsp reset`",
+		"dsp_current":   "🎛️ Filters: `%s`",
+		"dsp_reduction": "Compressor gain reduction: %.1f dB",
+		"dsp_changed":   "🎛️ Filters changed to `%s` (used instead of the config file until `@Bot dsp reset`)",
+		"dsp_reset":     "🎛️ Filters back to the config file: `%s`",
+		"dsp_invalid":   "Invalid value: %s",
+		"dsp_no_band":   "EQ band numbers are 1 to %d",
+		"dsp_comp_zero": "The compressor %[1]s cannot be set to 0, which means the default. Use `@Bot dsp comp %[1]s default` to go back to the default",
+
+		"test_usage":          "Usage: `@Bot test tone [Hz] [seconds]` / `@Bot test lr` / `@Bot test sweep [seconds]` / `@Bot test click [seconds]` / `@Bot test stop`",
+		"test_not_streaming":  "Test signals can only be played while streaming. Use `@Bot join` first.",
+		"test_invalid":        "Frequency must be 20-20000 Hz and length 0.1-30 seconds",
+		"test_tone":           "🔊 Playing a %.0f Hz test tone for %.1f seconds",
+		"test_lr":             "🔊 Playing the left channel (440 Hz), then the right channel (880 Hz), twice",
+		"test_sweep":          "🔊 Playing a 20 Hz - 20 kHz sweep for %.1f seconds",
+		"test_click":          "🔊 Playing sync clicks for %.1f seconds (one per second, every fourth one higher)",
+		"test_stopped":        "🔇 Test signal stopped",
+		"test_none":           "No test signal is playing",
+		"diag_not_streaming":  "Diagnostics only work while streaming. Use `@Bot join` first.",
+		"diag_started":        "🩺 Measuring the stream for %d seconds…",
+		"diag_busy":           "Diagnostics are already running",
+		"diag_stopped":        "The stream stopped during the measurement",
+		"diag_failed":         "❌ Diagnostics failed: %v",
+		"diag_title":          "🩺 Diagnostics (%d seconds)",
+		"diag_ok":             "✅ No problems found",
+		"diag_frames":         "Frames captured / expected",
+		"diag_cadence":        "Frame interval (mean ± stddev, min–max)",
+		"diag_late":           "Late frames (>30ms)",
+		"diag_clipped":        "Clipped samples",
+		"diag_level":          "Stream level (peak / RMS)",
+		"diag_issue_dropped":  "%d frames were dropped (sending to Discord is congested)",
+		"diag_issue_slow":     "Fewer frames were captured than expected (%d / %d)",
+		"diag_issue_jitter":   "Frame intervals vary up to %d ms",
+		"diag_issue_silent":   "The stream is almost silent. Check the device, the volume and what is playing",
+		"diag_issue_clipping": "%d samples are clipping. Lower the input level",
+
+		"help_title":   "**%s - Commands**",
+		"help_join":    "`@Bot join #channel-name` - Join the voice channel",
+		"help_join2":   "`@Bot join channel-name` - Find a voice channel by name and join it",
+		"help_leave":   "`@Bot leave` - Leave the current voice channel",
+		"help_status":  "`@Bot status [live|stop]` - Show the connection status (live: update every few seconds)",
+		"help_rec":     "`@Bot record start [ogg|wav]` - Start recording the stream",
+		"help_recstop": "`@Bot record stop` - Stop recording",
+		"help_reload":  "`@Bot reload` - Reload the config file",
+		"help_profile": "`@Bot profile [name]` - List or switch audio profiles",
+		"help_cfg_get": "`@Bot config get [setting]` - Show this server's settings",
+		"help_cfg_set": "`@Bot config set <setting> <value>` - Change this server's settings (%s)",
+		"help_stereo":  "`@Bot stereo [mode|balance|width|reset]` - Swap, downmix, balance or widen the channels",
+		"help_dsp":     "`@Bot dsp [on|off|highpass|lowpass|notch|eq|comp|reset]` - Change the filters (hum removal, EQ, compressor)",
+		"help_test":    "`@Bot test tone|lr|sweep|click|stop` - Play a test signal into the stream",
+		"help_diag":    "`@Bot diag` - Measure the stream for 10 seconds and report problems",
+		"help_help":    "`@Bot help` - Show this help",
+	},
+}
+
+// helpKeys lists the lines of "@Bot help" in order
+var helpKeys = []string{
+	"help_join", "help_join2", "help_leave", "help_status", "help_rec", "help_recstop",
+	"help_reload", "help_profile", "help_cfg_get", "help_cfg_set",
+	"help_stereo", "help_dsp", "help_test", "help_diag", "help_help",
+}
+
+// tr returns the message for key in lang, formatted with args
+func tr(lang, key string, args ...interface{}) string {
+	msg, ok := catalog[lang][key]
+	if !ok {
+		msg, ok = catalog["ja"][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// replyLanguage picks the reply language of a guild: the language set with
+// "@Bot config set language", then the guild's preferred locale, then commands.language
+func replyLanguage(s *discordgo.Session, guildID string) string {
+	if guildID != "" {
+		if lang := guildSettings.Get(guildID).Language; lang != "" {
+			return lang
+		}
+		if guild, err := s.State.Guild(guildID); err == nil {
+			if lang := languageOfLocale(string(guild.PreferredLocale)); lang != "" {
+				return lang
+			}
+		}
+	}
+	return currentConfig().Commands.Language
+}
+
+// languageOfLocale maps a Discord locale (e.g. "ja", "en-US") to a supported language
+func languageOfLocale(locale string) string {
+	lang := strings.ToLower(strings.SplitN(locale, "-", 2)[0])
+	for _, supported := range supportedLanguages {
+		if lang == supported {
+			return lang
+		}
+	}
+	return ""
+}
+
+// userError is an error shown to the user in their language
+type userError struct {
+	key  string
+	args []interface{}
+}
+
+func newUserError(key string, args ...interface{}) *userError {
+	return &userError{key: key, args: args}
+}
+
+func (e *userError) Error() string {
+	return tr("en", e.key, e.args...)
+}
+
+// localizeError returns the text of err in lang
+func localizeError(lang string, err error) string {
+	if ue, ok := err.(*userError); ok {
+		return tr(lang, ue.key, ue.args...)
+	}
+	return err.Error()
+}
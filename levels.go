@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// clipFramesPerSecond is how many clipped frames make a second count as clipping
+	clipFramesPerSecond = 5
+
+	// levelClearSeconds is how long the audio must be clean before a clipping alert ends
+	levelClearSeconds = 10
+
+	// levelAlertCooldown keeps a flapping alert from flooding the control channel
+	levelAlertCooldown = 5 * time.Minute
+
+	// consoleMeterInterval is how often the console meter is redrawn
+	consoleMeterInterval = 100 * time.Millisecond
+
+	// consoleMeterWidth is the width of each channel's bar in the console meter
+	consoleMeterWidth = 24
+)
+
+// channelLevel is the peak and RMS level of one channel in dBFS
+type channelLevel struct {
+	peakDB float64
+	rmsDB  float64
+}
+
+// levelAccumulator sums the levels of both channels over a period
+type levelAccumulator struct {
+	peak    [2]int
+	squares [2]float64
+	samples int // 1チャンネルあたりのサンプル数
+	clipped int // フルスケールに達したサンプル数
+}
+
+// measureFrame returns the levels of one interleaved stereo frame
+func measureFrame(pcm []int16) levelAccumulator {
+	var a levelAccumulator
+	for i, s := range pcm {
+		v := int(s)
+		if v < 0 {
+			v = -v
+		}
+		if v >= 32767 {
+			a.clipped++
+		}
+		ch := i % 2
+		a.peak[ch] = max(a.peak[ch], v)
+		a.squares[ch] += float64(v) * float64(v)
+	}
+	a.samples = len(pcm) / 2
+	return a
+}
+
+func (a *levelAccumulator) add(b levelAccumulator) {
+	for ch := 0; ch < 2; ch++ {
+		a.peak[ch] = max(a.peak[ch], b.peak[ch])
+		a.squares[ch] += b.squares[ch]
+	}
+	a.samples += b.samples
+	a.clipped += b.clipped
+}
+
+// channels returns the accumulated level of each channel
+func (a levelAccumulator) channels() [2]channelLevel {
+	var levels [2]channelLevel
+	for ch := 0; ch < 2; ch++ {
+		levels[ch].peakDB = toDBFS(float64(a.peak[ch]))
+		levels[ch].rmsDB = math.Inf(-1)
+		if a.samples > 0 {
+			levels[ch].rmsDB = toDBFS(math.Sqrt(a.squares[ch] / float64(a.samples)))
+		}
+	}
+	return levels
+}
+
+// total returns the accumulated level of both channels together
+func (a levelAccumulator) total() channelLevel {
+	level := channelLevel{toDBFS(float64(max(a.peak[0], a.peak[1]))), math.Inf(-1)}
+	if a.samples > 0 {
+		level.rmsDB = toDBFS(math.Sqrt((a.squares[0] + a.squares[1]) / float64(2*a.samples)))
+	}
+	return level
+}
+
+// levelAlert is a change of the clipping or silence alert
+type levelAlert struct {
+	kind   string // "clipping" or "silence"
+	active bool
+}
+
+// levelMonitor measures every frame before it is encoded and raises alerts
+// on sustained clipping or silence. observe is called from the audio callback.
+type levelMonitor struct {
+	mu    sync.Mutex
+	cfg   LevelsConfig
+	probe *levelAccumulator // "@Bot diag" の計測中の集計
+	levelState
+}
+
+// levelState is what the monitor measures during one pipeline run
+type levelState struct {
+	meter  levelAccumulator // コンソールメーターが読み出すまでの集計
+	window levelAccumulator // 1秒ごとの集計
+
+	windowFrames  int
+	windowClipped int
+	last          [2]channelLevel // 直前の1秒
+	lastTotal     channelLevel
+	clippedFrames uint64
+
+	clipSeconds   int // クリップが続いている秒数
+	cleanSeconds  int // クリップ後に問題のない秒数
+	silentSeconds int
+	clipping      bool
+	silent        bool
+}
+
+// levels is the level monitor of the stream
+var levels = newLevelMonitor()
+
+// levelAlertHandler is called in a new goroutine whenever an alert starts or ends
+var levelAlertHandler = postLevelAlert
+
+// newLevelMonitor creates a monitor that shows silence until the first frame
+func newLevelMonitor() *levelMonitor {
+	m := &levelMonitor{}
+	m.start(LevelsConfig{})
+	return m
+}
+
+// start resets the monitor for a new pipeline run
+func (m *levelMonitor) start(cfg LevelsConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+	m.levelState = levelState{}
+	for ch := range m.last {
+		m.last[ch] = channelLevel{math.Inf(-1), math.Inf(-1)}
+	}
+	m.lastTotal = channelLevel{math.Inf(-1), math.Inf(-1)}
+}
+
+// Configure changes the alert thresholds of the running monitor
+func (m *levelMonitor) Configure(cfg LevelsConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+}
+
+// observe measures one stereo frame. It is the only place the levels of the
+// stream are computed; the status, the console meter and "@Bot diag" read them from here.
+func (m *levelMonitor) observe(pcm []int16) {
+	frame := measureFrame(pcm)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.meter.add(frame)
+	m.window.add(frame)
+	if m.probe != nil {
+		m.probe.add(frame)
+	}
+	m.windowFrames++
+	// 1サンプルだけの振り切れは聞こえないので数えない
+	if frame.clipped >= 2 {
+		m.windowClipped++
+		m.clippedFrames++
+	}
+	if m.windowFrames < statsWindowFrames {
+		return
+	}
+	m.last, m.lastTotal = m.window.channels(), m.window.total()
+	m.window = levelAccumulator{}
+	m.evaluateLocked()
+	m.windowFrames, m.windowClipped = 0, 0
+}
+
+// startProbe starts collecting the levels for a diagnosis
+func (m *levelMonitor) startProbe() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.probe = &levelAccumulator{}
+}
+
+// stopProbe returns the levels collected since startProbe
+func (m *levelMonitor) stopProbe() levelAccumulator {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	probe := m.probe
+	m.probe = nil
+	if probe == nil {
+		return levelAccumulator{}
+	}
+	return *probe
+}
+
+// evaluateLocked updates the alerts after each second
+func (m *levelMonitor) evaluateLocked() {
+	if m.windowClipped >= clipFramesPerSecond {
+		m.clipSeconds++
+		m.cleanSeconds = 0
+	} else {
+		m.clipSeconds = 0
+		m.cleanSeconds++
+	}
+	switch {
+	case !m.clipping && m.cfg.ClipAlertSeconds > 0 && m.clipSeconds >= m.cfg.ClipAlertSeconds:
+		m.clipping = true
+		m.raiseLocked(levelAlert{kind: "clipping", active: true})
+	case m.clipping && m.cleanSeconds >= levelClearSeconds:
+		m.clipping = false
+		m.raiseLocked(levelAlert{kind: "clipping", active: false})
+	}
+
+	if max(m.last[0].peakDB, m.last[1].peakDB) < meterFloorDB {
+		m.silentSeconds++
+	} else {
+		m.silentSeconds = 0
+	}
+	switch {
+	case !m.silent && m.cfg.SilenceAlertSeconds > 0 && m.silentSeconds >= m.cfg.SilenceAlertSeconds:
+		m.silent = true
+		m.raiseLocked(levelAlert{kind: "silence", active: true})
+	case m.silent && m.silentSeconds == 0:
+		m.silent = false
+		m.raiseLocked(levelAlert{kind: "silence", active: false})
+	}
+}
+
+// raiseLocked logs the alert and hands it to levelAlertHandler outside the audio callback
+func (m *levelMonitor) raiseLocked(alert levelAlert) {
+	switch {
+	case alert.kind == "clipping" && alert.active:
+		slog.Warn("The stream is clipping, lower the input level or the volume", "seconds", m.clipSeconds)
+	case alert.kind == "silence" && alert.active:
+		slog.Warn("The stream is silent", "seconds", m.silentSeconds)
+	case alert.kind == "clipping":
+		log.Printf("Stream level back to normal (no clipping for %d seconds)", levelClearSeconds)
+	default:
+		log.Println("Stream audio is back after silence")
+	}
+	go levelAlertHandler(alert)
+}
+
+// levelSnapshot is a copy of the levels for "@Bot status"
+type levelSnapshot struct {
+	total         channelLevel // 両チャンネル合わせたレベル
+	left, right   channelLevel
+	clippedFrames uint64
+	clipping      bool
+	silent        bool
+}
+
+// snapshot returns the levels of the last second and the alert state
+func (m *levelMonitor) snapshot() levelSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return levelSnapshot{
+		total:         m.lastTotal,
+		left:          m.last[0],
+		right:         m.last[1],
+		clippedFrames: m.clippedFrames,
+		clipping:      m.clipping,
+		silent:        m.silent,
+	}
+}
+
+// meterLevels returns the levels since the previous call, for the console meter
+func (m *levelMonitor) meterLevels() ([2]channelLevel, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meter := m.meter.channels()
+	m.meter = levelAccumulator{}
+	return meter, m.clipping
+}
+
+// levelAlertPosts remembers the alerts posted to Discord
+var levelAlertPosts = struct {
+	sync.Mutex
+	last   map[string]time.Time // 最後に開始を通知した時刻
+	active map[string]bool      // 開始を通知して、まだ解消を通知していない
+}{last: make(map[string]time.Time), active: make(map[string]bool)}
+
+// postLevelAlert sends an alert to the control channel: the alert_channel
+// of the server, or the channel "@Bot join" was used in
+func postLevelAlert(alert levelAlert) {
+	if session == nil {
+		return
+	}
+	botState.RLock()
+	guildID, channelID := botState.guildID, botState.textChannelID
+	botState.RUnlock()
+	if id := guildSettings.Get(guildID).AlertChannelID; id != "" {
+		channelID = id
+	}
+	if channelID == "" {
+		return
+	}
+
+	// 開始の通知は間隔を空け、解消は通知した警告についてだけ知らせる
+	posts := &levelAlertPosts
+	posts.Lock()
+	if alert.active {
+		if time.Since(posts.last[alert.kind]) < levelAlertCooldown {
+			posts.Unlock()
+			return
+		}
+		posts.last[alert.kind] = time.Now()
+	} else if !posts.active[alert.kind] {
+		posts.Unlock()
+		return
+	}
+	posts.active[alert.kind] = alert.active
+	posts.Unlock()
+
+	key := "level_" + alert.kind
+	if !alert.active {
+		key += "_cleared"
+	}
+	lang := replyLanguage(session, guildID)
+	if _, err := session.ChannelMessageSend(channelID, tr(lang, key)); err != nil {
+		slog.Error("Failed to send level alert", "error", err)
+	}
+}
+
+// consoleMu serializes the console output of the log and the console meter
+var consoleMu sync.Mutex
+
+// consoleMeterShown is the width of the meter line on the console, 0 when none is drawn
+var consoleMeterShown int
+
+// eraseConsoleMeterLocked removes the meter line so that a log line can be
+// printed in its place. consoleMu must be locked.
+func eraseConsoleMeterLocked() {
+	if consoleMeterShown == 0 {
+		return
+	}
+	fmt.Fprint(os.Stdout, "\r"+strings.Repeat(" ", consoleMeterShown)+"\r")
+	consoleMeterShown = 0
+}
+
+// isTerminal reports whether f is an interactive console
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// runConsoleMeter draws a live level meter on the last console line while
+// streaming, until ctx is cancelled. Nothing is drawn unless levels.console_meter is set.
+func runConsoleMeter(ctx context.Context) {
+	if headless || !isTerminal(os.Stdout) {
+		return
+	}
+	ticker := time.NewTicker(consoleMeterInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			consoleMu.Lock()
+			eraseConsoleMeterLocked()
+			consoleMu.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		if !currentConfig().Levels.ConsoleMeter || !stats.snapshot().running {
+			consoleMu.Lock()
+			eraseConsoleMeterLocked()
+			consoleMu.Unlock()
+			continue
+		}
+		line := formatConsoleMeter(levels.meterLevels())
+		consoleMu.Lock()
+		// 前の行より短くなっても残りが消えるように空白で埋める
+		width := utf8.RuneCountInString(line)
+		fmt.Fprint(os.Stdout, "\r"+line+strings.Repeat(" ", max(consoleMeterShown-width, 0)))
+		consoleMeterShown = max(width, 1)
+		consoleMu.Unlock()
+	}
+}
+
+// formatConsoleMeter formats the meter line, e.g. "L ████░░ -12.0  R ████░░ -12.3 dBFS"
+func formatConsoleMeter(levels [2]channelLevel, clipping bool) string {
+	line := fmt.Sprintf("L %s %5s  R %s %5s dBFS",
+		levelBar(levels[0].peakDB, consoleMeterWidth), formatDB(levels[0].peakDB),
+		levelBar(levels[1].peakDB, consoleMeterWidth), formatDB(levels[1].peakDB))
+	if levels[0].peakDB >= -0.1 || levels[1].peakDB >= -0.1 || clipping {
+		line += "  CLIP"
+	}
+	return line
+}
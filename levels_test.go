@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLevelAlerts collects the alerts raised until the test ends
+func captureLevelAlerts(t *testing.T) <-chan levelAlert {
+	alerts := make(chan levelAlert, 10)
+	old := levelAlertHandler
+	levelAlertHandler = func(alert levelAlert) { alerts <- alert }
+	t.Cleanup(func() { levelAlertHandler = old })
+	return alerts
+}
+
+// feedFrames passes seconds of the frame to the monitor
+func feedFrames(m *levelMonitor, frame []int16, seconds int) {
+	for i := 0; i < seconds*statsWindowFrames; i++ {
+		m.observe(frame)
+	}
+}
+
+func expectAlert(t *testing.T, alerts <-chan levelAlert, want levelAlert) {
+	t.Helper()
+	select {
+	case got := <-alerts:
+		if got != want {
+			t.Fatalf("alert = %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no alert, want %+v", want)
+	}
+}
+
+func TestLevelMonitorClippingAlert(t *testing.T) {
+	alerts := captureLevelAlerts(t)
+	m := newLevelMonitor()
+	m.start(LevelsConfig{ClipAlertSeconds: 2})
+
+	clipped := make([]int16, 960*outputChannels)
+	for i := range clipped {
+		clipped[i] = 32767
+	}
+	feedFrames(m, clipped, 1)
+	if m.snapshot().clipping {
+		t.Fatal("clipping alert after 1 second, want 2")
+	}
+	feedFrames(m, clipped, 1)
+	expectAlert(t, alerts, levelAlert{kind: "clipping", active: true})
+	if lv := m.snapshot(); !lv.clipping || lv.clippedFrames != 100 {
+		t.Errorf("snapshot = %+v, want clipping with 100 clipped frames", lv)
+	}
+
+	feedFrames(m, sineFrame(0, 0.5), levelClearSeconds)
+	expectAlert(t, alerts, levelAlert{kind: "clipping", active: false})
+}
+
+func TestLevelMonitorSilenceAlert(t *testing.T) {
+	alerts := captureLevelAlerts(t)
+	m := newLevelMonitor()
+	m.start(LevelsConfig{SilenceAlertSeconds: 3})
+
+	feedFrames(m, make([]int16, 960*outputChannels), 3)
+	expectAlert(t, alerts, levelAlert{kind: "silence", active: true})
+
+	feedFrames(m, sineFrame(0, 0.5), 1)
+	expectAlert(t, alerts, levelAlert{kind: "silence", active: false})
+}
+
+func TestLevelMonitorAlertsOff(t *testing.T) {
+	alerts := captureLevelAlerts(t)
+	m := newLevelMonitor()
+	m.start(LevelsConfig{})
+
+	feedFrames(m, make([]int16, 960*outputChannels), 5)
+	select {
+	case alert := <-alerts:
+		t.Errorf("alert %+v with alerts disabled", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLevelProbeCollectsFrames(t *testing.T) {
+	m := newLevelMonitor()
+	m.start(LevelsConfig{})
+	feedFrames(m, sineFrame(0, 0.5), 1)
+
+	// 診断の計測は開始してからのフレームだけを集計する
+	m.startProbe()
+	clipped := sineFrame(0, 0.5)
+	clipped[0], clipped[1] = 32767, -32768
+	feedFrames(m, clipped, 1)
+	probe := m.stopProbe()
+
+	if probe.clipped != 2*statsWindowFrames {
+		t.Errorf("clipped samples = %d, want 2 per frame", probe.clipped)
+	}
+	if probe.samples != len(clipped)/2*statsWindowFrames {
+		t.Errorf("samples = %d, want one second", probe.samples)
+	}
+	if empty := m.stopProbe(); empty.samples != 0 {
+		t.Errorf("stopped probe still collected %d samples", empty.samples)
+	}
+}
+
+func TestLevelMonitorMeasuresChannels(t *testing.T) {
+	m := newLevelMonitor()
+	m.start(LevelsConfig{})
+
+	// 左チャンネルだけに音を入れる
+	frame := sineFrame(0, 0.5)
+	for i := 1; i < len(frame); i += 2 {
+		frame[i] = 0
+	}
+	feedFrames(m, frame, 1)
+
+	lv := m.snapshot()
+	if lv.left.peakDB < -7 || lv.left.peakDB > -5 {
+		t.Errorf("left peak = %.1f dBFS, want about -6", lv.left.peakDB)
+	}
+	if lv.left.rmsDB < -10 || lv.left.rmsDB > -8 {
+		t.Errorf("left RMS = %.1f dBFS, want about -9", lv.left.rmsDB)
+	}
+	if formatDB(lv.right.peakDB) != "-inf" {
+		t.Errorf("right peak = %.1f dBFS, want silence", lv.right.peakDB)
+	}
+	// 両チャンネル合わせると RMS は片側だけの分 3 dB 下がる
+	if lv.total.peakDB != lv.left.peakDB || lv.total.rmsDB < lv.left.rmsDB-3.2 || lv.total.rmsDB > lv.left.rmsDB-2.8 {
+		t.Errorf("total = %.1f / %.1f dBFS, want the left peak and 3 dB below its RMS", lv.total.peakDB, lv.total.rmsDB)
+	}
+
+	meter, _ := m.meterLevels()
+	if line := formatConsoleMeter(meter, false); !strings.HasPrefix(line, "L ") || strings.Contains(line, "CLIP") {
+		t.Errorf("console meter = %q", line)
+	}
+	if line := formatConsoleMeter(meter, true); !strings.HasSuffix(line, "CLIP") {
+		t.Errorf("console meter while clipping = %q", line)
+	}
+}
+
+func TestStreamFeedsLevelMonitor(t *testing.T) {
+	setupTestBot(t, nil)
+	levels.start(LevelsConfig{})
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 3*time.Second, "levels of the stream", func() bool {
+		lv := levels.snapshot()
+		return lv.left.peakDB > -7 && lv.right.peakDB > -7
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"time"
+)
+
+const (
+	// shutdownTimeout bounds the whole shutdown; the bot exits even if Discord does not answer
+	shutdownTimeout = 10 * time.Second
+
+	// silenceTrailerFrames of silence are sent when a stream stops so that
+	// Discord clients do not interpolate the last frames into noise
+	silenceTrailerFrames = 5
+
+	// trailerTimeout bounds sending the silence trailer and waiting for the queue to drain
+	trailerTimeout = time.Second
+)
+
+// opusSilenceFrame is a 20ms Opus frame of silence
+var opusSilenceFrame = []byte{0xF8, 0xFF, 0xFE}
+
+// sendSilenceTrailer sends the silence frames and waits until the queued
+// frames have been sent, giving up after trailerTimeout
+func sendSilenceTrailer(v voiceConn) {
+	opusSend := v.OpusSend()
+	deadline := time.NewTimer(trailerTimeout)
+	defer deadline.Stop()
+
+	for i := 0; i < silenceTrailerFrames; i++ {
+		select {
+		case opusSend <- opusSilenceFrame:
+		case <-deadline.C:
+			slog.Warn("Timed out sending the silence trailer")
+			return
+		}
+	}
+
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for len(opusSend) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			slog.Warn("Timed out waiting for queued frames to be sent")
+			return
+		}
+	}
+}
+
+// shutdown stops every stream, leaves all voice channels and closes the
+// session. It returns after timeout even if some step hangs.
+func shutdown(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		liveStatus.Stop()
+		stopStreamServer()
+		stopOutputs()
+
+		// 配信中のパイプラインに停止を伝えてから退出を待つ
+		botState.cancel()
+		leaveVoiceChannel()
+
+		// 再接続中などで管理外になった接続も切断する
+		if gateway != nil {
+			gateway.DisconnectAll()
+		}
+		if session != nil {
+			if err := session.Close(); err != nil {
+				slog.Warn("Failed to close Discord session", "error", err)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+		log.Println("Shutdown complete")
+	case <-time.After(timeout):
+		slog.Warn("Shutdown did not finish in time, exiting anyway", "timeout", timeout)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// logFileName is the file currently written in the log directory
+	logFileName = "consonance.log"
+
+	// logRepeatInterval is how often the same repeated warning is logged
+	logRepeatInterval = 10 * time.Second
+)
+
+// logLevel is the minimum level written to the console and the log file.
+// It is changed in place when logging.level is reloaded.
+var logLevel = new(slog.LevelVar)
+
+// logLevels maps the values of logging.level to slog levels
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging sends the log and slog output to the console and the rotating
+// log file. If the log file cannot be opened, logging continues on the console
+// only and the error is returned.
+func setupLogging(cfg LoggingConfig) (io.Closer, error) {
+	logLevel.Set(logLevels[cfg.Level])
+	console := newConsoleHandler(cfg.Format)
+
+	file, err := openRotatingFile(cfg)
+	if err != nil {
+		installLogHandler(console)
+		return nil, err
+	}
+	installLogHandler(fanoutHandler{console, newFormatHandler(file, cfg.Format)})
+	return file, nil
+}
+
+// newConsoleHandler creates the handler of the console output
+func newConsoleHandler(format string) slog.Handler {
+	if headless {
+		// ヘッドレスモードではログ収集ツール向けにファイルと同じ形式で出力
+		return newFormatHandler(os.Stdout, format)
+	}
+	return &consoleHandler{mu: &consoleMu, out: os.Stdout}
+}
+
+// installLogHandler makes h the slog default and routes the standard log
+// package (informational messages) and discordgo's log through it
+func installLogHandler(h slog.Handler) {
+	slog.SetDefault(slog.New(h))
+	// slog.SetDefault は log パッケージを slog の既定ハンドラ経由で再帰させるので置き換える
+	log.SetOutput(logBridge{})
+	log.SetFlags(0)
+	discordgo.Logger = discordLogger
+}
+
+// newFormatHandler creates the handler of logging.format ("text" is logfmt)
+func newFormatHandler(out io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == "json" {
+		return slog.NewJSONHandler(out, opts)
+	}
+	return slog.NewTextHandler(out, opts)
+}
+
+// logBridge passes lines written with the log package to slog at Info level.
+// Warnings and errors are logged with slog.Warn / slog.Error directly.
+type logBridge struct{}
+
+func (logBridge) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		msg := strings.TrimSpace(line)
+		if msg == "" {
+			continue
+		}
+		slog.Info(msg)
+	}
+	return len(p), nil
+}
+
+// discordLevels maps the log levels of discordgo to slog levels
+var discordLevels = map[int]slog.Level{
+	discordgo.LogError:         slog.LevelError,
+	discordgo.LogWarning:       slog.LevelWarn,
+	discordgo.LogInformational: slog.LevelInfo,
+	discordgo.LogDebug:         slog.LevelDebug,
+}
+
+// discordLogger logs discordgo's messages with their own level
+func discordLogger(msgL, caller int, format string, a ...interface{}) {
+	slog.Log(context.Background(), discordLevels[msgL], strings.TrimSpace(fmt.Sprintf(format, a...)), "source", "discordgo")
+}
+
+// consoleHandler prints records as "date time [LEVEL] message key=value"
+// for people watching the console
+type consoleHandler struct {
+	mu    *sync.Mutex
+	out   io.Writer
+	attrs []slog.Attr
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	if r.Level != slog.LevelInfo {
+		fmt.Fprintf(&buf, "[%s] ", r.Level)
+	}
+	buf.WriteString(r.Message)
+	for _, a := range h.attrs {
+		fmt.Fprintf(&buf, " %s=%v", a.Key, a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&buf, " %s=%v", a.Key, a.Value)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// レベルメーターの行をログで上書きする（次の描画で下に出直す）
+	eraseConsoleMeterLocked()
+	_, err := h.out.Write(buf.Bytes())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &consoleHandler{mu: h.mu, out: h.out, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+}
+
+// WithGroup is not used by the bot; groups are flattened
+func (h *consoleHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// fanoutHandler passes every record to several handlers
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range f {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// rotatingFile is the log file in logging.dir. It starts a new file when the
+// current one exceeds logging.max_size_mb or a new day begins, and deletes old
+// files beyond logging.max_age_days / logging.max_files.
+type rotatingFile struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	file     *os.File
+	size     int64
+	day      string // 書き込み中のファイルの日付
+}
+
+// openRotatingFile opens (or continues) the log file of cfg
+func openRotatingFile(cfg LoggingConfig) (*rotatingFile, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create logs directory: %v", err)
+	}
+	r := &rotatingFile{
+		dir:      cfg.Dir,
+		maxSize:  int64(cfg.MaxSizeMB) * 1024 * 1024,
+		maxAge:   time.Duration(cfg.MaxAgeDays) * 24 * time.Hour,
+		maxFiles: cfg.MaxFiles,
+	}
+
+	// 前回の起動から日付が変わっていたら新しいファイルにする
+	path := filepath.Join(r.dir, logFileName)
+	if info, err := os.Stat(path); err == nil && info.ModTime().Format("20060102") != time.Now().Format("20060102") {
+		if err := os.Rename(path, r.archiveName(info.ModTime())); err != nil {
+			return nil, fmt.Errorf("failed to rotate log file: %v", err)
+		}
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.prune()
+	return r, nil
+}
+
+// open opens logFileName for appending
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(filepath.Join(r.dir, logFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to create log file: %v", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	r.day = time.Now().Format("20060102")
+	return nil
+}
+
+// archiveName returns an unused consonance_<timestamp>.log path
+func (r *rotatingFile) archiveName(t time.Time) string {
+	base := filepath.Join(r.dir, "consonance_"+t.Format("20060102_150405"))
+	path := base + ".log"
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = fmt.Sprintf("%s_%d.log", base, i)
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, fmt.Errorf("log file is closed")
+	}
+	tooLarge := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	if tooLarge || r.day != time.Now().Format("20060102") {
+		if err := r.rotate(); err != nil {
+			// ローテーションに失敗しても今のファイルに書き続ける
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file to consonance_<timestamp>.log and starts a new one
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %v", err)
+	}
+	path := filepath.Join(r.dir, logFileName)
+	renameErr := os.Rename(path, r.archiveName(time.Now()))
+	if err := r.open(); err != nil {
+		r.file = nil
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("failed to rotate log file: %v", renameErr)
+	}
+	r.prune()
+	return nil
+}
+
+// prune deletes rotated files older than maxAge and beyond the newest maxFiles.
+// Files of older versions (one consonance_<timestamp>.log per launch) are included.
+func (r *rotatingFile) prune() {
+	matches, err := filepath.Glob(filepath.Join(r.dir, "consonance_*.log"))
+	if err != nil {
+		return
+	}
+
+	type logFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []logFile
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil {
+			files = append(files, logFile{path, info.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	for i, f := range files {
+		expired := r.maxAge > 0 && time.Since(f.modTime) > r.maxAge
+		tooMany := r.maxFiles > 0 && i >= r.maxFiles
+		if expired || tooMany {
+			if err := os.Remove(f.path); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to delete old log file: %v\n", err)
+			}
+		}
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// logLimiter logs a repeated warning at most once per interval and reports
+// how many repeats were skipped in between
+type logLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	entries  map[string]*limitEntry
+}
+
+type limitEntry struct {
+	last       time.Time
+	suppressed int
+}
+
+// warnLimiter rate-limits warnings that can repeat for every audio frame
+var warnLimiter = &logLimiter{interval: logRepeatInterval, entries: make(map[string]*limitEntry)}
+
+// Warn logs msg with args (slog key/value pairs) unless the same key was
+// logged within the interval
+func (l *logLimiter) Warn(key, msg string, args ...any) {
+	l.mu.Lock()
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &limitEntry{}
+		l.entries[key] = entry
+	}
+	now := time.Now()
+	if now.Sub(entry.last) < l.interval {
+		entry.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := entry.suppressed
+	entry.last = now
+	entry.suppressed = 0
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	slog.Warn(msg, args...)
+}
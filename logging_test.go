@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// captureLog sends the log output to a buffer in logfmt until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	old, oldOutput, oldFlags := slog.Default(), log.Writer(), log.Flags()
+	oldLevel, oldDiscordLogger := logLevel.Level(), discordgo.Logger
+	logLevel.Set(slog.LevelDebug)
+	installLogHandler(newFormatHandler(&buf, "text"))
+	t.Cleanup(func() {
+		// slog.SetDefault は log の出力先も変えるので、その後で戻す
+		slog.SetDefault(old)
+		log.SetOutput(oldOutput)
+		log.SetFlags(oldFlags)
+		logLevel.Set(oldLevel)
+		discordgo.Logger = oldDiscordLogger
+	})
+	return &buf
+}
+
+func TestLogLevelsComeFromTheCallSite(t *testing.T) {
+	buf := captureLog(t)
+
+	// log パッケージの行は文面にかかわらず Info
+	log.Printf("Failed attempts: %d", 3)
+	slog.Warn("Recorder dropped frames", "frames", 5)
+	discordLogger(discordgo.LogError, 1, "websocket closed: %v", "EOF")
+	discordLogger(discordgo.LogDebug, 1, "heartbeat")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{
+		`level=INFO msg="Failed attempts: 3"`,
+		`level=WARN msg="Recorder dropped frames" frames=5`,
+		`level=ERROR msg="websocket closed: EOF" source=discordgo`,
+		`level=DEBUG msg=heartbeat source=discordgo`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("log = %q, want %d lines", buf.String(), len(want))
+	}
+	for i := range want {
+		if !strings.Contains(lines[i], want[i]) {
+			t.Errorf("line %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
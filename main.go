@@ -18,13 +18,14 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"math"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,112 +34,143 @@ import (
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/gen2brain/malgo"
-	"gopkg.in/yaml.v3"
 	"layeh.com/gopus"
 )
 
 // Bot state management
 type BotState struct {
 	sync.RWMutex
-	voiceConnection *discordgo.VoiceConnection
+	voiceConnection voiceConn
 	guildID         string
 	channelID       string
+	connectedAt     time.Time
 	audioDeviceName string
-	isStreaming     bool
-	stopStreaming   chan bool
+	profile         string // 使用中のプロファイル（"" = audio / encoder セクションの設定）
+	textChannelID   string // "@Bot join" が使われたテキストチャンネル（警告の通知先）
+	state           connState
+	observers       map[chan stateChange]struct{}
+	connCtx         context.Context    // 接続ごと（退出でキャンセル）
+	cancelConn      context.CancelFunc
+	cancelStream    context.CancelFunc // 配信中のパイプラインを止める
+	streamDone      chan struct{}      // ストリーミングのgoroutineが終了したら閉じられる
+	wantStream      bool               // 配信を止める操作がなければ true（再接続後に配信を再開する）
+	recorder        *streamRecorder
+	receiver        *voiceReceiver
+	stereoOverride  *StereoConfig // "@Bot stereo" での変更（reset まで設定ファイルより優先）
+	dspOverride     *DSPConfig    // "@Bot dsp" での変更（同上）
+
+	// ctx is cancelled on shutdown; every pipeline runs under it
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newBotState creates the state of a bot that is not connected yet
+func newBotState(guildID, audioDeviceName string) *BotState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &BotState{
+		guildID:         guildID,
+		audioDeviceName: audioDeviceName,
+		observers:       make(map[chan stateChange]struct{}),
+		ctx:             ctx,
+		cancel:          cancel,
+	}
 }
 
 var (
 	botState *BotState
+	// config is replaced as a whole on reload (never modified in place),
+	// so a pointer taken under botState's lock stays consistent
 	config   *Config
 	session  *discordgo.Session
-)
-
-// Config structure
-type Config struct {
-	DiscordToken       string `yaml:"discord_token"`
-	ChannelID          string `yaml:"channel_id"`
-	GuildID            string `yaml:"guild_id"`
-	AudioDeviceName    string `yaml:"audio_device_name"`
-	AudioBufferPeriods int    `yaml:"audio_buffer_periods"` // 0 = use default
-}
-
-// setupLogFile creates a log file and configures logging to both file and console
-func setupLogFile() (*os.File, error) {
-	// logsディレクトリを作成
-	logsDir := "logs"
-	if err := os.MkdirAll(logsDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create logs directory: %w", err)
-	}
 
-	// タイムスタンプ付きのログファイル名を生成
-	timestamp := time.Now().Format("20060102_150405")
-	logFileName := filepath.Join(logsDir, fmt.Sprintf("consonance_%s.log", timestamp))
-
-	// ログファイルを作成
-	logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create log file: %w", err)
-	}
-
-	// コンソールとファイルの両方に出力するように設定
-	multiWriter := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(multiWriter)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	// configPath is the config file used by all commands (--config)
+	configPath = defaultConfigPath()
+)
 
-	return logFile, nil
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
 
-func main() {
+// runBot starts the bot and blocks until it is stopped with Ctrl+C or a signal
+func runBot() {
 	// バージョン情報を表示
-	fmt.Println("==========================================")
-	fmt.Printf("  %s\n", GetVersionString())
-	fmt.Println("==========================================")
-	fmt.Println()
+	if !headless {
+		fmt.Println("==========================================")
+		fmt.Printf("  %s\n", GetVersionString())
+		fmt.Println("==========================================")
+		fmt.Println()
+	}
 
-	// ログファイルのセットアップ
-	logFile, err := setupLogFile()
-	if err != nil {
-		log.Printf("Warning: Failed to setup log file: %v (continuing with console only)", err)
-	} else {
-		defer logFile.Close()
-		log.Println("Log file created successfully")
+	// 設定を読み込むまではコンソールにだけ出力する
+	installLogHandler(newConsoleHandler("text"))
+	if headless {
+		log.Printf("Starting %s in headless mode", GetVersionString())
 	}
 
 	// panicをキャッチしてログに記録
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("PANIC: %v", r)
-			log.Println("Application terminated abnormally")
+			slog.Error("Panic", "panic", r, "stack", string(debug.Stack()))
+			slog.Error("Application terminated abnormally")
 			waitForEnter()
+			os.Exit(1)
 		}
 	}()
 
 	// config.yamlの読み込み（存在しない場合は作成）
+	var err error
 	config, err = loadOrCreateConfig()
 	if err != nil {
 		exitWithError("Failed to load config: %v", err)
 	}
+	if err := applyEnvironment(config); err != nil {
+		exitWithError("Failed to load config: %v", err)
+	}
+
+	// ログファイルのセットアップ
+	logFile, err := setupLogging(config.Logging)
+	if err != nil {
+		slog.Warn("Failed to set up the log file, continuing with console only", "error", err)
+	} else {
+		defer logFile.Close()
+		log.Printf("Log file: %s", filepath.Join(config.Logging.Dir, logFileName))
+	}
+	log.Printf("Config file: %s", configPath)
+
+	// サーバーごとの設定の読み込み
+	guildSettings, err = loadGuildStore(guildSettingsPath())
+	if err != nil {
+		exitWithError("Failed to load guild settings: %v", err)
+	}
 
 	// トークンの検証と対話的入力
-	if config.DiscordToken == "" {
+	if config.Discord.Token == "" {
+		if headless {
+			exitWithError("Failed to get Discord token: discord.token is not set in %s and %s is empty", configPath, envDiscordToken)
+		}
 		token, err := promptForDiscordToken()
 		if err != nil {
 			exitWithError("Failed to get Discord token: %v", err)
 		}
-		config.DiscordToken = token
-		log.Println("✓ Discord token saved to config.yaml")
+		config.Discord.Token = token
+		log.Println("✓ Discord token saved")
 	}
 	// トークンの最初と最後の数文字だけ表示（セキュリティのため）
-	tokenPreview := config.DiscordToken
+	tokenPreview := config.Discord.Token
 	if len(tokenPreview) > 20 {
 		tokenPreview = tokenPreview[:10] + "..." + tokenPreview[len(tokenPreview)-10:]
 	}
 	log.Printf("Using Discord token: %s", tokenPreview)
 
 	// オーディオデバイスの選択
-	selectedDevice := config.AudioDeviceName
-	if selectedDevice == "" {
+	selectedDevice := config.Audio.DeviceName
+	if selectedDevice == "" && headless {
+		// ヘッドレスモードでは選択できないので、起動時のプロファイルがデバイスを持たなければ終了する
+		if profile, ok := config.Profiles[config.Audio.Profile]; !ok || len(profile.Devices) == 0 {
+			exitWithError("No audio device configured: set audio.device_name in %s or %s (or use an audio.profile with devices)", configPath, envAudioDevice)
+		}
+		log.Printf("Using the devices of profile %q", config.Audio.Profile)
+	} else if selectedDevice == "" {
 		// 設定ファイルに指定がない場合は、対話的に選択
 		device, err := selectAudioDevice()
 		if err != nil {
@@ -151,14 +183,10 @@ func main() {
 	}
 
 	// BotStateの初期化
-	botState = &BotState{
-		guildID:         config.GuildID,
-		audioDeviceName: selectedDevice,
-		stopStreaming:   make(chan bool),
-	}
+	botState = newBotState(config.Discord.GuildID, selectedDevice)
 
 	// Discordセッションの作成
-	session, err = discordgo.New("Bot " + config.DiscordToken)
+	session, err = discordgo.New("Bot " + config.Discord.Token)
 	if err != nil {
 		exitWithError("Failed to create Discord session: %v", err)
 	}
@@ -168,64 +196,94 @@ func main() {
 
 	// メッセージハンドラの登録
 	session.AddHandler(messageCreate)
+	gateway = discordGateway{session}
 
 	// Discordセッションのオープン
 	log.Println("Connecting to Discord...")
 	if err := session.Open(); err != nil {
-		log.Printf("Failed to open Discord session: %v", err)
-		log.Println("")
-		log.Println("=== Troubleshooting Authentication Error ===")
-		log.Println("If you see '4004: Authentication failed', check the following:")
-		log.Println("1. Verify your bot token is correct in config.yaml")
-		log.Println("2. Go to Discord Developer Portal (https://discord.com/developers/applications)")
-		log.Println("3. Select your application → Bot")
-		log.Println("4. Under 'Privileged Gateway Intents', enable:")
-		log.Println("   - MESSAGE CONTENT INTENT (required!)")
-		log.Println("   - SERVER MEMBERS INTENT")
-		log.Println("   - PRESENCE INTENT")
-		log.Println("5. Save changes and try again")
-		log.Println("6. If still failing, try resetting your bot token")
-		log.Println("")
+		slog.Error("Failed to open Discord session", "error", err)
+		// 対処方法も警告として出す（ログレベルが warn でも表示される）
+		slog.Warn("=== Troubleshooting Authentication Error ===")
+		slog.Warn("If you see '4004: Authentication failed', check the following:")
+		slog.Warn(fmt.Sprintf("1. Verify your bot token is correct in %s", configPath))
+		slog.Warn("2. Go to Discord Developer Portal (https://discord.com/developers/applications)")
+		slog.Warn("3. Select your application → Bot")
+		slog.Warn("4. Under 'Privileged Gateway Intents', enable:")
+		slog.Warn("   - MESSAGE CONTENT INTENT (required!)")
+		slog.Warn("   - SERVER MEMBERS INTENT")
+		slog.Warn("   - PRESENCE INTENT")
+		slog.Warn("5. Save changes and try again")
+		slog.Warn("6. If still failing, try resetting your bot token")
 		waitForEnter()
 		os.Exit(1)
 	}
-	defer session.Close()
 
 	// Bot招待リンクを生成して表示
 	if session.State.User != nil {
 		clientID := session.State.User.ID
-		// 必要な権限: Connect (1048576) + Speak (2097152) + View Channels (1024) + Send Messages (2048) + Read Message History (65536) = 3215376
-		inviteURL := fmt.Sprintf("https://discord.com/api/oauth2/authorize?client_id=%s&scope=bot&permissions=3215376", clientID)
-		fmt.Println("")
-		fmt.Println("==========================================")
-		fmt.Println("  Bot Invite Link:")
-		fmt.Printf("  %s\n", inviteURL)
-		fmt.Println("==========================================")
-		fmt.Println("")
+		link := inviteURL(clientID)
+		if headless {
+			log.Printf("Bot invite link: %s", link)
+		} else {
+			fmt.Println("")
+			fmt.Println("==========================================")
+			fmt.Println("  Bot Invite Link:")
+			fmt.Printf("  %s\n", link)
+			fmt.Println("==========================================")
+			fmt.Println("")
+		}
+	}
+
+	// ボイスチャンネル外の視聴者向けのHTTPストリーム
+	if err := applyStreamServerConfig(config.StreamServer); err != nil {
+		slog.Warn("Failed to start the HTTP stream server", "error", err)
+	}
+	// OBSやffmpeg向けのPCM出力
+	if err := applyOutputsConfig(config.Outputs); err != nil {
+		slog.Warn("Failed to start the PCM outputs", "error", err)
 	}
 
 	log.Println("Bot is now running. Mention me with commands!")
 	log.Println("Commands: @Bot join #channel-name, @Bot leave, @Bot status, @Bot help")
 
 	// config.yamlにチャンネルIDが指定されていたら自動接続
-	if config.ChannelID != "" {
-		log.Printf("Auto-connecting to channel %s...", config.ChannelID)
-		if err := joinVoiceChannel(config.GuildID, config.ChannelID); err != nil {
-			log.Printf("Failed to auto-connect: %v", err)
+	if config.Discord.ChannelID != "" {
+		log.Printf("Auto-connecting to channel %s...", config.Discord.ChannelID)
+		if err := joinVoiceChannel(config.Discord.GuildID, config.Discord.ChannelID); err != nil {
+			slog.Error("Failed to auto-connect", "channel", config.Discord.ChannelID, "error", err)
 		}
 	}
 
-	// プログラムの終了を待機（Ctrl+Cで終了）
+	// 設定ファイルの変更を監視して自動で再読み込み
+	go watchConfigFile(botState.ctx)
+	// 配信中のレベルメーター（levels.console_meter）
+	go runConsoleMeter(botState.ctx)
+
+	// プログラムの終了を待機（Ctrl+Cで終了、SIGHUPで設定を再読み込み）
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	<-sc
+	hup := make(chan os.Signal, 1)
+	notifyReloadSignal(hup)
+	for waiting := true; waiting; {
+		select {
+		case <-hup:
+			log.Println("Received SIGHUP, reloading config...")
+			if _, err := reloadConfig(); err != nil {
+				slog.Warn("Config not reloaded, keeping the current settings", "error", err)
+			}
+		case <-sc:
+			waiting = false
+		}
+	}
 
 	log.Println("Bot is shutting down...")
-	
-	// 接続中なら切断
-	if botState.voiceConnection != nil {
-		leaveVoiceChannel()
-	}
+	shutdown(shutdownTimeout)
+}
+
+// inviteURL returns the OAuth2 URL for inviting the bot with the required permissions
+func inviteURL(clientID string) string {
+	// 必要な権限: Connect (1048576) + Speak (2097152) + View Channels (1024) + Send Messages (2048) + Read Message History (65536) = 3215376
+	return fmt.Sprintf("https://discord.com/api/oauth2/authorize?client_id=%s&scope=bot&permissions=3215376", clientID)
 }
 
 // messageCreate handles incoming messages
@@ -244,24 +302,35 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		}
 	}
 
-	if !mentioned {
-		return
-	}
-
-	// Remove bot mention from message
+	// メンションがなくてもプレフィックス付きのメッセージはコマンドとして扱う
 	content := m.Content
-	for _, user := range m.Mentions {
-		if user.ID == s.State.User.ID {
-			content = strings.Replace(content, "<@"+user.ID+">", "", -1)
-			content = strings.Replace(content, "<@!"+user.ID+">", "", -1)
+	cfg := currentConfig()
+	prefix := cfg.Commands.Prefix
+	if mentioned {
+		// Remove bot mention from message
+		for _, user := range m.Mentions {
+			if user.ID == s.State.User.ID {
+				content = strings.Replace(content, "<@"+user.ID+">", "", -1)
+				content = strings.Replace(content, "<@!"+user.ID+">", "", -1)
+			}
 		}
+	} else if prefix != "" && strings.HasPrefix(content, prefix) {
+		content = strings.TrimPrefix(content, prefix)
+	} else {
+		return
 	}
 	content = strings.TrimSpace(content)
 
+	lang := replyLanguage(s, m.GuildID)
+	if !isCommandAllowed(s, cfg, m) {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "no_permission"))
+		return
+	}
+
 	// Parse command
 	parts := strings.Fields(content)
 	if len(parts) == 0 {
-		s.ChannelMessageSend(m.ChannelID, "コマンドを指定してください！ `@Bot help` でヘルプを表示できます。")
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "no_command"))
 		return
 	}
 
@@ -273,349 +342,882 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 	case "leave":
 		handleLeaveCommand(s, m)
 	case "status":
-		handleStatusCommand(s, m)
+		handleStatusCommand(s, m, parts[1:])
+	case "record":
+		handleRecordCommand(s, m, parts[1:])
+	case "reload":
+		handleReloadCommand(s, m)
+	case "config":
+		handleConfigCommand(s, m, parts[1:])
+	case "profile":
+		handleProfileCommand(s, m, parts[1:])
+	case "stereo":
+		handleStereoCommand(s, m, parts[1:])
+	case "dsp":
+		handleDSPCommand(s, m, parts[1:])
+	case "test":
+		handleTestCommand(s, m, parts[1:])
+	case "diag":
+		handleDiagCommand(s, m)
 	case "help":
 		handleHelpCommand(s, m)
 	default:
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("不明なコマンド: `%s`\n`@Bot help` でヘルプを表示できます。", command))
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "unknown_command", command))
 	}
 }
 
 // handleJoinCommand handles the join command
 func handleJoinCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	lang := replyLanguage(s, m.GuildID)
+	guildID := m.GuildID
+	var channelID, channelName string
+
 	if len(args) == 0 {
-		s.ChannelMessageSend(m.ChannelID, "チャンネル名またはメンションを指定してください！\n例: `@Bot join #雑談部屋`")
+		// 引数がなければサーバーごとの既定のチャンネルに接続
+		channelID = guildSettings.Get(guildID).DefaultChannelID
+		if channelID == "" {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "join_no_channel"))
+			return
+		}
+		if ch, err := s.Channel(channelID); err == nil {
+			channelName = ch.Name
+		} else {
+			channelName = channelID
+		}
+	} else {
+		var err error
+		channelID, channelName, err = resolveVoiceChannel(s, guildID, args)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, localizeError(lang, err))
+			return
+		}
+	}
+
+	// Join voice channel
+	if err := joinVoiceChannel(guildID, channelID); err != nil {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "join_failed", err))
 		return
 	}
+	botState.Lock()
+	botState.textChannelID = m.ChannelID
+	botState.Unlock()
 
-	guildID := m.GuildID
-	var channelID string
-	var channelName string
+	s.ChannelMessageSend(m.ChannelID, tr(lang, "join_ok", channelName))
+}
 
+// resolveVoiceChannel finds a voice channel from a channel mention, ID or name
+func resolveVoiceChannel(s *discordgo.Session, guildID string, args []string) (channelID, channelName string, err error) {
 	// Check if it's a channel mention
-	if strings.HasPrefix(args[0], "<#") && strings.HasSuffix(args[0], ">") {
+	if strings.HasPrefix(args[0], "<#") && strings.HasSuffix(args[0], ">") || isSnowflake(args[0]) {
 		// Extract channel ID from mention
 		channelID = strings.TrimPrefix(args[0], "<#")
 		channelID = strings.TrimSuffix(channelID, ">")
-	} else {
-		// Search by channel name
-		targetName := strings.Join(args, " ")
-		targetName = strings.TrimPrefix(targetName, "#")
 
-		// Get all channels in the guild
-		channels, err := s.GuildChannels(guildID)
+		ch, err := s.Channel(channelID)
 		if err != nil {
-			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("チャンネル一覧の取得に失敗しました: %v", err))
+			return "", "", newUserError("channel_info_failed", err)
+		}
+		return channelID, ch.Name, nil
+	}
+
+	// Search by channel name
+	targetName := strings.Join(args, " ")
+	targetName = strings.TrimPrefix(targetName, "#")
+
+	// Get all channels in the guild
+	channels, err := s.GuildChannels(guildID)
+	if err != nil {
+		return "", "", newUserError("channel_list_failed", err)
+	}
+
+	// Find matching voice channel
+	for _, ch := range channels {
+		if ch.Type == discordgo.ChannelTypeGuildVoice && strings.EqualFold(ch.Name, targetName) {
+			return ch.ID, ch.Name, nil
+		}
+	}
+	return "", "", newUserError("channel_not_found", targetName)
+}
+
+// handleLeaveCommand handles the leave command
+func handleLeaveCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+	lang := replyLanguage(s, m.GuildID)
+
+	if botState.State() == stateIdle {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "leave_not_connected"))
+		return
+	}
+
+	leaveVoiceChannel()
+	s.ChannelMessageSend(m.ChannelID, tr(lang, "leave_ok"))
+}
+
+// handleStatusCommand handles the status command
+func handleStatusCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	lang := replyLanguage(s, m.GuildID)
+
+	live := false
+	if len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "live":
+			live = true
+		case "stop":
+			if liveStatus.Stop() {
+				s.ChannelMessageSend(m.ChannelID, tr(lang, "status_live_stopped"))
+			} else {
+				s.ChannelMessageSend(m.ChannelID, tr(lang, "status_live_none"))
+			}
+			return
+		default:
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "status_usage"))
 			return
 		}
+	}
+
+	embed, _ := buildStatusEmbed(s, lang, live)
+	msg, err := s.ChannelMessageSendEmbed(m.ChannelID, embed)
+	if err != nil {
+		slog.Error("Failed to send status", "error", err)
+		return
+	}
+	if live {
+		liveStatus.Start(s, m.GuildID, m.ChannelID, msg.ID)
+	}
+}
 
-		// Find matching voice channel
-		for _, ch := range channels {
-			if ch.Type == discordgo.ChannelTypeGuildVoice && strings.EqualFold(ch.Name, targetName) {
-				channelID = ch.ID
-				channelName = ch.Name
-				break
+// isCommandAllowed reports whether the author may use commands (commands.allowed_role_ids)
+// (or the allowed roles set for the guild with "@Bot config set allowed_roles")
+func isCommandAllowed(s *discordgo.Session, cfg *Config, m *discordgo.MessageCreate) bool {
+	allowedRoles := cfg.Commands.AllowedRoleIDs
+	if m.GuildID != "" {
+		if roles := guildSettings.Get(m.GuildID).AllowedRoleIDs; len(roles) > 0 {
+			allowedRoles = roles
+		}
+	}
+
+	if len(allowedRoles) == 0 {
+		return true
+	}
+	if m.Member == nil {
+		return false
+	}
+	for _, role := range m.Member.Roles {
+		for _, allowed := range allowedRoles {
+			if role == allowed {
+				return true
 			}
 		}
+	}
+	// ロールの設定を間違えても管理者が締め出されないようにする
+	return canManageGuild(s, m)
+}
 
-		if channelID == "" {
-			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("ボイスチャンネル `%s` が見つかりませんでした。", targetName))
+// canManageGuild reports whether the author has the Manage Server or
+// Administrator permission in the channel of the message
+func canManageGuild(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	perms, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	return err == nil && perms&(discordgo.PermissionManageGuild|discordgo.PermissionAdministrator) != 0
+}
+
+// handleRecordCommand handles the record command
+func handleRecordCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	lang := replyLanguage(s, m.GuildID)
+
+	if len(args) == 0 {
+		botState.RLock()
+		rec := botState.recorder
+		botState.RUnlock()
+
+		if rec == nil {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "record_none"))
 			return
 		}
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "record_current",
+			rec.Elapsed().Truncate(time.Second), rec.CurrentFile()))
+		return
 	}
 
-	// Get channel info
-	if channelName == "" {
-		ch, err := s.Channel(channelID)
+	switch strings.ToLower(args[0]) {
+	case "start":
+		format := ""
+		if len(args) > 1 {
+			format = args[1]
+		}
+		rec, err := startRecording(format)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "record_start_failed", err))
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "record_started", rec.CurrentFile()))
+	case "stop":
+		files, err := stopRecording()
 		if err != nil {
-			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("チャンネル情報の取得に失敗しました: %v", err))
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "record_stop_failed", err))
 			return
 		}
-		channelName = ch.Name
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "record_stopped", strings.Join(files, "`, `")))
+	default:
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "record_usage"))
 	}
+}
 
-	// Join voice channel
-	if err := joinVoiceChannel(guildID, channelID); err != nil {
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("ボイスチャンネルへの接続に失敗しました: %v", err))
+// handleConfigCommand handles the config command (per-guild settings)
+func handleConfigCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	lang := replyLanguage(s, m.GuildID)
+
+	if m.GuildID == "" {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "guild_only"))
 		return
 	}
 
-	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ ボイスチャンネル `%s` に接続しました！", channelName))
+	action := "get"
+	if len(args) > 0 {
+		action = strings.ToLower(args[0])
+		args = args[1:]
+	}
+
+	switch action {
+	case "get":
+		settings := guildSettings.Get(m.GuildID)
+		keys := guildSettingKeys
+		if len(args) > 0 {
+			keys = []string{strings.ToLower(args[0])}
+		}
+
+		var b strings.Builder
+		b.WriteString(tr(lang, "config_title") + "\n")
+		for _, key := range keys {
+			value := formatGuildSetting(lang, settings, key)
+			if value == "" {
+				s.ChannelMessageSend(m.ChannelID, tr(lang, "config_unknown_key", key, strings.Join(guildSettingKeys, "`, `")))
+				return
+			}
+			b.WriteString(fmt.Sprintf("`%s`: %s\n", key, value))
+		}
+		s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content:         b.String(),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+
+	case "set", "unset":
+		// 設定の変更はサーバー管理権限を持つメンバーに限る
+		if !canManageGuild(s, m) {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "config_need_manage"))
+			return
+		}
+		if len(args) == 0 || action == "set" && len(args) < 2 {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "config_set_usage", strings.Join(guildSettingKeys, "`, `")))
+			return
+		}
+
+		key := strings.ToLower(args[0])
+		var valueErr error
+		err := guildSettings.Update(m.GuildID, func(settings *GuildSettings) error {
+			if action == "set" {
+				valueErr = setGuildSetting(s, m.GuildID, settings, key, args[1:])
+			} else {
+				valueErr = unsetGuildSetting(settings, key)
+			}
+			return valueErr
+		})
+		if err != nil {
+			if err != valueErr {
+				slog.Error("Failed to save guild settings", "guild", m.GuildID, "error", err)
+			}
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "config_failed", localizeError(lang, err)))
+			return
+		}
+
+		settings := guildSettings.Get(m.GuildID)
+		if key == "volume" {
+			applyGuildVolume(m.GuildID)
+		}
+		log.Printf("Guild %s: %s %s", m.GuildID, action, key)
+		s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content:         tr(lang, "config_updated", key, formatGuildSetting(lang, settings, key)),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+
+	default:
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "config_usage"))
+	}
 }
 
-// handleLeaveCommand handles the leave command
-func handleLeaveCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	botState.RLock()
-	connected := botState.voiceConnection != nil
-	botState.RUnlock()
+// handleProfileCommand handles the profile command
+func handleProfileCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	lang := replyLanguage(s, m.GuildID)
+
+	botState.Lock()
+	cfg := config
+
+	if len(args) == 0 {
+		active := botState.profile
+		deviceName := botState.audioDeviceName
+		botState.Unlock()
+		if active == "" {
+			active = defaultProfileName
+		}
 
-	if !connected {
-		s.ChannelMessageSend(m.ChannelID, "現在、どのボイスチャンネルにも接続していません。")
+		var b strings.Builder
+		b.WriteString(tr(lang, "profile_title") + "\n")
+		for _, name := range append([]string{defaultProfileName}, cfg.profileNames()...) {
+			mark := "　"
+			if name == active {
+				mark = "▶"
+			}
+			settings := resolveAudioSettings(cfg, name, deviceName)
+			devices := make([]string, len(settings.devices))
+			for i, device := range settings.devices {
+				devices[i] = describeDevice(device)
+			}
+			b.WriteString(fmt.Sprintf("%s `%s` - %s\n", mark, name, strings.Join(devices, " + ")))
+		}
+		b.WriteString(tr(lang, "profile_hint"))
+		s.ChannelMessageSend(m.ChannelID, b.String())
 		return
 	}
 
-	leaveVoiceChannel()
-	s.ChannelMessageSend(m.ChannelID, "✅ ボイスチャンネルから退出しました。")
+	name := args[0]
+	if _, ok := cfg.Profiles[name]; !ok && name != defaultProfileName {
+		botState.Unlock()
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "profile_not_found", name))
+		return
+	}
+	if name == defaultProfileName {
+		name = ""
+	}
+
+	botState.profile = name
+	restarted := botState.state == stateStreaming
+	// 双方向モードの再生先が新しいプロファイルのループバック元になるとエコーするので確かめ直す
+	restartPlayback := func() error { return nil }
+	if botState.receiver != nil && botState.receiver.playback != nil {
+		restartPlayback = restartReceiverLocked()
+	}
+	botState.Unlock()
+	if err := restartPlayback(); err != nil {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "profile_echo", err))
+	}
+	if restarted {
+		restartStreaming()
+	}
+
+	if name == "" {
+		name = defaultProfileName
+	}
+	log.Printf("Switched audio profile to %s", name)
+	if restarted {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "profile_switched", name))
+	} else {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "profile_selected", name))
+	}
 }
 
-// handleStatusCommand handles the status command
-func handleStatusCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+// applyGuildVolume applies the guild's volume if the bot is streaming to that guild
+func applyGuildVolume(guildID string) {
 	botState.RLock()
 	defer botState.RUnlock()
+	if botState.guildID == guildID {
+		streamVolume.Store(int32(guildSettings.Get(guildID).volume()))
+	}
+}
+
+// handleReloadCommand handles the reload command
+func handleReloadCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+	lang := replyLanguage(s, m.GuildID)
 
-	if botState.voiceConnection == nil {
-		s.ChannelMessageSend(m.ChannelID, "📊 **Status**: ボイスチャンネルに接続していません")
+	changes, err := reloadConfig()
+	if err != nil {
+		slog.Warn("Config not reloaded, keeping the current settings", "error", err)
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "reload_failed", err))
+		return
+	}
+	if len(changes) == 0 {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "reload_unchanged"))
 		return
 	}
 
-	ch, err := s.Channel(botState.channelID)
-	channelName := botState.channelID
-	if err == nil {
-		channelName = ch.Name
+	var b strings.Builder
+	for _, c := range changes {
+		b.WriteString(c.String())
+		b.WriteString("\n")
 	}
+	s.ChannelMessageSend(m.ChannelID, tr(lang, "reload_done", b.String()))
+}
 
-	status := fmt.Sprintf("📊 **Status**\n"+
-		"接続中: `%s`\n"+
-		"ストリーミング: %v\n"+
-		"オーディオデバイス: `%s`",
-		channelName,
-		botState.isStreaming,
-		botState.audioDeviceName)
+// handleStereoCommand shows or changes the stereo settings. Changes apply to
+// the running stream at once and are kept across restarts until "reset".
+func handleStereoCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	lang := replyLanguage(s, m.GuildID)
 
-	s.ChannelMessageSend(m.ChannelID, status)
-}
+	botState.RLock()
+	cfg := botState.audioSettingsLocked().stereo
+	botState.RUnlock()
+	if len(args) == 0 {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "stereo_current", cfg))
+		return
+	}
 
-// handleHelpCommand handles the help command
-func handleHelpCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	helpText := fmt.Sprintf("**%s - Commands**\n\n", GetVersionString()) +
-		"`@Bot join #チャンネル名` - 指定したボイスチャンネルに接続します\n" +
-		"`@Bot join チャンネル名` - チャンネル名で検索して接続します\n" +
-		"`@Bot leave` - 現在のボイスチャンネルから退出します\n" +
-		"`@Bot status` - 現在の接続状態を表示します\n" +
-		"`@Bot help` - このヘルプを表示します"
+	switch arg := strings.ToLower(args[0]); arg {
+	case "stereo", "swap", "mono", "left", "right":
+		cfg.Mode = arg
+	case "balance", "width":
+		if len(args) < 2 {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "stereo_usage"))
+			return
+		}
+		v, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+		switch {
+		case arg == "balance" && (err != nil || v < -100 || v > 100):
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "stereo_invalid_balance"))
+			return
+		case arg == "width" && (err != nil || v < 1 || v > 200):
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "stereo_invalid_width"))
+			return
+		case arg == "balance":
+			cfg.Balance = v
+		default:
+			cfg.Width = v
+		}
+	case "reset":
+		cfg = setStereoOverride(nil)
+		log.Printf("Stereo settings reset: %s", cfg)
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "stereo_reset", cfg))
+		return
+	default:
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "stereo_usage"))
+		return
+	}
 
-	s.ChannelMessageSend(m.ChannelID, helpText)
+	setStereoOverride(&cfg)
+	log.Printf("Stereo settings changed: %s", cfg)
+	s.ChannelMessageSend(m.ChannelID, tr(lang, "stereo_changed", cfg))
 }
 
-// joinVoiceChannel joins a voice channel and starts streaming
-func joinVoiceChannel(guildID, channelID string) error {
-	botState.Lock()
-	defer botState.Unlock()
+// handleDSPCommand shows or edits the filter chain. Changes apply to the
+// running stream at once and are kept across restarts until "reset".
+func handleDSPCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	lang := replyLanguage(s, m.GuildID)
 
-	// If already connected, disconnect first
-	if botState.voiceConnection != nil {
-		log.Println("Already connected, disconnecting first...")
-		botState.voiceConnection.Disconnect()
-		if botState.isStreaming {
-			botState.stopStreaming <- true
-			botState.isStreaming = false
+	botState.RLock()
+	current := botState.audioSettingsLocked().dsp
+	streaming := botState.streamRunningLocked()
+	botState.RUnlock()
+	if len(args) == 0 {
+		text := tr(lang, "dsp_current", current)
+		if reduction := audioDSP.GainReduction(); streaming && reduction > 0.1 {
+			text += "\n" + tr(lang, "dsp_reduction", reduction)
 		}
+		s.ChannelMessageSend(m.ChannelID, text)
+		return
 	}
 
-	// Join voice channel
-	vc, err := session.ChannelVoiceJoin(guildID, channelID, false, true)
+	if strings.ToLower(args[0]) == "reset" {
+		cfg := setDSPOverride(nil)
+		log.Printf("DSP chain reset: %s", cfg)
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "dsp_reset", cfg))
+		return
+	}
+	cfg, err := editDSP(current, args)
 	if err != nil {
-		return fmt.Errorf("failed to join voice channel: %v", err)
+		s.ChannelMessageSend(m.ChannelID, localizeError(lang, err))
+		return
 	}
 
-	botState.voiceConnection = vc
-	botState.channelID = channelID
-	botState.guildID = guildID
+	setDSPOverride(&cfg)
+	log.Printf("DSP chain changed: %s", cfg)
+	s.ChannelMessageSend(m.ChannelID, tr(lang, "dsp_changed", cfg))
+}
 
-	// Wait for connection to be ready
-	log.Println("Waiting for voice connection to be ready...")
-	timeout := time.After(10 * time.Second)
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+// handleTestCommand plays a test signal into the stream in place of the captured audio
+func handleTestCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	lang := replyLanguage(s, m.GuildID)
 
-	ready := false
-	for !ready {
-		select {
-		case <-timeout:
-			log.Println("Warning: Timeout waiting for voice connection to be ready, proceeding anyway...")
-			ready = true
-		case <-ticker.C:
-			if vc.Ready {
-				ready = true
-				log.Println("Voice connection is ready!")
-			}
+	if len(args) == 0 {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "test_usage"))
+		return
+	}
+	kind := strings.ToLower(args[0])
+	if kind == "stop" {
+		if testSignals.Stop() {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "test_stopped"))
+		} else {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "test_none"))
 		}
+		return
 	}
 
-	// Start streaming
-	botState.isStreaming = true
-	go func() {
-		if err := streamSystemAudio(vc, botState.audioDeviceName); err != nil {
-			log.Printf("Failed to stream system audio: %v", err)
-			botState.Lock()
-			botState.isStreaming = false
-			botState.Unlock()
+	// 引数は数値のみ（tone は周波数・秒、sweep と click は秒）
+	values := make([]float64, 0, 2)
+	for _, arg := range args[1:] {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "test_usage"))
+			return
 		}
-	}()
+		values = append(values, v)
+	}
+	arg := func(i int, def float64) float64 {
+		if i < len(values) {
+			return values[i]
+		}
+		return def
+	}
+	validSeconds := func(seconds float64) bool { return seconds >= 0.1 && seconds <= 30 }
 
-	log.Printf("Successfully connected to voice channel: %s", channelID)
-	return nil
+	var signal *testSignal
+	var reply string
+	switch {
+	case kind == "tone" && len(values) <= 2:
+		freq, seconds := arg(0, 440), arg(1, 3)
+		if freq < 20 || freq > 20000 || !validSeconds(seconds) {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "test_invalid"))
+			return
+		}
+		signal, reply = newToneSignal(freq, seconds), tr(lang, "test_tone", freq, seconds)
+	case kind == "lr" && len(values) == 0:
+		signal, reply = newChannelSignal(), tr(lang, "test_lr")
+	case kind == "sweep" && len(values) <= 1:
+		seconds := arg(0, 10)
+		if !validSeconds(seconds) {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "test_invalid"))
+			return
+		}
+		signal, reply = newSweepSignal(seconds), tr(lang, "test_sweep", seconds)
+	case kind == "click" && len(values) <= 1:
+		seconds := arg(0, 10)
+		if !validSeconds(seconds) {
+			s.ChannelMessageSend(m.ChannelID, tr(lang, "test_invalid"))
+			return
+		}
+		signal, reply = newClickSignal(seconds), tr(lang, "test_click", seconds)
+	default:
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "test_usage"))
+		return
+	}
+
+	if botState.State() != stateStreaming {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "test_not_streaming"))
+		return
+	}
+	testSignals.Start(signal)
+	s.ChannelMessageSend(m.ChannelID, reply)
 }
 
-// leaveVoiceChannel disconnects from the current voice channel
-func leaveVoiceChannel() {
-	botState.Lock()
-	defer botState.Unlock()
+// handleDiagCommand measures the stream for diagDuration and posts the report
+func handleDiagCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+	lang := replyLanguage(s, m.GuildID)
 
-	if botState.voiceConnection == nil {
+	// 配信状態ではなく、実際にキャプチャが動いているかで判断する
+	if !stats.snapshot().running {
+		s.ChannelMessageSend(m.ChannelID, tr(lang, "diag_not_streaming"))
+		return
+	}
+	msg, err := s.ChannelMessageSend(m.ChannelID, tr(lang, "diag_started", int(diagDuration.Seconds())))
+	if err != nil {
+		slog.Error("Failed to send diagnostics message", "error", err)
 		return
 	}
 
-	log.Println("Disconnecting from voice channel...")
+	// 計測中もほかのコマンドを受け付けられるよう別ゴルーチンで待つ
+	go func() {
+		report, err := runDiagnostics(botState.ctx, diagDuration)
+		if err != nil {
+			if botState.ctx.Err() != nil {
+				return
+			}
+			s.ChannelMessageEdit(m.ChannelID, msg.ID, tr(lang, "diag_failed", localizeError(lang, err)))
+			return
+		}
+		empty := ""
+		if _, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:      msg.ID,
+			Channel: m.ChannelID,
+			Content: &empty,
+			Embeds:  &[]*discordgo.MessageEmbed{report.embed(lang)},
+		}); err != nil {
+			slog.Error("Failed to send diagnostics report", "error", err)
+		}
+	}()
+}
 
-	// Stop streaming
-	if botState.isStreaming {
-		botState.stopStreaming <- true
-		botState.isStreaming = false
-	}
+// handleHelpCommand handles the help command
+func handleHelpCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+	lang := replyLanguage(s, m.GuildID)
 
-	// Disconnect
-	botState.voiceConnection.Disconnect()
-	botState.voiceConnection = nil
-	botState.channelID = ""
+	lines := []string{tr(lang, "help_title", GetVersionString()), ""}
+	for _, key := range helpKeys {
+		if key == "help_cfg_set" {
+			lines = append(lines, tr(lang, key, strings.Join(guildSettingKeys, ", ")))
+			continue
+		}
+		lines = append(lines, tr(lang, key))
+	}
+	helpText := strings.Join(lines, "\n")
 
-	log.Println("Disconnected from voice channel")
+	s.ChannelMessageSend(m.ChannelID, helpText)
 }
 
-// playBeep generates and plays a simple beep sound
-func playBeep(v *discordgo.VoiceConnection) error {
-	// VoiceConnectionがReadyであることを再確認
-	if !v.Ready {
-		return fmt.Errorf("voice connection is not ready")
-	}
+// joinVoiceChannel joins a voice channel and starts streaming.
+// Waiting for Discord is done without holding botState's lock.
+func joinVoiceChannel(guildID, channelID string) error {
+	// 接続中なら先に切断する（録音は続ける）
+	disconnectVoice("move to " + channelID)
 
-	// Opusエンコーダーの作成
-	// 48kHz, 2チャンネル（ステレオ）
-	const (
-		sampleRate = 48000
-		channels   = 2
-		frameSize  = 960 // 20msのフレーム
-		frequency  = 440 // A4の音（ラの音）
-		duration   = 1.0 // 1秒間
-	)
+	botState.Lock()
+	if !botState.transitionLocked(stateJoining, "join "+channelID) {
+		state := botState.state
+		botState.Unlock()
+		return fmt.Errorf("voice connection is busy (%s)", state)
+	}
+	connCtx, cancelConn := context.WithCancel(botState.ctx)
+	botState.connCtx = connCtx
+	botState.cancelConn = cancelConn
+	botState.guildID = guildID
+	botState.channelID = channelID
+	cfg := config
+	botState.Unlock()
 
-	encoder, err := gopus.NewEncoder(sampleRate, channels, gopus.Audio)
+	// Join voice channel
+	// 受信モード・双方向モードでない場合はスピーカーミュート（deaf）で参加する
+	deaf := !cfg.Audio.ReceiveVoice && !cfg.Audio.ReturnAudio
+	vc, err := gateway.JoinVoice(guildID, channelID, false, deaf)
 	if err != nil {
-		return fmt.Errorf("failed to create opus encoder: %v", err)
+		botState.Lock()
+		botState.clearConnectionLocked()
+		botState.transitionLocked(stateIdle, "join failed")
+		botState.Unlock()
+		return fmt.Errorf("failed to join voice channel: %v", err)
 	}
 
-	// ビープ音の生成とエンコード
-	totalSamples := int(sampleRate * duration)
-	pcm := make([]int16, frameSize*channels)
+	waitVoiceReady(connCtx, vc)
 
-	// Speaking状態を設定
-	if err := v.Speaking(true); err != nil {
-		return fmt.Errorf("failed to set speaking state: %v", err)
+	botState.Lock()
+	if connCtx.Err() != nil {
+		// 参加中に退出・終了が要求された
+		botState.Unlock()
+		vc.Disconnect()
+		botState.Lock()
+		botState.clearConnectionLocked()
+		botState.transitionLocked(stateIdle, "join cancelled")
+		botState.Unlock()
+		return fmt.Errorf("join cancelled")
 	}
-	defer v.Speaking(false)
-
-	// 少し待機してOpusSendチャンネルが準備完了するのを待つ
-	time.Sleep(100 * time.Millisecond)
 
-	// フレームごとの送信タイミングを管理
-	frameDuration := time.Duration(frameSize) * time.Second / time.Duration(sampleRate)
+	botState.voiceConnection = vc
+	botState.connectedAt = time.Now()
+
+	// サーバーごとの設定を読み込んで適用
+	streamVolume.Store(int32(guildSettings.Get(guildID).volume()))
+	botState.profile = joinProfile(cfg, guildID)
+
+	botState.transitionLocked(stateReady, "voice ready")
+	startStreamingLocked(vc)
+	captureDevices := resolveAudioSettings(cfg, botState.profile, botState.audioDeviceName).devices
+	botState.Unlock()
+
+	go monitorVoice(connCtx, vc)
+
+	// 受信モードなら受信音声のデコードを開始（再生デバイスの初期化はロックの外で行う）
+	if cfg.Audio.ReceiveVoice || cfg.Audio.ReturnAudio {
+		var playback *returnPlayback
+		if cfg.Audio.ReturnAudio {
+			playback, err = startReturnPlayback(cfg.Audio.ReturnDeviceName, captureDevices)
+			if err != nil {
+				slog.Error("Failed to start two-way mode", "error", err)
+			}
+		}
+		receiver := startVoiceReceiver(vc, playback)
 
-	for sample := 0; sample < totalSamples; sample += frameSize {
-		start := time.Now()
+		botState.Lock()
+		attached := botState.voiceConnection == vc
+		if attached {
+			botState.receiver = receiver
+		}
+		botState.Unlock()
+		if !attached {
+			receiver.Stop()
+		}
+	}
 
-		// PCMデータの生成（サイン波）
-		for i := 0; i < frameSize; i++ {
-			if sample+i >= totalSamples {
-				break
+	// 自動録音が有効なら録音を開始
+	if cfg.Recording.AutoStart {
+		go func() {
+			botState.RLock()
+			recording := botState.recorder != nil
+			botState.RUnlock()
+			if recording {
+				return
+			}
+			if _, err := startRecording(""); err != nil {
+				slog.Error("Failed to start auto-recording", "error", err)
 			}
-			// サイン波を生成（440Hz）
-			value := math.Sin(2.0 * math.Pi * frequency * float64(sample+i) / float64(sampleRate))
-			// 振幅を調整（音量を小さめに）
-			pcmValue := int16(value * 0.3 * 32767)
+		}()
+	}
 
-			// ステレオなので両チャンネルに同じ値を設定
-			pcm[i*channels] = pcmValue
-			pcm[i*channels+1] = pcmValue
-		}
+	log.Printf("Successfully connected to voice channel: %s", channelID)
+	return nil
+}
 
-		// OpusにエンコードしてVoiceConnectionに送信
-		// gopusは[]int16を直接受け取る
-		opusData, err := encoder.Encode(pcm, frameSize, 1000)
-		if err != nil {
-			return fmt.Errorf("failed to encode: %v", err)
-		}
+// voiceReadyTimeout is how long a join waits for the voice connection to be ready
+var voiceReadyTimeout = 10 * time.Second
 
-		v.OpusSend <- opusData
+// waitVoiceReady waits until the voice connection is ready, for at most
+// voiceReadyTimeout, or until ctx is cancelled
+func waitVoiceReady(ctx context.Context, vc voiceConn) {
+	log.Println("Waiting for voice connection to be ready...")
+	timeout := time.NewTimer(voiceReadyTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
 
-		// 次のフレームまで適切な時間待機（20ms）
-		elapsed := time.Since(start)
-		if elapsed < frameDuration {
-			time.Sleep(frameDuration - elapsed)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeout.C:
+			slog.Warn("Timed out waiting for the voice connection to be ready, proceeding anyway")
+			return
+		case <-ticker.C:
+			if vc.Ready() {
+				log.Println("Voice connection is ready!")
+				return
+			}
 		}
 	}
+}
 
-	return nil
+// leaveVoiceChannel stops recording and disconnects from the current voice channel
+func leaveVoiceChannel() {
+	// 録音中なら先に停止してファイルを確定させる
+	if _, err := stopRecording(); err == nil {
+		log.Println("Recording finalized")
+	}
+	disconnectVoice("leave")
+}
+
+// disconnectVoice stops the pipeline and leaves the voice channel.
+// The pipeline and the connection are shut down without holding botState's lock.
+func disconnectVoice(event string) {
+	botState.Lock()
+	switch botState.state {
+	case stateIdle, stateLeaving:
+		botState.Unlock()
+		return
+	case stateJoining:
+		// 参加処理がキャンセルに気づいて切断し、Idle に戻す
+		botState.transitionLocked(stateLeaving, event)
+		botState.cancelConn()
+		botState.Unlock()
+		return
+	}
+
+	log.Println("Disconnecting from voice channel...")
+	botState.transitionLocked(stateLeaving, event)
+	wait := stopStreamingLocked(event)
+	vc := botState.voiceConnection
+	receiver := botState.receiver
+	botState.cancelConn()
+	botState.clearConnectionLocked()
+	botState.Unlock()
+
+	wait()
+	if receiver != nil {
+		receiver.Stop()
+	}
+	vc.Disconnect()
+
+	botState.Lock()
+	botState.transitionLocked(stateIdle, "disconnected")
+	botState.Unlock()
+	log.Println("Disconnected from voice channel")
+}
+
+// clearConnectionLocked forgets the current connection. botState must be locked.
+func (b *BotState) clearConnectionLocked() {
+	b.voiceConnection = nil
+	b.receiver = nil
+	b.channelID = ""
+	b.connCtx = nil
+	b.cancelConn = nil
 }
 
-// streamSystemAudio captures system audio (loopback) and streams it to Discord
-func streamSystemAudio(v *discordgo.VoiceConnection, deviceName string) error {
+// startStreamingLocked starts the capture pipeline on vc with the current
+// config. botState must be locked.
+func startStreamingLocked(vc voiceConn) {
+	settings := botState.audioSettingsLocked()
+	parent := botState.connCtx
+	if parent == nil {
+		parent = botState.ctx
+	}
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+
+	botState.cancelStream = cancel
+	botState.streamDone = done
+	botState.wantStream = true
+	// コマンドでの変更と競合しないよう、ロック中に設定する
+	stereoTools.Set(settings.stereo)
+	audioDSP.Set(settings.dsp)
+	botState.transitionLocked(stateStreaming, "stream started")
+	go func() {
+		err := streamSystemAudio(ctx, vc, settings)
+		close(done)
+		if err != nil {
+			slog.Error("Failed to stream system audio", "error", err)
+			botState.Lock()
+			if botState.streamDone == done {
+				botState.cancelStream = nil
+				botState.streamDone = nil
+				if botState.state == stateStreaming {
+					botState.transitionLocked(stateReady, "stream failed")
+				}
+			}
+			botState.Unlock()
+			cancel()
+		}
+	}()
+}
+
+// stopStreamingLocked cancels the capture pipeline. botState must be locked;
+// call the returned function after unlocking to wait until the device is released.
+func stopStreamingLocked(event string) (wait func()) {
+	cancel, done := botState.cancelStream, botState.streamDone
+	botState.cancelStream = nil
+	botState.streamDone = nil
+	botState.wantStream = false
+	if botState.state == stateStreaming {
+		botState.transitionLocked(stateReady, event)
+	}
+	if cancel == nil {
+		return func() {}
+	}
+	// 既にエラーで終了していても cancel と done の待機はブロックしない
+	cancel()
+	return func() { <-done }
+}
+
+// streamSystemAudio captures system audio (loopback) and streams it to Discord.
+// With several devices in the profile their audio is mixed into one stream.
+func streamSystemAudio(ctx context.Context, v voiceConn, settings audioSettings) error {
 	// VoiceConnectionがReadyであることを確認
-	if !v.Ready {
+	if !v.Ready() {
 		return fmt.Errorf("voice connection is not ready")
 	}
 
 	const (
-		sampleRate = 48000
-		channels   = 2
-		frameSize  = 960 // 20ms at 48kHz
+		channels  = 2
+		frameSize = 960 // 20ms at 48kHz
 	)
 
 	// Opusエンコーダーの作成
-	encoder, err := gopus.NewEncoder(sampleRate, channels, gopus.Audio)
+	encoder, err := newOpusEncoder(settings.encoder)
 	if err != nil {
-		return fmt.Errorf("failed to create opus encoder: %v", err)
+		return err
 	}
 
-	// malgoコンテキストの初期化
-	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
-	if err != nil {
-		return fmt.Errorf("failed to initialize malgo context: %v", err)
-	}
-	defer func() {
-		_ = ctx.Uninit()
-		ctx.Free()
-	}()
-
-	// デバイスコンフィグの設定
-	deviceConfig := malgo.DefaultDeviceConfig(malgo.Loopback)
-	deviceConfig.Capture.Format = malgo.FormatS16
-	deviceConfig.Capture.Channels = uint32(channels)
-	deviceConfig.SampleRate = uint32(sampleRate)
-	deviceConfig.Alsa.NoMMap = 1
-	
-	// 低遅延設定：バッファサイズを小さくする
-	// frameSize (960 samples = 20ms) と同じサイズに設定
-	deviceConfig.PeriodSizeInFrames = uint32(frameSize)
-	
-	// バッファの数を設定（デフォルト値: 4）
-	bufferPeriods := config.AudioBufferPeriods
-	if bufferPeriods == 0 {
-		bufferPeriods = 4 // デフォルト値
-	}
-	deviceConfig.Periods = uint32(bufferPeriods)
-	log.Printf("Audio buffer periods: %d (latency: ~%dms)", bufferPeriods, bufferPeriods*20)
-
-	// デバイス名が指定されている場合、そのデバイスを探す
-	if deviceName != "" {
-		deviceInfo, err := findDeviceByName(ctx, deviceName)
-		if err != nil {
-			return fmt.Errorf("failed to find device '%s': %v", deviceName, err)
-		}
-		deviceConfig.Capture.DeviceID = deviceInfo.ID.Pointer()
-		log.Printf("Using audio device: %s", deviceName)
-	} else {
-		log.Println("Using default loopback device")
-	}
+	log.Printf("Audio profile: %s", settings.profile)
+	log.Printf("Audio buffer periods: %d (latency: ~%dms)", settings.bufferPeriods, settings.bufferPeriods*20)
 
 	// オーディオバッファ（PCMデータを蓄積）
 	pcmBuffer := make([]int16, 0, frameSize*channels*2)
@@ -626,68 +1228,153 @@ func streamSystemAudio(v *discordgo.VoiceConnection, deviceName string) error {
 	}
 	defer v.Speaking(false)
 
-	log.Println("Starting system audio capture (loopback mode)...")
-
-	// データコールバック：音声データが取得されるたびに呼ばれる
-	var captureCallbacks = malgo.DeviceCallbacks{
-		Data: func(pOutputSample, pInputSamples []byte, framecount uint32) {
-			// バイト列をint16スライスに変換
-			samples := make([]int16, len(pInputSamples)/2)
-			for i := 0; i < len(samples); i++ {
-				samples[i] = int16(pInputSamples[i*2]) | int16(pInputSamples[i*2+1])<<8
+	log.Println("Starting system audio capture...")
+	stats.start(settings)
+	defer stats.stop()
+	levels.start(currentConfig().Levels)
+	defer testSignals.Stop()
+
+	// キャプチャした音声（複数デバイスならミックス後）が届くたびに呼ばれる
+	onPCM := func(pcm []int16) {
+		pcmBuffer = append(pcmBuffer, pcm...)
+
+		// バッファが1フレーム分以上溜まったら送信
+		for len(pcmBuffer) >= frameSize*channels {
+			// 1フレーム分を取り出す
+			frame := pcmBuffer[:frameSize*channels]
+			pcmBuffer = pcmBuffer[frameSize*channels:]
+
+			// 診断中はフレームの間隔を計測する（レベルは levels が測る）
+			diagnostics.observe()
+			// プロファイルのステレオ設定（左右入れ替え・モノラル化・バランス・広がり）
+			stereoTools.Process(frame)
+			// プロファイルのフィルタチェーン（ハイパス・ハム除去・EQ・ローパス・コンプレッサー）
+			audioDSP.Process(frame)
+			// テスト信号の再生中は差し替える
+			testSignals.Apply(frame)
+
+			// サーバーごとの音量を適用
+			if volume := streamVolume.Load(); volume != 100 {
+				applyGain(frame, int(volume))
 			}
 
-			// バッファに追加
-			pcmBuffer = append(pcmBuffer, samples...)
+			// 送信する音声のレベルを計測（メーター・ステータス・診断・クリップと無音の警告）
+			levels.observe(frame)
 
-			// バッファが1フレーム分以上溜まったら送信
-			for len(pcmBuffer) >= frameSize*channels {
-				// 1フレーム分を取り出す
-				frame := pcmBuffer[:frameSize*channels]
-				pcmBuffer = pcmBuffer[frameSize*channels:]
-
-				// Opusエンコード
-				opusData, err := encoder.Encode(frame, frameSize, 1000)
-				if err != nil {
-					log.Printf("Failed to encode audio: %v", err)
-					continue
-				}
+			// Opusエンコード
+			opusData, err := encoder.Encode(frame, frameSize, 1000)
+			if err != nil {
+				warnLimiter.Warn("encode", "Failed to encode audio", "error", err)
+				continue
+			}
 
-				// Discordに送信（ノンブロッキング）
-				select {
-				case v.OpusSend <- opusData:
-				default:
-					// チャンネルがいっぱいの場合はスキップ
-					log.Println("Warning: OpusSend channel full, skipping frame")
-				}
+			// Discordに送信（ノンブロッキング）
+			sent := false
+			opusSend := v.OpusSend()
+			select {
+			case opusSend <- opusData:
+				sent = true
+				// 送信したフレームを録音などの追加出力に渡す
+				frameSinks.Dispatch(frame, opusData)
+			default:
+				// チャンネルがいっぱいの場合はスキップ（毎フレーム出ないよう間引く）
+				warnLimiter.Warn("opus_send_full", "OpusSend channel full, skipping frame")
 			}
-		},
+			stats.recordFrame(opusData, sent, len(opusSend), len(pcmBuffer)/channels)
+		}
 	}
 
-	// デバイスの初期化と開始
-	device, err := malgo.InitDevice(ctx.Context, deviceConfig, captureCallbacks)
-	if err != nil {
-		return fmt.Errorf("failed to initialize capture device: %v", err)
+	// 複数デバイスのプロファイルは全デバイスの音声をミキサーに溜めて独自のクロックで混ぜる
+	// （1台目のデバイスが止まっても他のデバイスの音声は途切れない）
+	onDevice := func(index int, pcm []int16) { onPCM(pcm) }
+	stopMix := func() {}
+	if len(settings.devices) > 1 {
+		mixer := newVoiceMixer()
+		onDevice = func(index int, pcm []int16) { mixer.Push(uint32(index), pcm) }
+		stopMix = startDeviceMix(mixer, onPCM)
 	}
 
-	if err := device.Start(); err != nil {
-		device.Uninit()
-		return fmt.Errorf("failed to start capture device: %v", err)
+	// デバイスの初期化と開始
+	stopCapture, err := openCapture(settings.devices, settings.bufferPeriods, onDevice)
+	if err != nil {
+		stopMix()
+		return err
 	}
 
 	log.Println("System audio streaming started!")
 
-	// ストリーミング停止シグナルを待機
-	<-botState.stopStreaming
-	
-	// デバイスの停止とクリーンアップ
-	device.Stop()
-	device.Uninit()
-	
+	// ストリーミングの停止（退出・再起動・終了）を待機
+	<-ctx.Done()
+
+	// キャプチャを止めてから無音を送り、受信側で最後のフレームが補間されないようにする
+	stopCapture()
+	stopMix()
+	sendSilenceTrailer(v)
+
 	log.Println("System audio streaming stopped.")
 	return nil
 }
 
+// startDeviceMix hands the mix of the devices of a profile to onPCM in 20ms
+// chunks paced by its own clock, so that a stalled device does not silence the
+// others. Call the returned function to stop it.
+func startDeviceMix(mixer *voiceMixer, onPCM func(pcm []int16)) (stop func()) {
+	const frameSize = 960 // 20ms at 48kHz
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(frameSize * time.Second / outputSampleRate)
+		defer ticker.Stop()
+
+		chunk := make([]int16, frameSize*outputChannels)
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			mixer.Read(chunk)
+			onPCM(chunk)
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// newOpusEncoder creates the stream encoder with the settings of the encoder section
+func newOpusEncoder(cfg EncoderConfig) (*gopus.Encoder, error) {
+	application := gopus.Audio
+	switch cfg.Application {
+	case "voip":
+		application = gopus.Voip
+	case "lowdelay":
+		application = gopus.RestrictedLowDelay
+	}
+
+	encoder, err := gopus.NewEncoder(outputSampleRate, outputChannels, application)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create opus encoder: %v", err)
+	}
+	if cfg.BitrateKbps > 0 {
+		encoder.SetBitrate(cfg.BitrateKbps * 1000)
+	}
+	encoder.SetVbr(!cfg.ConstantBitrate)
+
+	bitrate, mode := "default", "VBR"
+	if cfg.BitrateKbps > 0 {
+		bitrate = fmt.Sprintf("%d kbps", cfg.BitrateKbps)
+	}
+	if cfg.ConstantBitrate {
+		mode = "CBR"
+	}
+	log.Printf("Opus encoder: %s, bitrate %s, %s", cfg.Application, bitrate, mode)
+	return encoder, nil
+}
+
 // selectAudioDevice displays available audio devices and lets the user select one
 func selectAudioDevice() (string, error) {
 	// malgoコンテキストの初期化
@@ -750,10 +1437,10 @@ func selectAudioDevice() (string, error) {
 	fmt.Printf("\n✓ Selected: %s\n", selectedDevice)
 
 	// デフォルトとして保存するか確認
-	fmt.Print("\nSave this device as default in config.yaml? (y/n): ")
+	fmt.Printf("\nSave this device as default in %s? (y/n): ", configPath)
 	saveInput, err := reader.ReadString('\n')
 	if err != nil {
-		log.Printf("Warning: Failed to read input: %v", err)
+		slog.Warn("Failed to read input", "error", err)
 		fmt.Println()
 		return selectedDevice, nil
 	}
@@ -761,10 +1448,10 @@ func selectAudioDevice() (string, error) {
 	saveInput = strings.TrimSpace(strings.ToLower(saveInput))
 	if saveInput == "y" || saveInput == "yes" {
 		if err := saveDeviceToConfig(selectedDevice); err != nil {
-			log.Printf("Warning: Failed to save device to config: %v", err)
+			slog.Warn("Failed to save device to config", "error", err)
 			fmt.Println("Device selection will be used for this session only.")
 		} else {
-			fmt.Println("✓ Device saved to config.yaml")
+			fmt.Printf("✓ Device saved to %s\n", configPath)
 		}
 	}
 
@@ -772,58 +1459,6 @@ func selectAudioDevice() (string, error) {
 	return selectedDevice, nil
 }
 
-// saveDeviceToConfig saves the selected audio device to config.yaml
-func saveDeviceToConfig(deviceName string) error {
-	// config.yamlを読み込む
-	data, err := os.ReadFile("config.yaml")
-	if err != nil {
-		return fmt.Errorf("failed to read config.yaml: %v", err)
-	}
-
-	lines := strings.Split(string(data), "\n")
-	updated := false
-	inAudioSection := false
-
-	// 既存の audio_device_name を探して更新、またはコメントアウトされている行を置き換え
-	for i, line := range lines {
-		trimmed := strings.TrimSpace(line)
-
-		// オーディオデバイスセクションを検出
-		if strings.Contains(trimmed, "オーディオデバイスの設定") || 
-		   strings.Contains(trimmed, "Audio Device Settings") {
-			inAudioSection = true
-			continue
-		}
-
-		// 別のセクションに入ったらフラグをオフ
-		if inAudioSection && strings.HasPrefix(trimmed, "#") && 
-		   (strings.Contains(trimmed, "デバイス一覧") || strings.Contains(trimmed, "Device List")) {
-			inAudioSection = false
-		}
-
-		// audio_device_name の行を見つけた場合
-		if strings.HasPrefix(trimmed, "audio_device_name:") || 
-		   strings.HasPrefix(trimmed, "# audio_device_name:") {
-			lines[i] = fmt.Sprintf("audio_device_name: \"%s\"", deviceName)
-			updated = true
-			break
-		}
-	}
-
-	// audio_device_name が見つからなかった場合は、ファイルの最後に追加
-	if !updated {
-		lines = append(lines, fmt.Sprintf("audio_device_name: \"%s\"", deviceName))
-	}
-
-	// ファイルに書き込む
-	output := strings.Join(lines, "\n")
-	if err := os.WriteFile("config.yaml", []byte(output), 0644); err != nil {
-		return fmt.Errorf("failed to write config.yaml: %v", err)
-	}
-
-	return nil
-}
-
 // findDeviceByName finds a device by its name
 func findDeviceByName(ctx *malgo.AllocatedContext, deviceName string) (*malgo.DeviceInfo, error) {
 	// 再生デバイスから検索
@@ -842,7 +1477,11 @@ func findDeviceByName(ctx *malgo.AllocatedContext, deviceName string) (*malgo.De
 }
 
 // waitForEnter waits for the user to press Enter before exiting
+// (does nothing in headless mode)
 func waitForEnter() {
+	if headless {
+		return
+	}
 	fmt.Println("")
 	fmt.Print("Press Enter to exit...")
 	reader := bufio.NewReader(os.Stdin)
@@ -851,82 +1490,12 @@ func waitForEnter() {
 
 // exitWithError logs an error message and waits for Enter before exiting
 func exitWithError(format string, args ...interface{}) {
-	log.Printf(format, args...)
+	// ログレベルが warn / error でも終了理由が必ず残るようにする
+	slog.Error(fmt.Sprintf(format, args...))
 	waitForEnter()
 	os.Exit(1)
 }
 
-// loadOrCreateConfig loads config.yaml or creates it if it doesn't exist
-func loadOrCreateConfig() (*Config, error) {
-	// config.yamlが存在するか確認
-	if _, err := os.Stat("config.yaml"); os.IsNotExist(err) {
-		// 存在しない場合は、テンプレートから作成
-		log.Println("config.yaml not found. Creating a new one...")
-		if err := createDefaultConfig(); err != nil {
-			return nil, fmt.Errorf("failed to create config.yaml: %v", err)
-		}
-		log.Println("✓ Created config.yaml")
-	}
-
-	// config.yamlを読み込む
-	configFile, err := os.Open("config.yaml")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open config.yaml: %v", err)
-	}
-	defer configFile.Close()
-
-	cfg := &Config{}
-	decoder := yaml.NewDecoder(configFile)
-	if err := decoder.Decode(cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config.yaml: %v", err)
-	}
-
-	return cfg, nil
-}
-
-// createDefaultConfig creates a default config.yaml file
-func createDefaultConfig() error {
-	defaultConfig := `# ConsoNance Configuration File
-# This file was automatically generated
-
-# Discord Bot Token (REQUIRED)
-# Get your token from https://discord.com/developers/applications
-discord_token: ""
-
-# ===== Optional Settings =====
-# These settings are all optional. You can control the bot via Discord chat commands!
-
-# Auto-connect Settings (Optional)
-# If you want the bot to automatically join a voice channel on startup, 
-# uncomment and fill in these values:
-# guild_id: "YOUR_GUILD_ID_HERE"
-# channel_id: "YOUR_CHANNEL_ID_HERE"
-
-# To join via Discord chat, simply mention the bot:
-#   @Bot join #channel-name
-#   @Bot leave
-#   @Bot status
-#   @Bot help
-
-# Audio Device Settings (Optional)
-# If not specified, you'll be prompted to select a device from a list at startup
-# To use a specific device, uncomment and set the device name:
-# audio_device_name: "Speakers (Realtek High Definition Audio)"
-
-# Audio Buffer Settings (Optional)
-# Number of audio buffer periods (affects latency and stability)
-# 0 = use default, higher values = more stable but more latency
-# Recommended: 3-6 depending on your system performance
-audio_buffer_periods: 0
-`
-
-	if err := os.WriteFile("config.yaml", []byte(defaultConfig), 0644); err != nil {
-		return fmt.Errorf("failed to write config.yaml: %v", err)
-	}
-
-	return nil
-}
-
 // promptForDiscordToken prompts the user to enter their Discord bot token
 func promptForDiscordToken() (string, error) {
 	fmt.Println("\n=== Discord Bot Token Required ===")
@@ -959,31 +1528,3 @@ func promptForDiscordToken() (string, error) {
 
 	return token, nil
 }
-
-// saveTokenToConfig saves the Discord token to config.yaml
-func saveTokenToConfig(token string) error {
-	// config.yamlを読み込む
-	data, err := os.ReadFile("config.yaml")
-	if err != nil {
-		return fmt.Errorf("failed to read config.yaml: %v", err)
-	}
-
-	lines := strings.Split(string(data), "\n")
-
-	// discord_token の行を探して更新
-	for i, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmed, "discord_token:") {
-			lines[i] = fmt.Sprintf("discord_token: \"%s\"", token)
-			break
-		}
-	}
-
-	// ファイルに書き込む
-	output := strings.Join(lines, "\n")
-	if err := os.WriteFile("config.yaml", []byte(output), 0644); err != nil {
-		return fmt.Errorf("failed to write config.yaml: %v", err)
-	}
-
-	return nil
-}
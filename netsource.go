@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/malgo"
+	"layeh.com/gopus"
+)
+
+const (
+	// networkBufferDefaultMS is the jitter buffer of a network source when buffer_ms is unset
+	networkBufferDefaultMS = 100
+
+	// networkBufferSlackMS is how far the buffer may grow beyond buffer_ms
+	// (a sender with a faster clock) before the oldest audio is dropped
+	networkBufferSlackMS = 500
+
+	// networkRetryMin and networkRetryMax bound the wait before reconnecting to an HTTP stream
+	networkRetryMin = time.Second
+	networkRetryMax = 30 * time.Second
+
+	// networkConnectTimeout bounds connecting to an HTTP stream and waiting for its headers
+	networkConnectTimeout = 10 * time.Second
+
+	// maxUDPPacketSize is the largest datagram read from a UDP source
+	maxUDPPacketSize = 65536
+)
+
+// networkHTTPClient pulls HTTP streams
+var networkHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: networkConnectTimeout}).DialContext,
+		ResponseHeaderTimeout: networkConnectTimeout,
+	},
+}
+
+// isNetworkSource reports whether a profile device is received over the network instead of captured
+func isNetworkSource(device ProfileDevice) bool {
+	switch device.Mode {
+	case "http", "tcp", "udp":
+		return true
+	}
+	return false
+}
+
+// openSources is the capture backend of the stream. Network sources are
+// received by the bot itself; the other devices are opened with malgo.
+func openSources(sources []ProfileDevice, bufferPeriods int, onPCM func(index int, pcm []int16)) (func(), error) {
+	var stops []func()
+	stop := func() {
+		for _, s := range stops {
+			s()
+		}
+	}
+
+	var devices []ProfileDevice
+	var deviceIndex []int
+	for i, source := range sources {
+		if !isNetworkSource(source) {
+			devices = append(devices, source)
+			deviceIndex = append(deviceIndex, i)
+			continue
+		}
+		index := i
+		ns, err := startNetworkSource(source, func(pcm []int16) { onPCM(index, pcm) })
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		stops = append(stops, ns.Stop)
+	}
+
+	if len(devices) > 0 {
+		stopDevices, err := openMalgoCapture(devices, bufferPeriods, func(i int, pcm []int16) { onPCM(deviceIndex[i], pcm) })
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		stops = append(stops, stopDevices)
+	}
+	return stop, nil
+}
+
+// networkSource receives audio over HTTP, TCP or UDP into a jitter buffer
+// and hands it on in 20ms chunks paced by the local clock, so that the
+// network jitter does not reach the encoder. While the sender is away it
+// hands on silence and reconnects in the background.
+type networkSource struct {
+	device ProfileDevice
+	buffer *jitterBuffer
+	onPCM  func(pcm []int16)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	listener   net.Listener   // tcp
+	packetConn net.PacketConn // udp
+
+	mu   sync.Mutex
+	conn net.Conn // 受信中のTCP接続
+}
+
+// startNetworkSource starts receiving a network source. Listening errors are
+// returned; connection errors of an HTTP stream are retried in the background.
+func startNetworkSource(device ProfileDevice, onPCM func(pcm []int16)) (*networkSource, error) {
+	bufferMS := device.BufferMS
+	if bufferMS == 0 {
+		bufferMS = networkBufferDefaultMS
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ns := &networkSource{
+		device: device,
+		buffer: newJitterBuffer(msToSamples(bufferMS), msToSamples(bufferMS+networkBufferSlackMS)),
+		onPCM:  onPCM,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	var err error
+	switch device.Mode {
+	case "tcp":
+		ns.listener, err = net.Listen("tcp", device.Listen)
+		if err == nil {
+			ns.run(ns.acceptLoop)
+		}
+	case "udp":
+		ns.packetConn, err = net.ListenPacket("udp", device.Listen)
+		if err == nil {
+			ns.run(ns.readPackets)
+		}
+	case "http":
+		ns.run(ns.pullHTTP)
+	default:
+		err = fmt.Errorf("unknown network source mode %q", device.Mode)
+	}
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start network source %s: %v", describeDevice(device), err)
+	}
+
+	ns.run(ns.pace)
+	log.Printf("Capture source: %s, buffer: %dms", describeDevice(device), bufferMS)
+	return ns, nil
+}
+
+// Addr returns the address a TCP or UDP source listens on
+func (ns *networkSource) Addr() net.Addr {
+	switch {
+	case ns.listener != nil:
+		return ns.listener.Addr()
+	case ns.packetConn != nil:
+		return ns.packetConn.LocalAddr()
+	}
+	return nil
+}
+
+// Stop closes the source and waits for its goroutines
+func (ns *networkSource) Stop() {
+	ns.cancel()
+	if ns.listener != nil {
+		ns.listener.Close()
+	}
+	if ns.packetConn != nil {
+		ns.packetConn.Close()
+	}
+	ns.mu.Lock()
+	if ns.conn != nil {
+		ns.conn.Close()
+	}
+	ns.mu.Unlock()
+	ns.wg.Wait()
+}
+
+func (ns *networkSource) run(f func()) {
+	ns.wg.Add(1)
+	go func() {
+		defer ns.wg.Done()
+		f()
+	}()
+}
+
+// write applies the device volume and queues received PCM
+func (ns *networkSource) write(pcm []int16) {
+	if ns.device.Volume != 0 && ns.device.Volume != 100 {
+		applyGain(pcm, ns.device.Volume)
+	}
+	ns.buffer.Write(pcm)
+}
+
+// pace hands on one 20ms chunk per tick: buffered audio, or silence while
+// the buffer fills up again
+func (ns *networkSource) pace() {
+	const frameSize = 960 // 20ms at 48kHz
+
+	ticker := time.NewTicker(frameSize * time.Second / outputSampleRate)
+	defer ticker.Stop()
+
+	chunk := make([]int16, frameSize*outputChannels)
+	for {
+		select {
+		case <-ns.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !ns.buffer.Read(chunk) {
+			clear(chunk)
+		}
+		ns.onPCM(chunk)
+	}
+}
+
+// acceptLoop serves the TCP connections. A new connection replaces the
+// current one, so a restarted sender takes over at once.
+func (ns *networkSource) acceptLoop() {
+	for {
+		conn, err := ns.listener.Accept()
+		if err != nil {
+			if ns.ctx.Err() == nil {
+				slog.Warn("Network source stopped accepting", "source", describeDevice(ns.device), "error", err)
+			}
+			return
+		}
+
+		ns.mu.Lock()
+		if ns.conn != nil {
+			ns.conn.Close()
+		}
+		ns.conn = conn
+		ns.mu.Unlock()
+
+		ns.run(func() { ns.serveConn(conn) })
+	}
+}
+
+// serveConn reads one TCP connection until the sender closes it
+func (ns *networkSource) serveConn(conn net.Conn) {
+	log.Printf("Network source %s: connected from %s", describeDevice(ns.device), conn.RemoteAddr())
+	ns.buffer.Reset()
+
+	var err error
+	if ns.device.Format == "opus" {
+		err = ns.readOpusStream(conn)
+	} else {
+		err = ns.readPCMStream(conn)
+	}
+
+	ns.mu.Lock()
+	if ns.conn == conn {
+		ns.conn = nil
+	}
+	ns.mu.Unlock()
+	conn.Close()
+
+	if ns.ctx.Err() != nil {
+		return
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		slog.Warn("Network source connection lost", "source", describeDevice(ns.device), "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+	log.Printf("Network source %s: %s disconnected, waiting for the sender", describeDevice(ns.device), conn.RemoteAddr())
+}
+
+// readPCMStream reads raw 48kHz stereo S16LE samples
+func (ns *networkSource) readPCMStream(r io.Reader) error {
+	decoder := newPCMDecoder()
+	buf := make([]byte, 3840) // 20ms
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			ns.write(decoder.Decode(buf[:n]))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readOpusStream reads Opus packets, each prefixed with its length as a
+// 16-bit big-endian integer
+func (ns *networkSource) readOpusStream(r io.Reader) error {
+	decoder, err := gopus.NewDecoder(outputSampleRate, outputChannels)
+	if err != nil {
+		return fmt.Errorf("failed to create opus decoder: %v", err)
+	}
+
+	var size [2]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return err
+		}
+		ns.decodeOpus(decoder, packet)
+	}
+}
+
+// readPackets reads UDP datagrams: raw PCM, or one Opus packet per datagram
+func (ns *networkSource) readPackets() {
+	var opusDecoder *gopus.Decoder
+	if ns.device.Format == "opus" {
+		var err error
+		opusDecoder, err = gopus.NewDecoder(outputSampleRate, outputChannels)
+		if err != nil {
+			slog.Warn("Network source failed to create opus decoder", "source", describeDevice(ns.device), "error", err)
+			return
+		}
+	}
+	pcmDecoder := newPCMDecoder()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, _, err := ns.packetConn.ReadFrom(buf)
+		if err != nil {
+			if ns.ctx.Err() == nil {
+				slog.Warn("Network source stopped receiving", "source", describeDevice(ns.device), "error", err)
+			}
+			return
+		}
+		if opusDecoder != nil {
+			ns.decodeOpus(opusDecoder, buf[:n])
+		} else {
+			ns.write(pcmDecoder.Decode(buf[:n]))
+		}
+	}
+}
+
+// decodeOpus decodes one Opus packet into the buffer; broken packets are skipped
+func (ns *networkSource) decodeOpus(decoder *gopus.Decoder, packet []byte) {
+	pcm, err := decoder.Decode(packet, maxOpusFrameSize, false)
+	if err != nil {
+		warnLimiter.Warn("network_opus_decode", "Failed to decode opus packet from network source", "source", describeDevice(ns.device), "error", err)
+		return
+	}
+	ns.write(pcm)
+}
+
+// pullHTTP reads the HTTP stream and reconnects with a growing delay when it ends
+func (ns *networkSource) pullHTTP() {
+	retry := networkRetryMin
+	for {
+		received, err := ns.readHTTP()
+		if ns.ctx.Err() != nil {
+			return
+		}
+		if received {
+			retry = networkRetryMin
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		slog.Warn("Network source failed, reconnecting", "source", describeDevice(ns.device), "error", err, "retry", retry)
+
+		select {
+		case <-ns.ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, networkRetryMax)
+	}
+}
+
+// readHTTP reads one connection to an Ogg Opus HTTP stream (Icecast and the
+// like). received reports whether any audio arrived before it ended.
+func (ns *networkSource) readHTTP() (received bool, err error) {
+	req, err := http.NewRequestWithContext(ns.ctx, http.MethodGet, ns.device.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", GetVersionString())
+
+	// ストリームは終わらないのでClient.Timeoutは使わず、接続とヘッダーだけに制限を掛ける
+	// (ns.ctx が止まるとBodyの読み込みも終わる)
+	resp, err := networkHTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("server returned %s", resp.Status)
+	}
+	log.Printf("Network source %s: connected (%s)", describeDevice(ns.device), resp.Header.Get("Content-Type"))
+	ns.buffer.Reset()
+
+	ogg := newOggReader(resp.Body)
+	var decoder *gopus.Decoder
+	for {
+		packet, bos, err := ogg.ReadPacket()
+		if err != nil {
+			return received, err
+		}
+
+		// 連結されたストリームでは曲ごとに新しい論理ストリームが始まる
+		if bos {
+			if len(packet) < 8 || string(packet[:8]) != "OpusHead" {
+				return received, fmt.Errorf("only Ogg Opus streams are supported")
+			}
+			decoder, err = gopus.NewDecoder(outputSampleRate, outputChannels)
+			if err != nil {
+				return received, fmt.Errorf("failed to create opus decoder: %v", err)
+			}
+			continue
+		}
+		if decoder == nil {
+			return received, fmt.Errorf("ogg stream without an OpusHead header")
+		}
+		if len(packet) >= 8 && string(packet[:8]) == "OpusTags" {
+			continue
+		}
+
+		ns.decodeOpus(decoder, packet)
+		received = true
+	}
+}
+
+// pcmDecoder converts a byte stream of 48kHz stereo S16LE samples, keeping
+// a partial sample frame for the next read
+type pcmDecoder struct {
+	converter *audioConverter
+	pending   []byte
+}
+
+func newPCMDecoder() *pcmDecoder {
+	// 48kHz/ステレオ/S16はそのまま通る
+	converter, _ := newAudioConverter(malgo.FormatS16, outputChannels, outputSampleRate)
+	return &pcmDecoder{converter: converter}
+}
+
+// Decode returns the complete sample frames of data. The result is reused by the next call.
+func (d *pcmDecoder) Decode(data []byte) []int16 {
+	const frameBytes = 2 * outputChannels
+
+	d.pending = append(d.pending, data...)
+	n := len(d.pending) / frameBytes * frameBytes
+	if n == 0 {
+		return nil
+	}
+	pcm := d.converter.Process(d.pending[:n])
+	d.pending = append(d.pending[:0], d.pending[n:]...)
+	return pcm
+}
+
+// jitterBuffer queues received PCM. Reading starts once target samples are
+// queued and stops again on an underrun, so that short gaps in the network
+// become one pause instead of many clicks.
+type jitterBuffer struct {
+	mu        sync.Mutex
+	samples   []int16
+	target    int
+	limit     int
+	buffering bool
+}
+
+func newJitterBuffer(target, limit int) *jitterBuffer {
+	return &jitterBuffer{target: target, limit: limit, buffering: true}
+}
+
+// Write queues samples, dropping the oldest ones beyond the limit
+func (b *jitterBuffer) Write(pcm []int16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples = append(b.samples, pcm...)
+	if over := len(b.samples) - b.limit; over > 0 {
+		over += over % outputChannels
+		b.samples = append(b.samples[:0], b.samples[over:]...)
+		warnLimiter.Warn("network_buffer_overflow", "Network source is ahead of the stream, dropping buffered audio")
+	}
+}
+
+// Read fills out with queued samples. It returns false while buffering.
+func (b *jitterBuffer) Read(out []int16) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buffering {
+		if len(b.samples) < b.target {
+			return false
+		}
+		b.buffering = false
+	}
+	if len(b.samples) < len(out) {
+		// 途切れたら再びバッファが溜まるまで待つ
+		b.buffering = true
+		warnLimiter.Warn("network_buffer_underrun", "Network source buffer ran empty, buffering")
+		return false
+	}
+	copy(out, b.samples)
+	b.samples = append(b.samples[:0], b.samples[len(out):]...)
+	return true
+}
+
+// Reset drops the queued samples and starts buffering again
+func (b *jitterBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples = b.samples[:0]
+	b.buffering = true
+}
+
+// msToSamples returns the number of interleaved output samples in ms milliseconds
+func msToSamples(ms int) int {
+	return ms * outputSampleRate / 1000 * outputChannels
+}
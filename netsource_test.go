@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"layeh.com/gopus"
+)
+
+// sineFrame returns 20ms of a 440Hz stereo sine starting at sample pos
+func sineFrame(pos int, amplitude float64) []int16 {
+	pcm := make([]int16, 960*outputChannels)
+	for i := 0; i < 960; i++ {
+		v := int16(amplitude * 32767 * math.Sin(2*math.Pi*440*float64(pos+i)/outputSampleRate))
+		pcm[i*2], pcm[i*2+1] = v, v
+	}
+	return pcm
+}
+
+// opusFrames encodes n frames of the sine
+func opusFrames(t *testing.T, n int) [][]byte {
+	t.Helper()
+	encoder, err := gopus.NewEncoder(outputSampleRate, outputChannels, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make([][]byte, n)
+	for i := range frames {
+		frames[i], err = encoder.Encode(sineFrame(i*960, 0.5), 960, 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return frames
+}
+
+// peakMeter records the loudest sample a network source has handed on
+type peakMeter struct {
+	peak atomic.Int32
+}
+
+func (m *peakMeter) onPCM(pcm []int16) {
+	for _, s := range pcm {
+		if v := int32(s); v > m.peak.Load() {
+			m.peak.Store(v)
+		}
+	}
+}
+
+func startTestSource(t *testing.T, device ProfileDevice) (*networkSource, *peakMeter) {
+	t.Helper()
+	meter := &peakMeter{}
+	ns, err := startNetworkSource(device, meter.onPCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ns.Stop)
+	return ns, meter
+}
+
+func TestOggReaderReadsWriterOutput(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newOggOpusWriter(&buf, outputChannels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 255バイト以上のパケットやページをまたぐパケットも含める
+	var packets [][]byte
+	for i := 0; i < 120; i++ {
+		packet := bytes.Repeat([]byte{byte(i)}, 1+i*7)
+		packets = append(packets, packet)
+		if err := w.WritePacket(packet, 960); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newOggReader(&buf)
+	head, bos, err := r.ReadPacket()
+	if err != nil || !bos || string(head[:8]) != "OpusHead" {
+		t.Fatalf("first packet = %q (bos %v, err %v), want OpusHead", head, bos, err)
+	}
+	if tags, _, err := r.ReadPacket(); err != nil || string(tags[:8]) != "OpusTags" {
+		t.Fatalf("second packet = %q (err %v), want OpusTags", tags, err)
+	}
+	for i, want := range packets {
+		got, bos, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if bos || !bytes.Equal(got, want) {
+			t.Fatalf("packet %d = %d bytes (bos %v), want %d bytes", i, len(got), bos, len(want))
+		}
+	}
+}
+
+func TestUDPSourcePCM(t *testing.T) {
+	ns, meter := startTestSource(t, ProfileDevice{Mode: "udp", Listen: "127.0.0.1:0", BufferMS: 40})
+
+	conn, err := net.Dial("udp", ns.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Write(encodeS16LE(sineFrame(i*960, 0.5))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, 2*time.Second, "received audio", func() bool { return meter.peak.Load() > 15000 })
+}
+
+func TestTCPSourceOpusReconnects(t *testing.T) {
+	ns, meter := startTestSource(t, ProfileDevice{Mode: "tcp", Listen: "127.0.0.1:0", Format: "opus", BufferMS: 40})
+	frames := opusFrames(t, 10)
+
+	send := func() {
+		conn, err := net.Dial("tcp", ns.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for _, frame := range frames {
+			var size [2]byte
+			binary.BigEndian.PutUint16(size[:], uint16(len(frame)))
+			conn.Write(size[:])
+			conn.Write(frame)
+		}
+	}
+
+	send()
+	waitFor(t, 2*time.Second, "audio of the first connection", func() bool { return meter.peak.Load() > 8000 })
+
+	// 送信側が切断・再接続しても受信し続ける
+	time.Sleep(400 * time.Millisecond) // 最初の200msを流し終える
+	meter.peak.Store(0)
+	send()
+	waitFor(t, 2*time.Second, "audio of the second connection", func() bool { return meter.peak.Load() > 8000 })
+}
+
+func TestHTTPSourceReconnects(t *testing.T) {
+	frames := opusFrames(t, 25)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "audio/ogg")
+		ogg, err := newOggOpusWriter(w, outputChannels)
+		if err != nil {
+			return
+		}
+		for _, frame := range frames {
+			ogg.WritePacket(frame, 960)
+		}
+		ogg.Close()
+	}))
+	defer server.Close()
+
+	_, meter := startTestSource(t, ProfileDevice{Mode: "http", URL: server.URL, BufferMS: 40})
+
+	waitFor(t, 2*time.Second, "audio of the stream", func() bool { return meter.peak.Load() > 8000 })
+	waitFor(t, 3*time.Second, "reconnect", func() bool { return requests.Load() >= 2 })
+}
+
+func TestHTTPSourceRejectsOtherCodecs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ID3 not an ogg stream"))
+	}))
+	defer server.Close()
+
+	ns, _ := startTestSource(t, ProfileDevice{Mode: "http", URL: server.URL})
+	received, err := ns.readHTTP()
+	if received || err == nil {
+		t.Errorf("readHTTP = %v, %v; want an error", received, err)
+	}
+}
+
+func TestJitterBufferWaitsForTarget(t *testing.T) {
+	b := newJitterBuffer(8, 16)
+	out := make([]int16, 4)
+
+	b.Write([]int16{1, 2, 3, 4})
+	if b.Read(out) {
+		t.Fatal("read before the target was buffered")
+	}
+	b.Write([]int16{5, 6, 7, 8})
+	if !b.Read(out) || !reflect.DeepEqual(out, []int16{1, 2, 3, 4}) {
+		t.Fatalf("first read = %v", out)
+	}
+	if !b.Read(out) || !reflect.DeepEqual(out, []int16{5, 6, 7, 8}) {
+		t.Fatalf("second read = %v", out)
+	}
+	// 足りなくなったら再び目標量まで溜める
+	if b.Read(out) {
+		t.Fatal("read from an empty buffer")
+	}
+	b.Write([]int16{9, 10, 11, 12})
+	if b.Read(out) {
+		t.Fatal("read after an underrun before the target was buffered again")
+	}
+
+	// 上限を超えたら古い方から捨てる
+	b.Write(make([]int16, 20))
+	b.mu.Lock()
+	n := len(b.samples)
+	b.mu.Unlock()
+	if n != 16 {
+		t.Errorf("buffered %d samples, want the limit of 16", n)
+	}
+}
+
+func TestProfileStreamsFromNetworkSource(t *testing.T) {
+	// 空いているポートを借りる
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().String()
+	probe.Close()
+
+	cfg := &Config{
+		Audio: AudioConfig{Profile: "remote"},
+		Profiles: map[string]ProfileConfig{
+			"remote": {Devices: []ProfileDevice{{Mode: "udp", Listen: addr, BufferMS: 40}}},
+		},
+	}
+	tb := setupTestBot(t, cfg)
+	openCapture = openSources
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	v := tb.gateway.Voices()[0]
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			conn.Write(encodeS16LE(sineFrame(i*960, 0.5)))
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	waitFor(t, 2*time.Second, "loud frames", func() bool {
+		return stats.snapshot().running && levels.snapshot().total.peakDB > -12
+	})
+	if len(v.Frames()) == 0 {
+		t.Error("no frames were sent")
+	}
+}
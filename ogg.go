@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+const (
+	// Opusエンコーダーの標準的な先読みサンプル数（48kHz）
+	opusPreSkip = 312
+
+	// 1ページにまとめるパケット数（20ms × 50 = 1秒）
+	oggPacketsPerPage = 50
+)
+
+// oggCRCTable is the lookup table for the Ogg page checksum (poly 0x04c11db7)
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggOpusWriter writes Opus packets into an Ogg Opus stream (RFC 7845)
+type oggOpusWriter struct {
+	w       io.Writer
+	serial  uint32
+	seq     uint32
+	granule uint64
+
+	lacing  []byte
+	data    []byte
+	packets int
+	written int64
+}
+
+// newOggOpusWriter creates a writer and emits the OpusHead and OpusTags headers
+func newOggOpusWriter(w io.Writer, channels int) (*oggOpusWriter, error) {
+	o := &oggOpusWriter{
+		w:      w,
+		serial: rand.Uint32(),
+	}
+
+	// OpusHead（識別ヘッダー）
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], outputSampleRate)
+	binary.LittleEndian.PutUint16(head[16:], 0) // output gain
+	head[18] = 0                                // channel mapping family
+	o.appendPacket(head)
+	if err := o.writePage(0x02); err != nil {
+		return nil, err
+	}
+
+	// OpusTags（コメントヘッダー）
+	vendor := GetVersionString()
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	binary.LittleEndian.PutUint32(tags[12+len(vendor):], 0)
+	o.appendPacket(tags)
+	if err := o.writePage(0); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// WritePacket appends one Opus packet containing the given number of samples
+func (o *oggOpusWriter) WritePacket(packet []byte, samples int) error {
+	// 1ページのセグメント数は最大255
+	if len(o.lacing)+len(packet)/255+1 > 255 {
+		if err := o.writePage(0); err != nil {
+			return err
+		}
+	}
+
+	o.appendPacket(packet)
+	o.granule += uint64(samples)
+	o.packets++
+
+	if o.packets >= oggPacketsPerPage {
+		return o.writePage(0)
+	}
+	return nil
+}
+
+// Flush writes any buffered packets as a page
+func (o *oggOpusWriter) Flush() error {
+	if o.packets == 0 {
+		return nil
+	}
+	return o.writePage(0)
+}
+
+// Close flushes buffered packets and writes the end-of-stream page
+func (o *oggOpusWriter) Close() error {
+	return o.writePage(0x04)
+}
+
+// Written returns the number of bytes written so far
+func (o *oggOpusWriter) Written() int64 {
+	return o.written
+}
+
+func (o *oggOpusWriter) appendPacket(packet []byte) {
+	n := len(packet)
+	for n >= 255 {
+		o.lacing = append(o.lacing, 255)
+		n -= 255
+	}
+	o.lacing = append(o.lacing, byte(n))
+	o.data = append(o.data, packet...)
+}
+
+// writePage writes the buffered segments as a single Ogg page
+func (o *oggOpusWriter) writePage(headerType byte) error {
+	page := make([]byte, 27+len(o.lacing)+len(o.data))
+	copy(page, "OggS")
+	page[4] = 0 // version
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], o.granule)
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.seq)
+	page[26] = byte(len(o.lacing))
+	copy(page[27:], o.lacing)
+	copy(page[27+len(o.lacing):], o.data)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	o.seq++
+	o.lacing = o.lacing[:0]
+	o.data = o.data[:0]
+	o.packets = 0
+
+	n, err := o.w.Write(page)
+	o.written += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write ogg page: %v", err)
+	}
+	return nil
+}
+
+// oggReader reads the packets of an Ogg stream, such as an Icecast Ogg Opus stream
+type oggReader struct {
+	r      *bufio.Reader
+	header [27]byte
+
+	// 読み込み済みページの残りのセグメント
+	lacing  []byte
+	data    []byte
+	partial []byte
+	bos     bool
+}
+
+func newOggReader(r io.Reader) *oggReader {
+	return &oggReader{r: bufio.NewReader(r)}
+}
+
+// ReadPacket returns the next complete packet. bos reports whether the
+// packet starts a logical stream (a new track of a chained stream).
+func (o *oggReader) ReadPacket() (packet []byte, bos bool, err error) {
+	for {
+		for len(o.lacing) > 0 {
+			n := 0
+			// 255のセグメントは次のセグメントに続く
+			for len(o.lacing) > 0 {
+				size := int(o.lacing[0])
+				o.lacing = o.lacing[1:]
+				n += size
+				if size < 255 {
+					packet = append(o.partial, o.data[:n]...)
+					o.data = o.data[n:]
+					o.partial = nil
+					bos, o.bos = o.bos, false
+					return packet, bos, nil
+				}
+			}
+			o.partial = append(o.partial, o.data[:n]...)
+			o.data = o.data[n:]
+		}
+		if err := o.readPage(); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// readPage reads the next page and checks its checksum
+func (o *oggReader) readPage() error {
+	if _, err := io.ReadFull(o.r, o.header[:]); err != nil {
+		return err
+	}
+	if string(o.header[:4]) != "OggS" {
+		return fmt.Errorf("not an ogg stream")
+	}
+	headerType := o.header[5]
+	segments := int(o.header[26])
+
+	page := make([]byte, 27+segments)
+	copy(page, o.header[:])
+	if _, err := io.ReadFull(o.r, page[27:]); err != nil {
+		return err
+	}
+	size := 0
+	for _, s := range page[27:] {
+		size += int(s)
+	}
+	page = append(page, make([]byte, size)...)
+	if _, err := io.ReadFull(o.r, page[27+segments:]); err != nil {
+		return err
+	}
+
+	crc := binary.LittleEndian.Uint32(page[22:])
+	binary.LittleEndian.PutUint32(page[22:], 0)
+	if oggCRC(page) != crc {
+		return fmt.Errorf("ogg page checksum mismatch")
+	}
+
+	// 継続ページでなければ途中のパケットは捨てる
+	if headerType&0x01 == 0 {
+		o.partial = nil
+	}
+	if headerType&0x02 != 0 {
+		o.bos = true
+	}
+	o.lacing = page[27 : 27+segments]
+	o.data = page[27+segments:]
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// outputQueueFrames is how many 20ms frames a PCM output may fall behind before frames are dropped
+	outputQueueFrames = 50
+
+	// outputWriteTimeout drops a WebSocket client that stops reading
+	outputWriteTimeout = 5 * time.Second
+)
+
+// errOutputClosed is returned while waiting for a reader when the output is closed
+var errOutputClosed = errors.New("output closed")
+
+// pcmOutput is an additional output of the raw PCM stream for OBS, ffmpeg and the like
+type pcmOutput interface {
+	frameSink
+	Close()
+}
+
+var (
+	// activeOutputs are the running PCM outputs by their frameSinks name
+	activeOutputs   = make(map[string]pcmOutput)
+	activeOutputsMu sync.Mutex
+)
+
+// applyOutputsConfig restarts the PCM outputs to match cfg
+func applyOutputsConfig(cfg OutputsConfig) error {
+	activeOutputsMu.Lock()
+	defer activeOutputsMu.Unlock()
+
+	for name, output := range activeOutputs {
+		frameSinks.Remove(name)
+		output.Close()
+		delete(activeOutputs, name)
+	}
+
+	var errs []error
+	start := func(name string, output pcmOutput, err error) {
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		activeOutputs[name] = output
+		frameSinks.Add(name, output)
+	}
+	if cfg.Pipe.Enabled {
+		output, err := startPipeOutput(cfg.Pipe.Path)
+		start("pipe", output, err)
+	}
+	if cfg.WebSocket.Enabled {
+		output, err := startWebSocketOutput(cfg.WebSocket)
+		start("websocket", output, err)
+	}
+	return errors.Join(errs...)
+}
+
+// stopOutputs closes every PCM output
+func stopOutputs() {
+	applyOutputsConfig(OutputsConfig{})
+}
+
+// encodeS16LE returns the samples as little-endian bytes, the format of the PCM outputs
+func encodeS16LE(pcm []int16) []byte {
+	b := make([]byte, len(pcm)*2)
+	for i, s := range pcm {
+		binary.LittleEndian.PutUint16(b[i*2:], uint16(s))
+	}
+	return b
+}
+
+// frameQueue hands frames from the audio callback to a writer goroutine,
+// dropping frames instead of blocking when the consumer falls behind
+type frameQueue chan []byte
+
+func newFrameQueue() frameQueue {
+	return make(frameQueue, outputQueueFrames)
+}
+
+// Push queues a frame without blocking
+func (q frameQueue) Push(frame []byte, warnKey string) {
+	select {
+	case q <- frame:
+	default:
+		warnLimiter.Warn(warnKey, "PCM output is too slow, dropping frames")
+	}
+}
+
+// Drain drops the queued frames, so that a new reader starts at the live position
+func (q frameQueue) Drain() {
+	for {
+		select {
+		case <-q:
+		default:
+			return
+		}
+	}
+}
+
+// pipeOutput writes the PCM stream to a named pipe (a FIFO on Linux/macOS,
+// \\.\pipe\<name> on Windows). Frames are dropped while no reader is connected,
+// and the next reader is waited for when one disconnects.
+type pipeOutput struct {
+	path   string
+	frames frameQueue
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	reader io.Closer // 接続中の読み手（書き込み中でも閉じられるように保持する）
+}
+
+func startPipeOutput(path string) (*pipeOutput, error) {
+	if err := createPipe(path); err != nil {
+		return nil, fmt.Errorf("failed to create pipe %s: %v", path, err)
+	}
+	p := &pipeOutput{
+		path:   path,
+		frames: newFrameQueue(),
+		done:   make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.run()
+	log.Printf("PCM output: pipe %s (48kHz stereo S16LE)", path)
+	return p, nil
+}
+
+func (p *pipeOutput) WriteFrame(pcm []int16, opus []byte) {
+	p.frames.Push(encodeS16LE(pcm), "pipe_output_slow")
+}
+
+// Close stops writing and removes the pipe
+func (p *pipeOutput) Close() {
+	close(p.done)
+	// 読み手が止まっていて書き込みが詰まっていても終了できるようにする
+	p.mu.Lock()
+	if p.reader != nil {
+		p.reader.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	removePipe(p.path)
+}
+
+func (p *pipeOutput) run() {
+	defer p.wg.Done()
+	for {
+		w, err := openPipe(p.path, p.done)
+		if err != nil {
+			if err != errOutputClosed {
+				slog.Warn("PCM output pipe failed", "path", p.path, "error", err)
+			}
+			return
+		}
+		p.mu.Lock()
+		p.reader = w
+		p.mu.Unlock()
+		log.Printf("PCM output: reader connected to %s", p.path)
+		p.frames.Drain()
+
+		err = p.write(w)
+		p.mu.Lock()
+		p.reader = nil
+		p.mu.Unlock()
+		w.Close()
+		if err == errOutputClosed {
+			return
+		}
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		log.Printf("PCM output: reader of %s disconnected (%v), waiting for the next one", p.path, err)
+	}
+}
+
+// write copies frames to the reader until it disconnects or the output is closed
+func (p *pipeOutput) write(w io.Writer) error {
+	for {
+		select {
+		case <-p.done:
+			return errOutputClosed
+		case frame := <-p.frames:
+			if _, err := w.Write(frame); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// websocketFormat is the first (text) message to every WebSocket client;
+// the following binary messages are 20ms frames in this format
+type websocketFormat struct {
+	Format     string `json:"format"`
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	FrameMS    int    `json:"frame_ms"`
+}
+
+// websocketOutput serves the PCM stream to local WebSocket clients
+type websocketOutput struct {
+	cfg      WebSocketOutputConfig
+	server   *http.Server
+	addr     net.Addr
+	upgrader websocket.Upgrader
+	done     chan struct{}
+
+	mu      sync.Mutex
+	clients map[frameQueue]struct{}
+}
+
+func startWebSocketOutput(cfg WebSocketOutputConfig) (*websocketOutput, error) {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start WebSocket output: %v", err)
+	}
+
+	o := &websocketOutput{
+		cfg:     cfg,
+		addr:    ln.Addr(),
+		done:    make(chan struct{}),
+		clients: make(map[frameQueue]struct{}),
+	}
+	o.upgrader = websocket.Upgrader{CheckOrigin: localOrigin}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Path, o.serve)
+	o.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := o.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Warn("WebSocket output stopped", "error", err)
+		}
+	}()
+	log.Printf("PCM output: %s (48kHz stereo S16LE)", o.URL())
+	return o, nil
+}
+
+// URL returns the address clients connect to
+func (o *websocketOutput) URL() string {
+	return fmt.Sprintf("ws://%s%s", o.addr, o.cfg.Path)
+}
+
+func (o *websocketOutput) WriteFrame(pcm []int16, opus []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.clients) == 0 {
+		return
+	}
+	frame := encodeS16LE(pcm)
+	for q := range o.clients {
+		q.Push(frame, "websocket_output_slow")
+	}
+}
+
+// Close disconnects every client and stops listening
+func (o *websocketOutput) Close() {
+	close(o.done)
+	if err := o.server.Close(); err != nil {
+		slog.Warn("Failed to close WebSocket output", "error", err)
+	}
+}
+
+// serve sends the stream to one client
+func (o *websocketOutput) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := o.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	header, _ := json.Marshal(websocketFormat{Format: "s16le", SampleRate: outputSampleRate, Channels: outputChannels, FrameMS: 20})
+	conn.SetWriteDeadline(time.Now().Add(outputWriteTimeout))
+	if err := conn.WriteMessage(websocket.TextMessage, header); err != nil {
+		return
+	}
+
+	frames := newFrameQueue()
+	o.mu.Lock()
+	o.clients[frames] = struct{}{}
+	o.mu.Unlock()
+	defer func() {
+		o.mu.Lock()
+		delete(o.clients, frames)
+		o.mu.Unlock()
+	}()
+	log.Printf("PCM output: WebSocket client %s connected", r.RemoteAddr)
+	defer log.Printf("PCM output: WebSocket client %s disconnected", r.RemoteAddr)
+
+	// クライアントからのメッセージは読み捨て、切断だけを検知する
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-o.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			return
+		case <-closed:
+			return
+		case frame := <-frames:
+			conn.SetWriteDeadline(time.Now().Add(outputWriteTimeout))
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// localOrigin accepts clients without an Origin header (ffmpeg, OBS plugins)
+// and pages served from this machine, so that other websites opened in a
+// browser cannot listen in
+func localOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
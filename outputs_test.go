@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPipeOutputWritesFrames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIFO test; Windows uses named pipes")
+	}
+	path := filepath.Join(t.TempDir(), "out.pcm")
+	p, err := startPipeOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	reader, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// 読み手の接続が検知されるまで書き続ける
+	frame := sineFrame(0, 0.5)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			p.WriteFrame(frame, nil)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	got := make([]byte, len(frame)*2)
+	if err := readFIFO(reader, got, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, encodeS16LE(frame)) {
+		t.Error("pipe data does not match the frame")
+	}
+}
+
+// readFIFO fills buf from a FIFO, waiting for the writer to open it
+func readFIFO(f *os.File, buf []byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	f.SetReadDeadline(deadline)
+	for n := 0; n < len(buf); {
+		m, err := f.Read(buf[n:])
+		n += m
+		switch {
+		case err == io.EOF && time.Now().Before(deadline):
+			// 書き手がまだ開いていない
+			time.Sleep(10 * time.Millisecond)
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPipeOutputRefusesRegularFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIFO test; Windows uses named pipes")
+	}
+	path := filepath.Join(t.TempDir(), "out.pcm")
+	if err := os.WriteFile(path, []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := startPipeOutput(path); err == nil {
+		t.Fatal("started a pipe output over a regular file")
+	}
+}
+
+func TestWebSocketOutputStreamsBotAudio(t *testing.T) {
+	setupTestBot(t, nil)
+	err := applyOutputsConfig(OutputsConfig{WebSocket: WebSocketOutputConfig{Enabled: true, Listen: "127.0.0.1:0", Path: "/pcm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stopOutputs)
+	url := activeOutputs["websocket"].(*websocketOutput).URL()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	kind, msg, err := conn.ReadMessage()
+	if err != nil || kind != websocket.TextMessage {
+		t.Fatalf("first message = %d %q (%v), want the format", kind, msg, err)
+	}
+	var format websocketFormat
+	if err := json.Unmarshal(msg, &format); err != nil || format.Format != "s16le" || format.SampleRate != 48000 || format.Channels != 2 {
+		t.Fatalf("format = %s (%v)", msg, err)
+	}
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	kind, msg, err = conn.ReadMessage()
+	if err != nil || kind != websocket.BinaryMessage {
+		t.Fatalf("frame = %d (%v), want binary", kind, err)
+	}
+	if len(msg) != 960*outputChannels*2 {
+		t.Errorf("frame size = %d bytes, want 20ms", len(msg))
+	}
+}
+
+func TestWebSocketOutputRejectsOtherOrigins(t *testing.T) {
+	o, err := startWebSocketOutput(WebSocketOutputConfig{Listen: "127.0.0.1:0", Path: "/pcm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	header := http.Header{"Origin": {"https://example.com"}}
+	if conn, _, err := websocket.DefaultDialer.Dial(o.URL(), header); err == nil {
+		conn.Close()
+		t.Error("accepted a client from another website")
+	}
+	header = http.Header{"Origin": {"http://localhost:8080"}}
+	conn, _, err := websocket.DefaultDialer.Dial(o.URL(), header)
+	if err != nil {
+		t.Fatalf("rejected a local page: %v", err)
+	}
+	conn.Close()
+}
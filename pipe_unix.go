@@ -0,0 +1,66 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultPipePath is the FIFO of outputs.pipe, in the working directory
+	defaultPipePath = "consonance.pcm"
+
+	// pipeRetryInterval is how often a FIFO is checked for a reader
+	pipeRetryInterval = 250 * time.Millisecond
+)
+
+// checkPipePath accepts any file path
+func checkPipePath(path string) error {
+	return nil
+}
+
+// createPipe creates the FIFO unless it already exists
+func createPipe(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.Mode()&os.ModeNamedPipe == 0 {
+			return fmt.Errorf("%s exists and is not a named pipe", path)
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syscall.Mkfifo(path, 0600)
+}
+
+// removePipe deletes the FIFO
+func removePipe(path string) {
+	os.Remove(path)
+}
+
+// openPipe waits until a reader opens the FIFO, then returns it for writing
+func openPipe(path string, done <-chan struct{}) (io.WriteCloser, error) {
+	ticker := time.NewTicker(pipeRetryInterval)
+	defer ticker.Stop()
+	for {
+		// 読み手がいないとENXIOになるので、ブロックせずに再試行する
+		f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, syscall.ENXIO) {
+			return nil, err
+		}
+		select {
+		case <-done:
+			return nil, errOutputClosed
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// defaultPipePath is the pipe of outputs.pipe
+const defaultPipePath = `\\.\pipe\consonance`
+
+const (
+	pipeAccessOutbound  = 0x00000002
+	pipeTypeByte        = 0x00000000
+	errorPipeConnected  = syscall.Errno(535)
+	pipeOutBufferSize   = 65536
+	pipeUnlimitedWaitMS = 0
+)
+
+var (
+	procCreateNamedPipeW    = syscall.NewLazyDLL("kernel32.dll").NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = syscall.NewLazyDLL("kernel32.dll").NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = syscall.NewLazyDLL("kernel32.dll").NewProc("DisconnectNamedPipe")
+)
+
+// checkPipePath accepts pipe names only, as Windows has no FIFO files
+func checkPipePath(path string) error {
+	if !strings.HasPrefix(path, `\\.\pipe\`) {
+		return fmt.Errorf(`must start with \\.\pipe\ on Windows`)
+	}
+	return nil
+}
+
+// createPipe checks the pipe name; Windows pipes are created when a reader is waited for
+func createPipe(path string) error {
+	return checkPipePath(path)
+}
+
+// removePipe does nothing; a Windows pipe disappears with its last handle
+func removePipe(path string) {}
+
+// openPipe creates a pipe instance and waits until a reader connects to it
+func openPipe(path string, done <-chan struct{}) (io.WriteCloser, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(name)), pipeAccessOutbound, pipeTypeByte,
+		1, pipeOutBufferSize, 0, pipeUnlimitedWaitMS, 0)
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		return nil, err
+	}
+	handle := syscall.Handle(h)
+
+	connected := make(chan error, 1)
+	go func() {
+		r, _, err := procConnectNamedPipe.Call(h, 0)
+		if r == 0 && err != errorPipeConnected {
+			connected <- err
+			return
+		}
+		connected <- nil
+	}()
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			syscall.CloseHandle(handle)
+			return nil, err
+		}
+		return &windowsPipe{File: os.NewFile(uintptr(h), path), handle: handle}, nil
+	case <-done:
+		// 待機中のConnectNamedPipeは自分で接続して終わらせる
+		if f, err := os.OpenFile(path, os.O_RDONLY, 0); err == nil {
+			f.Close()
+		}
+		<-connected
+		syscall.CloseHandle(handle)
+		return nil, errOutputClosed
+	}
+}
+
+// windowsPipe disconnects the reader before closing the pipe instance
+type windowsPipe struct {
+	*os.File
+	handle syscall.Handle
+}
+
+func (p *windowsPipe) Close() error {
+	procDisconnectNamedPipe.Call(uintptr(p.handle))
+	return p.File.Close()
+}
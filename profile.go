@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"reflect"
+
+	"github.com/gen2brain/malgo"
+)
+
+// audioSettings is what one run of the capture pipeline uses, resolved from
+// the active profile and the audio / encoder sections
+type audioSettings struct {
+	profile       string
+	devices       []ProfileDevice
+	bufferPeriods int
+	encoder       EncoderConfig
+	stereo        StereoConfig // 再起動せずに変更できる
+	dsp           DSPConfig    // 同上
+}
+
+// resolveAudioSettings returns the pipeline settings of a profile.
+// deviceName is the device selected at startup, used when the profile has no devices.
+func resolveAudioSettings(cfg *Config, profile, deviceName string) audioSettings {
+	settings := audioSettings{
+		profile:       defaultProfileName,
+		devices:       []ProfileDevice{{Name: deviceName}},
+		bufferPeriods: cfg.Audio.BufferPeriods,
+		encoder:       cfg.Encoder,
+		stereo:        cfg.Audio.Stereo,
+		dsp:           cfg.Audio.DSP,
+	}
+
+	p, ok := cfg.Profiles[profile]
+	if !ok {
+		return settings
+	}
+	settings.profile = profile
+	if len(p.Devices) > 0 {
+		settings.devices = p.Devices
+	}
+	if p.BufferPeriods != 0 {
+		settings.bufferPeriods = p.BufferPeriods
+	}
+	if p.Encoder != nil {
+		settings.encoder = *p.Encoder
+	}
+	if p.Stereo != nil {
+		settings.stereo = *p.Stereo
+	}
+	if p.DSP != nil {
+		settings.dsp = *p.DSP
+	}
+	return settings
+}
+
+// audioSettingsLocked returns the settings of the next pipeline run: those of
+// the active profile with the changes made from the chat. botState must be locked.
+func (b *BotState) audioSettingsLocked() audioSettings {
+	settings := resolveAudioSettings(config, b.profile, b.audioDeviceName)
+	if b.stereoOverride != nil {
+		settings.stereo = *b.stereoOverride
+	}
+	if b.dspOverride != nil {
+		settings.dsp = b.dspOverride.clone()
+	}
+	return settings
+}
+
+// needsRestart reports whether switching from a to b restarts the pipeline.
+// The stereo and DSP settings are applied to the running pipeline instead.
+func (a audioSettings) needsRestart(b audioSettings) bool {
+	a.stereo, b.stereo = StereoConfig{}, StereoConfig{}
+	a.dsp, b.dsp = DSPConfig{}, DSPConfig{}
+	return !reflect.DeepEqual(a, b)
+}
+
+// joinProfile returns the profile to use when joining a guild:
+// the guild's default profile, then audio.profile
+func joinProfile(cfg *Config, guildID string) string {
+	if name := guildSettings.Get(guildID).Profile; name != "" {
+		if _, ok := cfg.Profiles[name]; ok {
+			return name
+		}
+		slog.Warn("Profile of the guild is not defined, using audio.profile", "profile", name, "guild", guildID)
+	}
+	return cfg.Audio.Profile
+}
+
+// describeDevice formats a profile device for logs and chat
+func describeDevice(device ProfileDevice) string {
+	name := device.Name
+	switch device.Mode {
+	case "http":
+		name = device.URL
+	case "tcp", "udp":
+		format := device.Format
+		if format == "" {
+			format = "pcm"
+		}
+		name = fmt.Sprintf("%s %s", device.Listen, format)
+	}
+	if name == "" {
+		name = "default device"
+	}
+	mode := device.Mode
+	if mode == "" {
+		mode = "loopback"
+	}
+	if device.Volume != 0 && device.Volume != 100 {
+		return fmt.Sprintf("%s (%s, %d%%)", name, mode, device.Volume)
+	}
+	return fmt.Sprintf("%s (%s)", name, mode)
+}
+
+// captureBackend opens the capture devices of one pipeline run. Every device
+// calls onPCM with its index and 48kHz stereo S16 chunks until stop is called.
+// Tests replace openCapture with a synthetic source.
+type captureBackend func(devices []ProfileDevice, bufferPeriods int, onPCM func(index int, pcm []int16)) (stop func(), err error)
+
+// openCapture is the capture backend of the stream
+var openCapture captureBackend = openSources
+
+// openMalgoCapture opens the devices with malgo (WASAPI loopback, ALSA, ...)
+func openMalgoCapture(sources []ProfileDevice, bufferPeriods int, onPCM func(index int, pcm []int16)) (func(), error) {
+	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize malgo context: %v", err)
+	}
+
+	var devices []*malgo.Device
+	stop := func() {
+		for _, device := range devices {
+			device.Stop()
+			device.Uninit()
+		}
+		_ = ctx.Uninit()
+		ctx.Free()
+	}
+
+	for i, source := range sources {
+		index := i
+		device, err := startCaptureDevice(ctx, source, bufferPeriods, func(pcm []int16) { onPCM(index, pcm) })
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return stop, nil
+}
+
+// startCaptureDevice opens one capture source in its native format and calls
+// onPCM with every chunk converted to 48kHz stereo S16
+func startCaptureDevice(ctx *malgo.AllocatedContext, source ProfileDevice, bufferPeriods int, onPCM func(pcm []int16)) (*malgo.Device, error) {
+	const frameSize = 960 // 20ms at 48kHz
+
+	// マイクやライン入力は通常のキャプチャ、それ以外は再生デバイスのループバック
+	deviceType := malgo.Loopback
+	if source.Mode == "capture" {
+		deviceType = malgo.Capture
+	}
+
+	// 形式・チャンネル数・サンプルレートはデバイスのネイティブ形式のまま取得し、
+	// 48kHz/ステレオ/S16への変換はaudioConverterで行う
+	deviceConfig := malgo.DefaultDeviceConfig(deviceType)
+	deviceConfig.Capture.Format = malgo.FormatUnknown
+	deviceConfig.Capture.Channels = 0
+	deviceConfig.SampleRate = 0
+	deviceConfig.Alsa.NoMMap = 1
+
+	// 低遅延設定：1フレーム (20ms) と同じ長さに設定（サンプルレートに依存しないようミリ秒で指定）
+	deviceConfig.PeriodSizeInMilliseconds = uint32(frameSize * 1000 / outputSampleRate)
+	deviceConfig.Periods = uint32(bufferPeriods)
+
+	// デバイス名が指定されている場合、そのデバイスを探す
+	if source.Name != "" {
+		var info *malgo.DeviceInfo
+		var err error
+		if deviceType == malgo.Capture {
+			info, err = findCaptureDeviceByName(ctx, source.Name)
+		} else {
+			info, err = findDeviceByName(ctx, source.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to find device '%s': %v", source.Name, err)
+		}
+		deviceConfig.Capture.DeviceID = info.ID.Pointer()
+	}
+
+	// フォーマット変換器（デバイス初期化後にネイティブ形式が確定してから作成）
+	var converter *audioConverter
+	volume := source.Volume
+
+	callbacks := malgo.DeviceCallbacks{
+		Data: func(pOutputSample, pInputSamples []byte, framecount uint32) {
+			if converter == nil {
+				return
+			}
+			pcm := converter.Process(pInputSamples)
+			if volume != 0 && volume != 100 {
+				applyGain(pcm, volume)
+			}
+			onPCM(pcm)
+		},
+	}
+
+	device, err := malgo.InitDevice(ctx.Context, deviceConfig, callbacks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize capture device: %v", err)
+	}
+
+	// デバイスが実際に使用するネイティブ形式に合わせて変換器を作成
+	converter, err = newAudioConverter(device.CaptureFormat(), int(device.CaptureChannels()), int(device.SampleRate()))
+	if err != nil {
+		device.Uninit()
+		return nil, fmt.Errorf("failed to create audio converter: %v", err)
+	}
+	log.Printf("Capture source: %s, format: %s", describeDevice(source), converter.Describe())
+
+	if err := device.Start(); err != nil {
+		device.Uninit()
+		return nil, fmt.Errorf("failed to start capture device: %v", err)
+	}
+	return device, nil
+}
+
+// findCaptureDeviceByName finds a capture (input) device by its name
+func findCaptureDeviceByName(ctx *malgo.AllocatedContext, deviceName string) (*malgo.DeviceInfo, error) {
+	infos, err := ctx.Devices(malgo.Capture)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %v", err)
+	}
+
+	for _, info := range infos {
+		if info.Name() == deviceName {
+			return &info, nil
+		}
+	}
+
+	return nil, fmt.Errorf("capture device not found: %s", deviceName)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 録音フレームのキュー長（20ms × 250 = 5秒分）
+	recorderQueueSize = 250
+
+	frameDuration = 20 * time.Millisecond
+
+	// wavMaxFileBytes is the rotation size of WAV files whatever max_size_mb is:
+	// the RIFF header stores the sizes as 32-bit values (about 6 hours of audio)
+	wavMaxFileBytes = 4000 * 1024 * 1024
+)
+
+// recordedFrame is a copy of one outgoing frame queued for writing
+type recordedFrame struct {
+	pcm  []int16
+	opus []byte
+}
+
+// recordingFile is a single output file of a recording
+type recordingFile interface {
+	Write(frame recordedFrame) error
+	Size() int64
+	Close() error
+}
+
+// streamRecorder tees the outgoing stream into rotated files on disk
+type streamRecorder struct {
+	dir         string
+	format      string
+	maxDuration time.Duration
+	maxBytes    int64
+
+	frames chan recordedFrame
+	done   chan struct{}
+
+	// 受信モード時の話者ごとのトラック（無効時はnil）
+	voices *voiceTrackRecorder
+
+	mu      sync.Mutex
+	files   []string
+	started time.Time
+	dropped int
+}
+
+// newStreamRecorder creates the recordings directory and starts the writer goroutine
+func newStreamRecorder(dir, format string, maxDuration time.Duration, maxBytes int64) (*streamRecorder, error) {
+	format = strings.ToLower(format)
+	if format != "ogg" && format != "wav" {
+		return nil, fmt.Errorf("unsupported recording format: %s (use ogg or wav)", format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recordings directory: %v", err)
+	}
+
+	// WAVは4GiBを超えるとヘッダーのサイズが壊れるので、制限なしでも必ず分割する
+	if format == "wav" && (maxBytes <= 0 || maxBytes > wavMaxFileBytes) {
+		maxBytes = wavMaxFileBytes
+	}
+
+	r := &streamRecorder{
+		dir:         dir,
+		format:      format,
+		maxDuration: maxDuration,
+		maxBytes:    maxBytes,
+		frames:      make(chan recordedFrame, recorderQueueSize),
+		done:        make(chan struct{}),
+		started:     time.Now(),
+	}
+
+	// 最初のファイルはここで作成してエラーを呼び出し元に返す
+	file, err := r.openFile()
+	if err != nil {
+		return nil, err
+	}
+	go r.run(file)
+	return r, nil
+}
+
+// WriteFrame queues a copy of the frame without blocking the audio callback
+func (r *streamRecorder) WriteFrame(pcm []int16, opus []byte) {
+	frame := recordedFrame{
+		pcm:  append([]int16(nil), pcm...),
+		opus: append([]byte(nil), opus...),
+	}
+	select {
+	case r.frames <- frame:
+	default:
+		r.mu.Lock()
+		r.dropped++
+		r.mu.Unlock()
+	}
+}
+
+// Stop flushes queued frames, closes the current file and returns all written files
+func (r *streamRecorder) Stop() []string {
+	close(r.frames)
+	<-r.done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dropped > 0 {
+		slog.Warn("Recorder dropped frames (disk too slow?)", "frames", r.dropped)
+	}
+	return append([]string(nil), r.files...)
+}
+
+// CurrentFile returns the path of the file currently being written
+func (r *streamRecorder) CurrentFile() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.files) == 0 {
+		return ""
+	}
+	return r.files[len(r.files)-1]
+}
+
+// Elapsed returns the time since recording started
+func (r *streamRecorder) Elapsed() time.Duration {
+	return time.Since(r.started)
+}
+
+// run writes queued frames and rotates files by size/duration
+func (r *streamRecorder) run(file recordingFile) {
+	defer close(r.done)
+
+	var fileDuration time.Duration
+	for frame := range r.frames {
+		// ローテーション条件を満たしたら新しいファイルに切り替える
+		// （サイズは書き込む前に判定し、WAVのサイズ上限を超えないようにする）
+		if fileDuration > 0 && ((r.maxDuration > 0 && fileDuration >= r.maxDuration) ||
+			(r.maxBytes > 0 && file.Size()+r.frameBytes(frame) > r.maxBytes)) {
+			if err := file.Close(); err != nil {
+				slog.Warn("Failed to close recording", "error", err)
+			}
+			next, err := r.openFile()
+			if err != nil {
+				slog.Error("Failed to rotate recording, stopping recorder", "error", err)
+				file = nil
+				break
+			}
+			file = next
+			fileDuration = 0
+		}
+
+		if err := file.Write(frame); err != nil {
+			slog.Error("Failed to write recording, stopping recorder", "error", err)
+			break
+		}
+		fileDuration += frameDuration
+	}
+
+	if file != nil {
+		if err := file.Close(); err != nil {
+			slog.Warn("Failed to close recording", "error", err)
+		}
+	}
+
+	// 書き込みエラーで抜けた場合もキューを空にしてWriteFrameを詰まらせない
+	for range r.frames {
+	}
+}
+
+// frameBytes is how much a frame adds to a file of the recording format
+// (for Ogg without the page headers)
+func (r *streamRecorder) frameBytes(frame recordedFrame) int64 {
+	if r.format == "wav" {
+		return int64(len(frame.pcm)) * 2
+	}
+	return int64(len(frame.opus))
+}
+
+// openFile creates a new timestamped recording file
+func (r *streamRecorder) openFile() (recordingFile, error) {
+	timestamp := time.Now().Format("20060102_150405")
+	path := filepath.Join(r.dir, fmt.Sprintf("consonance_%s.%s", timestamp, r.format))
+	// 同時に始まった録音と同じ名前にならないよう、存在しない場合だけ作る
+	var f *os.File
+	var err error
+	for i := 1; ; i++ {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create recording file: %v", err)
+		}
+		path = filepath.Join(r.dir, fmt.Sprintf("consonance_%s_%d.%s", timestamp, i, r.format))
+	}
+
+	var file recordingFile
+	if r.format == "wav" {
+		file, err = newWAVFile(f)
+	} else {
+		file, err = newOggFile(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.files = append(r.files, path)
+	r.mu.Unlock()
+
+	log.Printf("Recording to %s", path)
+	return file, nil
+}
+
+// oggFile stores the exact Opus packets sent to Discord
+type oggFile struct {
+	f   *os.File
+	ogg *oggOpusWriter
+}
+
+func newOggFile(f *os.File) (*oggFile, error) {
+	ogg, err := newOggOpusWriter(f, outputChannels)
+	if err != nil {
+		return nil, err
+	}
+	return &oggFile{f: f, ogg: ogg}, nil
+}
+
+func (o *oggFile) Write(frame recordedFrame) error {
+	return o.ogg.WritePacket(frame.opus, len(frame.pcm)/outputChannels)
+}
+
+func (o *oggFile) Size() int64 {
+	return o.ogg.Written()
+}
+
+func (o *oggFile) Close() error {
+	if err := o.ogg.Close(); err != nil {
+		o.f.Close()
+		return err
+	}
+	return o.f.Close()
+}
+
+// wavFile stores the PCM frames that were encoded for Discord
+type wavFile struct {
+	f         *os.File
+	dataBytes int64
+	buf       []byte
+}
+
+const wavHeaderSize = 44
+
+func newWAVFile(f *os.File) (*wavFile, error) {
+	w := &wavFile{f: f}
+	// サイズは後で書き換えるのでまずは0で書いておく
+	if _, err := f.Write(w.header()); err != nil {
+		return nil, fmt.Errorf("failed to write wav header: %v", err)
+	}
+	return w, nil
+}
+
+func (w *wavFile) header() []byte {
+	const bitsPerSample = 16
+	blockAlign := outputChannels * bitsPerSample / 8
+
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+w.dataBytes))
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], outputChannels)
+	binary.LittleEndian.PutUint32(h[24:], outputSampleRate)
+	binary.LittleEndian.PutUint32(h[28:], uint32(outputSampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(h[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(h[34:], bitsPerSample)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(w.dataBytes))
+	return h
+}
+
+func (w *wavFile) Write(frame recordedFrame) error {
+	return w.writeSamples(frame.pcm)
+}
+
+// writeSamples appends interleaved stereo samples to the data chunk
+func (w *wavFile) writeSamples(pcm []int16) error {
+	// 話者ごとのトラックは分割しないので、上限に達したらヘッダーが壊れる前に止める
+	if w.dataBytes+int64(len(pcm))*2 > wavMaxFileBytes {
+		return fmt.Errorf("wav file reached the size limit of %d MB", wavMaxFileBytes/1024/1024)
+	}
+	w.buf = w.buf[:0]
+	for _, s := range pcm {
+		w.buf = binary.LittleEndian.AppendUint16(w.buf, uint16(s))
+	}
+	n, err := w.f.Write(w.buf)
+	w.dataBytes += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write wav data: %v", err)
+	}
+	return nil
+}
+
+// wavSilenceChunk is 20ms of stereo silence, written repeatedly to fill gaps
+var wavSilenceChunk = make([]byte, 960*outputChannels*2)
+
+// writeSilence appends frames samples per channel of silence in fixed-size
+// chunks, so that a long gap does not need a buffer of its whole length
+func (w *wavFile) writeSilence(frames int64) error {
+	remaining := frames * outputChannels * 2
+	if w.dataBytes+remaining > wavMaxFileBytes {
+		return fmt.Errorf("wav file reached the size limit of %d MB", wavMaxFileBytes/1024/1024)
+	}
+	for remaining > 0 {
+		chunk := wavSilenceChunk[:min(remaining, int64(len(wavSilenceChunk)))]
+		n, err := w.f.Write(chunk)
+		w.dataBytes += int64(n)
+		if err != nil {
+			return fmt.Errorf("failed to write wav data: %v", err)
+		}
+		remaining -= int64(n)
+	}
+	return nil
+}
+
+func (w *wavFile) Size() int64 {
+	return wavHeaderSize + w.dataBytes
+}
+
+func (w *wavFile) Close() error {
+	// 確定したサイズでヘッダーを書き直す
+	if _, err := w.f.WriteAt(w.header(), 0); err != nil {
+		w.f.Close()
+		return fmt.Errorf("failed to update wav header: %v", err)
+	}
+	return w.f.Close()
+}
+
+// startRecording starts teeing the outgoing stream to disk.
+// The files are opened outside botState's lock; only the sink is swapped under it.
+func startRecording(format string) (*streamRecorder, error) {
+	botState.RLock()
+	cfg := config
+	busy := botState.recorder != nil
+	receiving := botState.receiver != nil
+	guildID := botState.guildID
+	botState.RUnlock()
+
+	if busy {
+		return nil, fmt.Errorf("already recording")
+	}
+
+	if format == "" {
+		format = cfg.Recording.Format
+	}
+
+	rec, err := newStreamRecorder(cfg.Recording.Dir, format,
+		time.Duration(cfg.Recording.MaxMinutes)*time.Minute,
+		int64(cfg.Recording.MaxSizeMB)*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+
+	// 受信モードなら話者ごとのトラックも同じタイムラインで録音する
+	if receiving {
+		voiceDir := strings.TrimSuffix(rec.CurrentFile(), filepath.Ext(rec.CurrentFile())) + "_voices"
+		voices, err := newVoiceTrackRecorder(voiceDir, guildID, rec.started)
+		if err != nil {
+			slog.Warn("Failed to start voice track recording", "error", err)
+		} else {
+			rec.voices = voices
+		}
+	}
+
+	botState.Lock()
+	// 準備している間に別の録音が始まっていたら、こちらは破棄する
+	if botState.recorder != nil {
+		botState.Unlock()
+		rec.discard()
+		return nil, fmt.Errorf("already recording")
+	}
+	botState.recorder = rec
+	if botState.receiver != nil && rec.voices != nil {
+		botState.receiver.SetTracks(rec.voices)
+	}
+	frameSinks.Add("recorder", rec)
+	botState.Unlock()
+
+	log.Printf("Recording started (%s)", format)
+	return rec, nil
+}
+
+// discard stops a recorder that never received frames and removes its files
+func (r *streamRecorder) discard() {
+	if r.voices != nil {
+		r.voices.Close()
+		os.Remove(r.voices.dir)
+	}
+	for _, file := range r.Stop() {
+		os.Remove(file)
+	}
+}
+
+// stopRecording stops the current recording and returns the written files
+func stopRecording() ([]string, error) {
+	botState.Lock()
+	rec := botState.recorder
+	botState.recorder = nil
+	botState.Unlock()
+
+	if rec == nil {
+		return nil, fmt.Errorf("not recording")
+	}
+
+	frameSinks.Remove("recorder")
+	if rec.voices != nil {
+		botState.RLock()
+		if botState.receiver != nil {
+			botState.receiver.SetTracks(nil)
+		}
+		botState.RUnlock()
+		rec.voices.Close()
+	}
+	files := rec.Stop()
+	log.Printf("Recording stopped (%d file(s))", len(files))
+	return files, nil
+}
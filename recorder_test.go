@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWAVRecordingRotatesBelow4GiB(t *testing.T) {
+	for _, maxBytes := range []int64{0, 8 << 30} {
+		r, err := newStreamRecorder(t.TempDir(), "wav", time.Hour, maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Stop()
+		if r.maxBytes != wavMaxFileBytes {
+			t.Errorf("max %d: rotates at %d, want %d", maxBytes, r.maxBytes, wavMaxFileBytes)
+		}
+	}
+}
+
+func TestWAVRecordingRotatesBeforeTheLimit(t *testing.T) {
+	// 1フレーム 3840 バイトなので、10000 バイトまでに2フレームずつ入る
+	const maxBytes = 10000
+	r, err := newStreamRecorder(t.TempDir(), "wav", time.Hour, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := sineFrame(0, 0.5)
+	for i := 0; i < 5; i++ {
+		r.WriteFrame(frame, nil)
+	}
+	files := r.Stop()
+	if len(files) != 3 {
+		t.Fatalf("files = %v, want 3", files)
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > maxBytes {
+		t.Errorf("first file is %d bytes, over the limit of %d", len(data), maxBytes)
+	}
+	dataBytes := uint32(2 * len(frame) * 2)
+	if string(data[0:4]) != "RIFF" || string(data[36:40]) != "data" {
+		t.Fatalf("first file has no WAV header")
+	}
+	if got := binary.LittleEndian.Uint32(data[4:]); got != 36+dataBytes {
+		t.Errorf("RIFF size = %d, want %d", got, 36+dataBytes)
+	}
+	if got := binary.LittleEndian.Uint32(data[40:]); got != dataBytes || len(data) != wavHeaderSize+int(dataBytes) {
+		t.Errorf("data size = %d in a %d byte file, want %d", got, len(data), dataBytes)
+	}
+}
+
+func TestRecordingStartsOnceWhenStartedTwiceAtOnce(t *testing.T) {
+	setupTestBot(t, nil)
+
+	// 両方ともロックの外でファイルを開き、後から来た方が破棄される
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = startRecording("wav")
+		}(i)
+	}
+	wg.Wait()
+
+	started := 0
+	for _, err := range errs {
+		if err == nil {
+			started++
+		} else if err.Error() != "already recording" {
+			t.Errorf("startRecording: %v", err)
+		}
+	}
+	if started != 1 {
+		t.Fatalf("%d recordings started, want 1", started)
+	}
+
+	files, err := stopRecording()
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, err := os.ReadDir(config.Recording.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || len(left) != 1 {
+		t.Errorf("recorded %v, %d file(s) left in the directory, want 1", files, len(left))
+	}
+}
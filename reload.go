@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// configWatchInterval is how often the config file is checked for changes
+const configWatchInterval = 2 * time.Second
+
+// configChange is one setting that differs between two configs
+type configChange struct {
+	path   string // e.g. "encoder.bitrate_kbps"
+	from   string
+	to     string
+	effect string // how the change was applied
+}
+
+func (c configChange) String() string {
+	return fmt.Sprintf("%s: %s → %s (%s)", c.path, c.from, c.to, c.effect)
+}
+
+// currentConfig returns the config in effect; safe to call from any goroutine
+func currentConfig() *Config {
+	botState.RLock()
+	defer botState.RUnlock()
+	return config
+}
+
+// diffConfig lists every setting that differs between old and new
+func diffConfig(old, new *Config) []configChange {
+	var changes []configChange
+	diffStruct(reflect.ValueOf(*old), reflect.ValueOf(*new), "", &changes)
+	return changes
+}
+
+func diffStruct(a, b reflect.Value, prefix string, changes *[]configChange) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		path := prefix + key
+
+		if a.Field(i).Kind() == reflect.Struct {
+			diffStruct(a.Field(i), b.Field(i), path+".", changes)
+			continue
+		}
+		if reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+
+		from, to := formatConfigValue(a.Field(i)), formatConfigValue(b.Field(i))
+		switch {
+		case path == "discord.token":
+			// トークンはチャットやログに出さない
+			from, to = "***", "***"
+		case a.Field(i).Kind() == reflect.Map:
+			from, to = "...", "(changed)"
+		}
+		*changes = append(*changes, configChange{path: path, from: from, to: to})
+	}
+}
+
+// formatConfigValue formats a setting for change reports (strings are quoted)
+func formatConfigValue(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return fmt.Sprintf("%q", v.String())
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// reloadConfig re-reads the config file and applies the differences to the
+// running bot. An invalid file is rejected and the current config is kept.
+func reloadConfig() ([]configChange, error) {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyEnvironment(cfg); err != nil {
+		return nil, err
+	}
+
+	botState.Lock()
+	changes := diffConfig(config, cfg)
+	if len(changes) == 0 {
+		botState.Unlock()
+		return nil, nil
+	}
+
+	// パイプラインの設定（使用中のプロファイルを反映したもの）が変わったら再起動する
+	oldSettings := resolveAudioSettings(config, botState.profile, botState.audioDeviceName)
+
+	restartReceiver := false
+	restartServer := false
+	restartOutputs := false
+	for i := range changes {
+		c := &changes[i]
+		switch {
+		case c.path == "discord.token" || c.path == "discord.token_file":
+			// ログイン中のセッションはそのまま使う
+			cfg.Discord.Token = config.Discord.Token
+			cfg.Discord.TokenFile = config.Discord.TokenFile
+			c.effect = "restart required"
+		case c.path == "discord.guild_id" || c.path == "discord.channel_id":
+			c.effect = "used on next start"
+		case c.path == "audio.device_name":
+			// 空にした場合は起動時に選んだデバイスをそのまま使う
+			if cfg.Audio.DeviceName == "" || cfg.Audio.DeviceName == botState.audioDeviceName {
+				c.effect = "current device kept"
+				break
+			}
+			botState.audioDeviceName = cfg.Audio.DeviceName
+			c.effect = "pipeline restarted"
+		case c.path == "audio.buffer_periods" || strings.HasPrefix(c.path, "encoder.") || c.path == "profiles":
+			c.effect = "pipeline restarted"
+		case c.path == "audio.profile":
+			c.effect = "takes effect on next join"
+		case c.path == "audio.return_device_name":
+			c.effect = "two-way playback restarted"
+			restartReceiver = true
+		case c.path == "logging.level":
+			logLevel.Set(logLevels[cfg.Logging.Level])
+			c.effect = "applied"
+		case strings.HasPrefix(c.path, "logging."):
+			c.effect = "used on next start"
+		case strings.HasPrefix(c.path, "stream_server."):
+			c.effect = "HTTP stream server restarted"
+			restartServer = true
+		case strings.HasPrefix(c.path, "levels."):
+			levels.Configure(cfg.Levels)
+			c.effect = "applied"
+		case strings.HasPrefix(c.path, "outputs."):
+			c.effect = "PCM outputs restarted"
+			restartOutputs = true
+		case strings.HasPrefix(c.path, "audio.stereo.") && botState.stereoOverride != nil:
+			// "@Bot stereo" で変更した設定を優先する
+			c.effect = "used after stereo reset"
+		case strings.HasPrefix(c.path, "audio.dsp.") && botState.dspOverride != nil:
+			c.effect = "used after dsp reset"
+		case c.path == "audio.receive_voice" || c.path == "audio.return_audio":
+			// スピーカーミュートの有無は参加時に決まる
+			c.effect = "takes effect on next join"
+		default:
+			c.effect = "applied"
+		}
+	}
+
+	config = cfg
+
+	// 使用中のプロファイルが削除された場合は基本の設定に戻す
+	if _, ok := cfg.Profiles[botState.profile]; !ok && botState.profile != "" {
+		slog.Warn("Active profile was removed, switching to the default", "profile", botState.profile)
+		botState.profile = ""
+	}
+	newSettings := resolveAudioSettings(cfg, botState.profile, botState.audioDeviceName)
+	restartPipeline := oldSettings.needsRestart(newSettings)
+
+	// 接続していなければ次の参加時に新しい設定で開始される
+	pipelineRunning := botState.state == stateStreaming
+	playbackRunning := botState.voiceConnection != nil && botState.receiver != nil && botState.receiver.playback != nil
+	for i := range changes {
+		switch {
+		case changes[i].effect == "pipeline restarted" && !restartPipeline:
+			// 使用中のプロファイルが上書きしている設定は配信に影響しない
+			changes[i].effect = "applied"
+		case changes[i].effect == "pipeline restarted" && !pipelineRunning,
+			changes[i].effect == "two-way playback restarted" && !playbackRunning:
+			changes[i].effect = "takes effect on next join"
+		}
+	}
+	if pipelineRunning && !restartPipeline && newSettings.stereo != oldSettings.stereo && botState.stereoOverride == nil {
+		// ステレオ設定は配信を止めずに反映する（コマンドで変更中はそちらを優先）
+		stereoTools.Set(newSettings.stereo)
+	}
+	if pipelineRunning && !restartPipeline && !reflect.DeepEqual(newSettings.dsp, oldSettings.dsp) && botState.dspOverride == nil {
+		audioDSP.Set(newSettings.dsp)
+	}
+	restartPlayback := func() error { return nil }
+	if restartReceiver && playbackRunning {
+		restartPlayback = restartReceiverLocked()
+	}
+	botState.Unlock()
+
+	// 再生デバイスの初期化はロックの外で行う（失敗はログに出る）
+	restartPlayback()
+
+	// 古いパイプラインの停止はロックの外で待つ
+	if restartPipeline && pipelineRunning {
+		log.Println("Restarting audio pipeline to apply config changes...")
+		restartStreaming()
+	}
+
+	if restartServer {
+		if err := applyStreamServerConfig(cfg.StreamServer); err != nil {
+			slog.Warn("Failed to restart the HTTP stream server", "error", err)
+		}
+	}
+	if restartOutputs {
+		if err := applyOutputsConfig(cfg.Outputs); err != nil {
+			slog.Warn("Failed to restart the PCM outputs", "error", err)
+		}
+	}
+
+	for _, c := range changes {
+		log.Printf("Config reloaded: %s", c)
+	}
+	return changes, nil
+}
+
+// restartReceiverLocked detaches the voice receiver so that the two-way
+// playback can be restarted with the current return device and profile.
+// botState must be locked; call the returned function after unlocking to stop
+// the old receiver and start the new one. It returns why the playback could
+// not be started, e.g. because the return device is a loopback source of the profile.
+func restartReceiverLocked() (restart func() error) {
+	vc := botState.voiceConnection
+	old := botState.receiver
+	botState.receiver = nil
+	deviceName := config.Audio.ReturnDeviceName
+	devices := resolveAudioSettings(config, botState.profile, botState.audioDeviceName).devices
+
+	return func() error {
+		old.Stop()
+		playback, err := startReturnPlayback(deviceName, devices)
+		if err != nil {
+			slog.Error("Failed to restart two-way mode", "error", err)
+		}
+		receiver := startVoiceReceiver(vc, playback)
+
+		botState.Lock()
+		// 待っている間に退出・移動していたら付け替えない
+		attached := botState.voiceConnection == vc && botState.receiver == nil
+		if attached {
+			botState.receiver = receiver
+			// 録音中なら話者ごとのトラックを引き継ぐ
+			if botState.recorder != nil && botState.recorder.voices != nil {
+				receiver.SetTracks(botState.recorder.voices)
+			}
+		}
+		botState.Unlock()
+		if !attached {
+			receiver.Stop()
+		}
+		return err
+	}
+}
+
+// watchConfigFile reloads the config whenever the file changes, until ctx is cancelled
+func watchConfigFile(ctx context.Context) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(configPath); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(configPath)
+		if err != nil || (info.ModTime().Equal(lastMod) && info.Size() == lastSize) {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+
+		log.Printf("%s changed, reloading...", configPath)
+		if _, err := reloadConfig(); err != nil {
+			slog.Warn("Config not reloaded, keeping the current settings", "error", err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyReloadSignal does nothing on Windows, which has no SIGHUP;
+// use the file watcher or "@Bot reload" instead
+func notifyReloadSignal(c chan<- os.Signal) {}
@@ -0,0 +1,41 @@
+package main
+
+import "sync"
+
+// frameSink receives a copy of every audio frame that is sent to Discord.
+// WriteFrame is called from the audio callback, so implementations must not block.
+type frameSink interface {
+	WriteFrame(pcm []int16, opus []byte)
+}
+
+// sinkSet is a set of named frame sinks that can be changed while streaming
+type sinkSet struct {
+	sync.RWMutex
+	sinks map[string]frameSink
+}
+
+// frameSinks holds the additional outputs attached to the outgoing stream
+var frameSinks = &sinkSet{sinks: make(map[string]frameSink)}
+
+// Add registers a sink under the given name, replacing any existing one
+func (s *sinkSet) Add(name string, sink frameSink) {
+	s.Lock()
+	defer s.Unlock()
+	s.sinks[name] = sink
+}
+
+// Remove unregisters the sink with the given name
+func (s *sinkSet) Remove(name string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sinks, name)
+}
+
+// Dispatch passes a frame to every registered sink
+func (s *sinkSet) Dispatch(pcm []int16, opus []byte) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, sink := range s.sinks {
+		sink.WriteFrame(pcm, opus)
+	}
+}
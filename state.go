@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// connState is the state of the bot's voice connection
+type connState int
+
+const (
+	stateIdle         connState = iota // 未接続
+	stateJoining                       // 参加してVoiceの準備完了を待っている
+	stateReady                         // 接続済みで配信していない
+	stateStreaming                     // 配信中
+	stateReconnecting                  // Voiceの接続が切れ、discordgoが再接続している
+	stateLeaving                       // 配信を止めて切断している
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateIdle:
+		return "Idle"
+	case stateJoining:
+		return "Joining"
+	case stateReady:
+		return "Ready"
+	case stateStreaming:
+		return "Streaming"
+	case stateReconnecting:
+		return "Reconnecting"
+	case stateLeaving:
+		return "Leaving"
+	}
+	return fmt.Sprintf("connState(%d)", int(s))
+}
+
+// stateTransitions lists the states each state may change to
+var stateTransitions = map[connState][]connState{
+	stateIdle:         {stateJoining},
+	stateJoining:      {stateReady, stateIdle, stateLeaving},
+	stateReady:        {stateStreaming, stateReconnecting, stateLeaving},
+	stateStreaming:    {stateReady, stateReconnecting, stateLeaving},
+	stateReconnecting: {stateReady, stateStreaming, stateLeaving},
+	stateLeaving:      {stateIdle},
+}
+
+// stateChange is one transition of the voice connection, caused by event
+type stateChange struct {
+	from  connState
+	to    connState
+	event string
+}
+
+func (c stateChange) String() string {
+	return fmt.Sprintf("%s → %s (%s)", c.from, c.to, c.event)
+}
+
+// voiceMonitorInterval is how often the voice connection is checked for reconnects
+const voiceMonitorInterval = 250 * time.Millisecond
+
+// transitionLocked changes the connection state if the transition is allowed
+// and notifies the observers. botState must be locked.
+func (b *BotState) transitionLocked(to connState, event string) bool {
+	from := b.state
+	allowed := false
+	for _, next := range stateTransitions[from] {
+		if next == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	b.state = to
+	change := stateChange{from: from, to: to, event: event}
+	log.Printf("Voice state: %s", change)
+	for ch := range b.observers {
+		// 観測側が詰まっても状態遷移は止めない
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+	return true
+}
+
+// State returns the current connection state
+func (b *BotState) State() connState {
+	b.RLock()
+	defer b.RUnlock()
+	return b.state
+}
+
+// ObserveState returns a channel receiving every state change; cancel closes it
+func (b *BotState) ObserveState() (changes <-chan stateChange, cancel func()) {
+	ch := make(chan stateChange, 32)
+	b.Lock()
+	b.observers[ch] = struct{}{}
+	b.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.Lock()
+			delete(b.observers, ch)
+			close(ch)
+			b.Unlock()
+		})
+	}
+}
+
+// streamRunningLocked reports whether the capture pipeline is running. botState must be locked.
+func (b *BotState) streamRunningLocked() bool {
+	if b.streamDone == nil {
+		return false
+	}
+	select {
+	case <-b.streamDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// restartStreaming restarts the pipeline with the current settings.
+// The old pipeline is stopped without holding botState's lock.
+func restartStreaming() {
+	botState.Lock()
+	if botState.state != stateStreaming {
+		botState.Unlock()
+		return
+	}
+	vc := botState.voiceConnection
+	wait := stopStreamingLocked("pipeline restart")
+	// 待っている間に再接続になったら、復帰時に monitorVoice が開始する
+	botState.wantStream = true
+	botState.Unlock()
+
+	wait()
+
+	botState.Lock()
+	defer botState.Unlock()
+	// 待っている間に退出・再接続していたら開始しない
+	if botState.voiceConnection != vc || botState.state != stateReady {
+		return
+	}
+	startStreamingLocked(vc)
+}
+
+// monitorVoice follows the Ready flag of the connection and moves between
+// Reconnecting and Ready/Streaming until ctx is cancelled
+func monitorVoice(ctx context.Context, vc voiceConn) {
+	ticker := time.NewTicker(voiceMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ready := vc.Ready()
+		botState.Lock()
+		if botState.voiceConnection != vc {
+			botState.Unlock()
+			return
+		}
+		switch {
+		case !ready && (botState.state == stateReady || botState.state == stateStreaming):
+			botState.transitionLocked(stateReconnecting, "voice connection lost")
+		case ready && botState.state == stateReconnecting:
+			switch {
+			case botState.streamRunningLocked():
+				botState.transitionLocked(stateStreaming, "voice connection restored")
+			case botState.wantStream:
+				// 切断中に配信が失敗していたら（参加時のタイムアウトを含む）開始し直す
+				botState.transitionLocked(stateReady, "voice connection restored")
+				startStreamingLocked(vc)
+			default:
+				botState.transitionLocked(stateReady, "voice connection restored")
+			}
+		}
+		botState.Unlock()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateTransitionsOfJoinAndLeave(t *testing.T) {
+	setupTestBot(t, nil)
+	states := recordStates(t)
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	leaveVoiceChannel()
+
+	want := []connState{stateJoining, stateReady, stateStreaming, stateLeaving, stateIdle}
+	waitFor(t, time.Second, "transitions", func() bool { return len(states()) >= len(want) })
+	if got := statesOf(states()); !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions = %v, want %v", got, want)
+	}
+}
+
+func TestStateIsReadableWhileJoining(t *testing.T) {
+	tb := setupTestBot(t, nil)
+	tb.gateway.readyAfter = 500 * time.Millisecond
+
+	joined := make(chan error, 1)
+	go func() { joined <- joinVoiceChannel("100", "200") }()
+
+	// 参加待ちの間も状態の読み取りはブロックされない
+	waitFor(t, 200*time.Millisecond, "Joining", func() bool { return botState.State() == stateJoining })
+
+	if err := <-joined; err != nil {
+		t.Fatal(err)
+	}
+	if state := botState.State(); state != stateStreaming {
+		t.Errorf("state after join = %s, want Streaming", state)
+	}
+}
+
+func TestLeaveWhileJoiningCancelsJoin(t *testing.T) {
+	tb := setupTestBot(t, nil)
+	tb.gateway.readyAfter = 5 * time.Second
+
+	joined := make(chan error, 1)
+	go func() { joined <- joinVoiceChannel("100", "200") }()
+	waitFor(t, time.Second, "Joining", func() bool { return botState.State() == stateJoining && len(tb.gateway.Voices()) == 1 })
+
+	leaveVoiceChannel()
+
+	select {
+	case err := <-joined:
+		if err == nil {
+			t.Error("join succeeded after leave")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("join did not notice the leave")
+	}
+	if state := botState.State(); state != stateIdle {
+		t.Errorf("state = %s, want Idle", state)
+	}
+	if !tb.gateway.Voices()[0].Disconnected() {
+		t.Error("cancelled connection was not disconnected")
+	}
+	if len(tb.capture.Opened()) != 0 {
+		t.Error("capture started for a cancelled join")
+	}
+}
+
+func TestStreamFailureReturnsToReady(t *testing.T) {
+	tb := setupTestBot(t, nil)
+	tb.capture.openErr = errCaptureFailed
+	states := recordStates(t)
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, "Ready", func() bool { return botState.State() == stateReady })
+
+	got := states()
+	last := got[len(got)-1]
+	if last.from != stateStreaming || last.event != "stream failed" {
+		t.Errorf("last transition = %s, want Streaming → Ready (stream failed)", last)
+	}
+}
+
+func TestReconnectingFollowsVoiceReady(t *testing.T) {
+	t.Run("connection lost while streaming", func(t *testing.T) {
+		tb := setupTestBot(t, nil)
+
+		if err := joinVoiceChannel("100", "200"); err != nil {
+			t.Fatal(err)
+		}
+		v := tb.gateway.Voices()[0]
+		waitFor(t, 2*time.Second, "frames", func() bool { return len(v.Frames()) >= 5 })
+
+		v.SetReady(false)
+		waitFor(t, time.Second, "Reconnecting", func() bool { return botState.State() == stateReconnecting })
+		v.SetReady(true)
+		waitFor(t, time.Second, "Streaming", func() bool { return botState.State() == stateStreaming })
+	})
+
+	t.Run("ready after the join timeout", func(t *testing.T) {
+		tb := setupTestBot(t, nil)
+		timeout := voiceReadyTimeout
+		voiceReadyTimeout = 100 * time.Millisecond
+		t.Cleanup(func() { voiceReadyTimeout = timeout })
+		tb.gateway.readyAfter = 600 * time.Millisecond
+
+		// タイムアウト後に開始した配信は準備前なので失敗する
+		if err := joinVoiceChannel("100", "200"); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, time.Second, "Reconnecting", func() bool { return botState.State() == stateReconnecting })
+
+		// 接続が戻ったら配信を開始し直す
+		v := tb.gateway.Voices()[0]
+		waitFor(t, 2*time.Second, "Streaming", func() bool { return botState.State() == stateStreaming })
+		waitFor(t, 2*time.Second, "frames", func() bool { return len(v.Frames()) >= 5 })
+	})
+}
+
+func TestInvalidTransitionIsRejected(t *testing.T) {
+	setupTestBot(t, nil)
+
+	botState.Lock()
+	defer botState.Unlock()
+	if botState.transitionLocked(stateStreaming, "test") {
+		t.Error("Idle → Streaming was allowed")
+	}
+	if botState.state != stateIdle {
+		t.Errorf("state = %s, want Idle", botState.state)
+	}
+}
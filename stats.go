@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsWindowFrames is the number of frames (1 second) the level and bitrate are averaged over
+const statsWindowFrames = 50
+
+// meterFloorDB is the lowest level shown by the level meter
+const meterFloorDB = -60.0
+
+// streamStats collects the numbers of the running pipeline for "@Bot status".
+// recordFrame is called from the audio callback for every frame.
+type streamStats struct {
+	mu sync.Mutex
+
+	settings      audioSettings
+	startedAt     time.Time
+	running       bool
+	framesSent    uint64
+	framesDropped uint64
+	queuedFrames  int // OpusSend に溜まっているフレーム数
+	pendingPCM    int // エンコード待ちのサンプル数（1チャンネル分）
+
+	// 現在のウィンドウの集計
+	windowFrames int
+	windowBytes  int
+
+	// 直前のウィンドウ（1秒）の結果
+	bitrateKbps float64
+}
+
+// stats holds the statistics of the current stream
+var stats = &streamStats{}
+
+// statsSnapshot is a copy of the statistics taken under the lock
+type statsSnapshot struct {
+	settings      audioSettings
+	running       bool
+	startedAt     time.Time
+	framesSent    uint64
+	framesDropped uint64
+	bufferLatency time.Duration
+	bitrateKbps   float64
+}
+
+// start resets the statistics for a new pipeline run
+func (st *streamStats) start(settings audioSettings) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.settings = settings
+	st.startedAt = time.Now()
+	st.running = true
+	st.framesSent, st.framesDropped, st.queuedFrames, st.pendingPCM = 0, 0, 0, 0
+	st.windowFrames, st.windowBytes = 0, 0
+	st.bitrateKbps = 0
+}
+
+// stop marks the pipeline as stopped, keeping the counters for the last status
+func (st *streamStats) stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.running = false
+}
+
+// recordFrame adds one encoded frame. sent is false when the frame was dropped,
+// queued is the number of frames waiting in OpusSend and pending the samples
+// per channel not yet encoded. The level is measured by levels, not here.
+func (st *streamStats) recordFrame(opus []byte, sent bool, queued, pending int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if sent {
+		st.framesSent++
+	} else {
+		st.framesDropped++
+	}
+	st.queuedFrames = queued
+	st.pendingPCM = pending
+
+	st.windowFrames++
+	st.windowBytes += len(opus)
+
+	if st.windowFrames < statsWindowFrames {
+		return
+	}
+	seconds := float64(st.windowFrames) * 20 / 1000
+	st.bitrateKbps = float64(st.windowBytes) * 8 / 1000 / seconds
+	st.windowFrames, st.windowBytes = 0, 0
+}
+
+// snapshot returns a copy of the current statistics
+func (st *streamStats) snapshot() statsSnapshot {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// デバイスのバッファ + エンコード待ち + 送信待ちのフレーム
+	frames := st.settings.bufferPeriods + st.queuedFrames
+	latency := time.Duration(frames)*20*time.Millisecond +
+		time.Duration(st.pendingPCM)*time.Second/outputSampleRate
+
+	return statsSnapshot{
+		settings:      st.settings,
+		running:       st.running,
+		startedAt:     st.startedAt,
+		framesSent:    st.framesSent,
+		framesDropped: st.framesDropped,
+		bufferLatency: latency,
+		bitrateKbps:   st.bitrateKbps,
+	}
+}
+
+// toDBFS converts a 16-bit sample amplitude to dBFS
+func toDBFS(amplitude float64) float64 {
+	if amplitude <= 0 {
+		return math.Inf(-1)
+	}
+	return 20 * math.Log10(amplitude/32768)
+}
+
+// formatDB formats a level for display ("-inf" for silence)
+func formatDB(db float64) string {
+	if db < meterFloorDB {
+		return "-inf"
+	}
+	return fmt.Sprintf("%.1f", db)
+}
+
+// levelBar draws a level between meterFloorDB and 0 dBFS as a bar of width characters
+func levelBar(db float64, width int) string {
+	filled := 0
+	if db > meterFloorDB {
+		filled = int(math.Round((db - meterFloorDB) / -meterFloorDB * float64(width)))
+	}
+	if filled > width {
+		filled = width
+	}
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+// formatUptime formats a duration as h:mm:ss
+func formatUptime(d time.Duration) string {
+	d = d.Truncate(time.Second)
+	h := int(d.Hours())
+	m := int(d.Minutes()) % 60
+	s := int(d.Seconds()) % 60
+	return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+}
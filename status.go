@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// statusUpdateInterval is how often "@Bot status live" refreshes the embed
+const statusUpdateInterval = 5 * time.Second
+
+const (
+	statusColorStreaming = 0x2ecc71
+	statusColorIdle      = 0x95a5a6
+)
+
+// buildStatusEmbed creates the status embed of the current connection
+// and returns it with the connection state it shows
+func buildStatusEmbed(s *discordgo.Session, lang string, live bool) (*discordgo.MessageEmbed, connState) {
+	// Discord API の呼び出しはロックの外で行う
+	botState.RLock()
+	state := botState.state
+	connected := botState.voiceConnection != nil
+	channelID := botState.channelID
+	connectedAt := botState.connectedAt
+	botState.RUnlock()
+
+	embed := &discordgo.MessageEmbed{
+		Title:  tr(lang, "status_title"),
+		Color:  statusColorIdle,
+		Footer: &discordgo.MessageEmbedFooter{Text: GetVersionString()},
+	}
+	if live {
+		embed.Footer.Text += " ・ " + tr(lang, "status_live_footer", int(statusUpdateInterval/time.Second))
+	}
+	embed.Timestamp = time.Now().Format(time.RFC3339)
+
+	if !connected {
+		embed.Description = tr(lang, "status_disconnected")
+		if state != stateIdle {
+			embed.Description = tr(lang, stateKey(state))
+		}
+		return embed, state
+	}
+
+	channelName := channelID
+	if ch, err := s.State.Channel(channelID); err == nil {
+		channelName = ch.Name
+	} else if ch, err := s.Channel(channelID); err == nil {
+		channelName = ch.Name
+	}
+
+	snap := stats.snapshot()
+
+	if state == stateStreaming {
+		embed.Color = statusColorStreaming
+	}
+	embed.Description = fmt.Sprintf("🔊 `%s` ・ %s", channelName, tr(lang, stateKey(state)))
+
+	devices := make([]string, len(snap.settings.devices))
+	for i, device := range snap.settings.devices {
+		devices[i] = describeDevice(device)
+	}
+
+	bitrate := fmt.Sprintf("%.0f kbps", snap.bitrateKbps)
+	if target := snap.settings.encoder.BitrateKbps; target > 0 {
+		bitrate += fmt.Sprintf(" (%s %d kbps)", tr(lang, "status_target"), target)
+	}
+
+	embed.Fields = []*discordgo.MessageEmbedField{
+		{Name: tr(lang, "status_uptime"), Value: formatUptime(time.Since(connectedAt)), Inline: true},
+		// 音声接続は自身のpingを報告しないので、Gatewayのものと明記して表示する
+		{Name: tr(lang, "status_gateway_ping"), Value: fmt.Sprintf("%d ms", s.HeartbeatLatency().Milliseconds()), Inline: true},
+		{Name: tr(lang, "status_buffer"), Value: fmt.Sprintf("~%d ms", snap.bufferLatency.Milliseconds()), Inline: true},
+		{Name: tr(lang, "status_bitrate"), Value: bitrate, Inline: true},
+		{Name: tr(lang, "status_frames"), Value: fmt.Sprintf("%d / %d", snap.framesSent, snap.framesDropped), Inline: true},
+		{Name: tr(lang, "status_profile"), Value: "`" + snap.settings.profile + "`", Inline: true},
+		{Name: tr(lang, "status_stereo"), Value: "`" + stereoTools.Get().String() + "`", Inline: true},
+		{Name: tr(lang, "status_dsp"), Value: "`" + audioDSP.Get().String() + "`", Inline: true},
+		{Name: tr(lang, "status_level"), Value: formatStatusLevels(lang, levels.snapshot())},
+		{Name: tr(lang, "status_devices"), Value: "`" + strings.Join(devices, "`\n`") + "`"},
+	}
+	if listeners := streamListenerCount(); listeners >= 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name: tr(lang, "status_listeners"), Value: fmt.Sprintf("%d", listeners), Inline: true,
+		})
+	}
+	return embed, state
+}
+
+// formatStatusLevels shows the level of the last second, each channel and the level alerts
+func formatStatusLevels(lang string, lv levelSnapshot) string {
+	text := fmt.Sprintf("`%s` %s / %s dBFS\n", levelBar(lv.total.peakDB, 20), formatDB(lv.total.peakDB), formatDB(lv.total.rmsDB))
+	for _, ch := range []struct {
+		name  string
+		level channelLevel
+	}{{"L", lv.left}, {"R", lv.right}} {
+		text += fmt.Sprintf("%s `%s` %s / %s\n", ch.name, levelBar(ch.level.peakDB, 18),
+			formatDB(ch.level.peakDB), formatDB(ch.level.rmsDB))
+	}
+	text += tr(lang, "status_clipped", lv.clippedFrames)
+	if lv.clipping {
+		text += "\n" + tr(lang, "status_clipping")
+	}
+	if lv.silent {
+		text += "\n" + tr(lang, "status_silent")
+	}
+	return text
+}
+
+// stateKey returns the message key of a connection state
+func stateKey(state connState) string {
+	return "state_" + strings.ToLower(state.String())
+}
+
+// liveStatusUpdater refreshes one status message until it is stopped
+// or the bot leaves the voice channel
+type liveStatusUpdater struct {
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+var liveStatus = &liveStatusUpdater{}
+
+// Start begins updating the message, replacing any earlier live status
+func (l *liveStatusUpdater) Start(s *discordgo.Session, guildID, channelID, messageID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stop != nil {
+		close(l.stop)
+	}
+	stop := make(chan struct{})
+	l.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(statusUpdateInterval)
+		defer ticker.Stop()
+		defer l.finished(stop)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			lang := replyLanguage(s, guildID)
+			embed, state := buildStatusEmbed(s, lang, true)
+			finished := state == stateIdle
+			if finished {
+				// 退出したら最終状態を表示して終了
+				embed, _ = buildStatusEmbed(s, lang, false)
+			}
+			if _, err := s.ChannelMessageEditEmbed(channelID, messageID, embed); err != nil {
+				slog.Warn("Live status stopped", "error", err)
+				return
+			}
+			if finished {
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the live status; it reports whether one was running
+func (l *liveStatusUpdater) Stop() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stop == nil {
+		return false
+	}
+	close(l.stop)
+	l.stop = nil
+	return true
+}
+
+// finished clears the updater when its goroutine ends by itself
+func (l *liveStatusUpdater) finished(stop chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == stop {
+		l.stop = nil
+	}
+}
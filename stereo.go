@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// stereoModes are the values of stereo.mode
+var stereoModes = []string{"stereo", "swap", "mono", "left", "right"}
+
+// isDefault reports whether the settings leave the audio unchanged
+func (c StereoConfig) isDefault() bool {
+	return (c.Mode == "" || c.Mode == "stereo") && c.Balance == 0 && c.width() == 100
+}
+
+// width returns the stereo width in percent
+func (c StereoConfig) width() int {
+	if c.Width == 0 {
+		return 100
+	}
+	return c.Width
+}
+
+// String formats the settings for logs and chat, e.g. "swap, balance L20, width 80%"
+func (c StereoConfig) String() string {
+	mode := c.Mode
+	if mode == "" {
+		mode = "stereo"
+	}
+	parts := []string{mode}
+	switch {
+	case c.Balance < 0:
+		parts = append(parts, fmt.Sprintf("balance L%d", -c.Balance))
+	case c.Balance > 0:
+		parts = append(parts, fmt.Sprintf("balance R%d", c.Balance))
+	}
+	if c.width() != 100 {
+		parts = append(parts, fmt.Sprintf("width %d%%", c.width()))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// stereoStage rearranges the channels of every frame. The settings are
+// replaced as a whole, so the audio callback reads them without a lock.
+type stereoStage struct {
+	cfg atomic.Pointer[StereoConfig]
+}
+
+// stereoTools is the stereo stage of the stream
+var stereoTools = &stereoStage{}
+
+// Set replaces the settings used from the next frame
+func (st *stereoStage) Set(cfg StereoConfig) {
+	st.cfg.Store(&cfg)
+}
+
+// Get returns the current settings
+func (st *stereoStage) Get() StereoConfig {
+	if cfg := st.cfg.Load(); cfg != nil {
+		return *cfg
+	}
+	return StereoConfig{}
+}
+
+// Process applies the channel mode, the stereo width and the balance to an
+// interleaved stereo frame in place. It is called from the audio callback.
+func (st *stereoStage) Process(pcm []int16) {
+	cfg := st.cfg.Load()
+	if cfg == nil || cfg.isDefault() {
+		return
+	}
+
+	width := float64(cfg.width()) / 100
+	// バランスは反対側のチャンネルを下げる（中央で両方100%）
+	gainL, gainR := 1.0, 1.0
+	if cfg.Balance > 0 {
+		gainL = float64(100-cfg.Balance) / 100
+	} else if cfg.Balance < 0 {
+		gainR = float64(100+cfg.Balance) / 100
+	}
+
+	for i := 0; i+1 < len(pcm); i += 2 {
+		l, r := float64(pcm[i]), float64(pcm[i+1])
+		switch cfg.Mode {
+		case "swap":
+			l, r = r, l
+		case "mono":
+			l = (l + r) / 2
+			r = l
+		case "left":
+			r = l
+		case "right":
+			l = r
+		}
+		if width != 1 {
+			// ミッド/サイドに分けてサイド成分の量を変える
+			mid, side := (l+r)/2, (l-r)/2*width
+			l, r = mid+side, mid-side
+		}
+		pcm[i] = clampSample(l * gainL)
+		pcm[i+1] = clampSample(r * gainR)
+	}
+}
+
+// clampSample rounds v to a 16-bit sample, clipping at full scale
+func clampSample(v float64) int16 {
+	switch {
+	case v > 32767:
+		return 32767
+	case v < -32768:
+		return -32768
+	}
+	return int16(v)
+}
+
+// setStereoOverride keeps cfg in place of the configured stereo settings until
+// it is called with nil, and applies it to the running stream. It returns the
+// settings now in effect.
+func setStereoOverride(cfg *StereoConfig) StereoConfig {
+	botState.Lock()
+	defer botState.Unlock()
+	botState.stereoOverride = cfg
+	settings := botState.audioSettingsLocked()
+	if botState.streamRunningLocked() {
+		stereoTools.Set(settings.stereo)
+	}
+	return settings.stereo
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStereoStageProcess(t *testing.T) {
+	tests := []struct {
+		cfg  StereoConfig
+		want []int16
+	}{
+		{StereoConfig{}, []int16{1000, -2000}},
+		{StereoConfig{Mode: "swap"}, []int16{-2000, 1000}},
+		{StereoConfig{Mode: "mono"}, []int16{-500, -500}},
+		{StereoConfig{Mode: "left"}, []int16{1000, 1000}},
+		{StereoConfig{Mode: "right"}, []int16{-2000, -2000}},
+		{StereoConfig{Balance: 50}, []int16{500, -2000}},
+		{StereoConfig{Balance: -100}, []int16{1000, 0}},
+		{StereoConfig{Width: 1}, []int16{-485, -515}},
+		{StereoConfig{Width: 200}, []int16{2500, -3500}},
+		{StereoConfig{Mode: "swap", Balance: 50}, []int16{-1000, 1000}},
+	}
+	for _, tt := range tests {
+		st := &stereoStage{}
+		st.Set(tt.cfg)
+		pcm := []int16{1000, -2000}
+		st.Process(pcm)
+		if !reflect.DeepEqual(pcm, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.cfg, pcm, tt.want)
+		}
+	}
+}
+
+func TestStereoStageClips(t *testing.T) {
+	st := &stereoStage{}
+	st.Set(StereoConfig{Width: 200})
+	pcm := []int16{30000, -30000}
+	st.Process(pcm)
+	if pcm[0] != 32767 || pcm[1] != -32768 {
+		t.Errorf("got %v, want full scale", pcm)
+	}
+}
+
+func TestStereoConfigString(t *testing.T) {
+	for cfg, want := range map[StereoConfig]string{
+		{}:                                      "stereo",
+		{Mode: "mono", Balance: -20}:            "mono, balance L20",
+		{Mode: "swap", Balance: 30, Width: 150}: "swap, balance R30, width 150%",
+	} {
+		if got := cfg.String(); got != want {
+			t.Errorf("%+v = %q, want %q", cfg, got, want)
+		}
+	}
+}
+
+func TestProfileStereoOverridesAudio(t *testing.T) {
+	cfg := &Config{
+		Audio: AudioConfig{Stereo: StereoConfig{Mode: "swap"}},
+		Profiles: map[string]ProfileConfig{
+			"mic":  {Stereo: &StereoConfig{Mode: "left"}},
+			"game": {},
+		},
+	}
+	for profile, want := range map[string]string{"": "swap", "mic": "left", "game": "swap"} {
+		if got := resolveAudioSettings(cfg, profile, "").stereo.Mode; got != want {
+			t.Errorf("profile %q: stereo mode %q, want %q", profile, got, want)
+		}
+	}
+}
+
+func TestReloadAppliesStereoWithoutRestart(t *testing.T) {
+	tb := setupTestBot(t, nil)
+	if err := os.WriteFile(configPath, []byte("version: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "the pipeline", func() bool { return stats.snapshot().running })
+
+	yaml := "version: 2\naudio:\n  stereo:\n    mode: swap\n    balance: -10\n"
+	if err := os.WriteFile(configPath, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := stereoTools.Get(); got != (StereoConfig{Mode: "swap", Balance: -10}) {
+		t.Errorf("stereo after reload = %+v", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(tb.capture.Opened()); n != 1 {
+		t.Errorf("capture opened %d times, want 1 (no restart)", n)
+	}
+}
+
+func TestStereoOverrideSurvivesRestart(t *testing.T) {
+	tb := setupTestBot(t, &Config{Audio: AudioConfig{Stereo: StereoConfig{Mode: "swap"}}})
+
+	// 配信していなくても変更でき、次の配信開始から使われる
+	setStereoOverride(&StereoConfig{Mode: "mono", Width: 80})
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "the pipeline", func() bool { return stats.snapshot().running })
+	want := StereoConfig{Mode: "mono", Width: 80}
+	if got := stereoTools.Get(); got != want {
+		t.Errorf("stereo after join = %+v, want %+v", got, want)
+	}
+
+	restartStreaming()
+	waitFor(t, 2*time.Second, "the restarted pipeline", func() bool { return len(tb.capture.Opened()) == 2 && stats.snapshot().running })
+	if got := stereoTools.Get(); got != want {
+		t.Errorf("stereo after restart = %+v, want %+v", got, want)
+	}
+
+	// reset で設定ファイルの内容に戻る
+	if got := setStereoOverride(nil); got != (StereoConfig{Mode: "swap"}) {
+		t.Errorf("reset returned %+v", got)
+	}
+	if got := stereoTools.Get(); got != (StereoConfig{Mode: "swap"}) {
+		t.Errorf("stereo after reset = %+v, want the config", got)
+	}
+}
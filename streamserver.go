@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// streamSinkName is the name of the HTTP stream in frameSinks
+	streamSinkName = "http_stream"
+
+	// streamPagePackets is how many frames go into one Ogg page of the HTTP stream (200ms)
+	streamPagePackets = 10
+
+	// streamListenerQueue is how many frames a listener may fall behind before frames are dropped
+	streamListenerQueue = 50
+
+	// streamIdleTimeout is how long the stream may have no frames before
+	// silence is sent, so that players do not give up while the bot is not streaming
+	streamIdleTimeout = 200 * time.Millisecond
+)
+
+// streamServer serves the frames sent to Discord as an Ogg Opus HTTP stream.
+// The encoded frames are reused, so listeners hear exactly what Discord gets.
+type streamServer struct {
+	cfg    StreamServerConfig
+	server *http.Server
+	addr   net.Addr
+	done   chan struct{}
+
+	mu        sync.Mutex
+	listeners map[chan []byte]struct{}
+}
+
+var (
+	// httpStream is the running HTTP stream server, nil when stream_server is disabled
+	httpStream   *streamServer
+	httpStreamMu sync.Mutex
+)
+
+// applyStreamServerConfig starts, restarts or stops the HTTP stream server to match cfg
+func applyStreamServerConfig(cfg StreamServerConfig) error {
+	httpStreamMu.Lock()
+	defer httpStreamMu.Unlock()
+
+	if httpStream != nil {
+		httpStream.Close()
+		httpStream = nil
+	}
+	if !cfg.Enabled {
+		return nil
+	}
+	s, err := startStreamServer(cfg)
+	if err != nil {
+		return err
+	}
+	httpStream = s
+	return nil
+}
+
+// stopStreamServer stops the HTTP stream server if it is running
+func stopStreamServer() {
+	applyStreamServerConfig(StreamServerConfig{})
+}
+
+// streamListenerCount returns the number of HTTP listeners, or -1 when the server is off
+func streamListenerCount() int {
+	httpStreamMu.Lock()
+	defer httpStreamMu.Unlock()
+	if httpStream == nil {
+		return -1
+	}
+	return httpStream.Listeners()
+}
+
+// startStreamServer listens on cfg.Listen and attaches the server to the outgoing stream
+func startStreamServer(cfg StreamServerConfig) (*streamServer, error) {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start HTTP stream server: %v", err)
+	}
+
+	s := &streamServer{
+		cfg:       cfg,
+		addr:      ln.Addr(),
+		done:      make(chan struct{}),
+		listeners: make(map[chan []byte]struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Path, s.serveStream)
+	mux.HandleFunc("/{$}", s.servePlayer)
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Warn("HTTP stream server stopped", "error", err)
+		}
+	}()
+	frameSinks.Add(streamSinkName, s)
+	log.Printf("HTTP stream: %s", s.URL())
+	return s, nil
+}
+
+// URL returns the address of the stream
+func (s *streamServer) URL() string {
+	return fmt.Sprintf("http://%s%s", s.addr, s.cfg.Path)
+}
+
+// Listeners returns the number of connected listeners
+func (s *streamServer) Listeners() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.listeners)
+}
+
+// Close detaches the server from the stream and disconnects every listener
+func (s *streamServer) Close() {
+	frameSinks.Remove(streamSinkName)
+	close(s.done)
+	if err := s.server.Close(); err != nil {
+		slog.Warn("Failed to close HTTP stream server", "error", err)
+	}
+}
+
+// WriteFrame hands the encoded frame to every listener without blocking.
+// A listener that falls behind loses frames instead of delaying the others.
+func (s *streamServer) WriteFrame(pcm []int16, opus []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return
+	}
+	frame := append([]byte(nil), opus...)
+	for ch := range s.listeners {
+		select {
+		case ch <- frame:
+		default:
+			warnLimiter.Warn("http_stream_slow", "HTTP stream listener is too slow, dropping frames")
+		}
+	}
+}
+
+// addListener registers a listener, or returns nil when max_listeners are connected
+func (s *streamServer) addListener() chan []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) >= s.cfg.MaxListeners {
+		return nil
+	}
+	ch := make(chan []byte, streamListenerQueue)
+	s.listeners[ch] = struct{}{}
+	return ch
+}
+
+func (s *streamServer) removeListener(ch chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, ch)
+}
+
+// serveStream sends the stream to one listener as a new Ogg Opus stream
+func (s *streamServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	frames := s.addListener()
+	if frames == nil {
+		http.Error(w, "too many listeners", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.removeListener(frames)
+
+	w.Header().Set("Content-Type", "audio/ogg")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("icy-name", "ConsoNance")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	ogg, err := newOggOpusWriter(w, outputChannels)
+	if err != nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	flush := func() error {
+		if err := ogg.Flush(); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if flush() != nil {
+		return
+	}
+
+	log.Printf("HTTP stream: listener %s connected (%d listening)", r.RemoteAddr, s.Listeners())
+	defer func() {
+		log.Printf("HTTP stream: listener %s disconnected", r.RemoteAddr)
+	}()
+
+	idle := time.NewTimer(streamIdleTimeout)
+	defer idle.Stop()
+	packets := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case frame := <-frames:
+			if ogg.WritePacket(frame, 960) != nil {
+				return
+			}
+			packets++
+			idle.Reset(streamIdleTimeout)
+		case <-idle.C:
+			// 配信していない間は無音を流して再生側の接続を保つ
+			for i := 0; i < streamPagePackets; i++ {
+				if ogg.WritePacket(opusSilenceFrame, 960) != nil {
+					return
+				}
+			}
+			packets = streamPagePackets
+			idle.Reset(streamIdleTimeout)
+		}
+		if packets >= streamPagePackets {
+			if flush() != nil {
+				return
+			}
+			packets = 0
+		}
+	}
+}
+
+// playerPage is the page at / that plays the stream in a browser
+var playerPage = template.Must(template.New("player").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>ConsoNance</title></head>
+<body>
+<h1>ConsoNance</h1>
+<audio controls autoplay src="{{.}}"></audio>
+</body>
+</html>
+`))
+
+// servePlayer serves a page with an audio player of the stream
+func (s *streamServer) servePlayer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	playerPage.Execute(w, s.cfg.Path)
+}
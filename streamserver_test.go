@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTestStreamServer runs the HTTP stream server on a free port for one test
+func startTestStreamServer(t *testing.T, maxListeners int) string {
+	t.Helper()
+	err := applyStreamServerConfig(StreamServerConfig{
+		Enabled:      true,
+		Listen:       "127.0.0.1:0",
+		Path:         "/stream.opus",
+		MaxListeners: maxListeners,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stopStreamServer)
+	return httpStream.URL()
+}
+
+// openStream connects to the stream and checks the Ogg Opus headers
+func openStream(t *testing.T, url string) *oggReader {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "audio/ogg" {
+		t.Fatalf("GET %s = %s (%s)", url, resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	r := newOggReader(resp.Body)
+	for _, header := range []string{"OpusHead", "OpusTags"} {
+		packet, _, err := r.ReadPacket()
+		if err != nil || !bytes.HasPrefix(packet, []byte(header)) {
+			t.Fatalf("expected %s, got %q (%v)", header, packet, err)
+		}
+	}
+	return r
+}
+
+func TestStreamServerServesSentFrames(t *testing.T) {
+	tb := setupTestBot(t, nil)
+	url := startTestStreamServer(t, 5)
+
+	if err := joinVoiceChannel("100", "200"); err != nil {
+		t.Fatal(err)
+	}
+	v := tb.gateway.Voices()[0]
+	r := openStream(t, url)
+
+	// 配信中のフレームは再エンコードせずにそのまま流れる
+	found := false
+	for i := 0; i < 100 && !found; i++ {
+		packet, _, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(packet, opusSilenceFrame) {
+			continue
+		}
+		for _, frame := range v.Frames() {
+			if bytes.Equal(frame, packet) {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no packet of the HTTP stream matched a frame sent to Discord")
+	}
+	if n := streamListenerCount(); n != 1 {
+		t.Errorf("listeners = %d, want 1", n)
+	}
+}
+
+func TestStreamServerSendsSilenceWhileIdle(t *testing.T) {
+	setupTestBot(t, nil)
+	r := openStream(t, startTestStreamServer(t, 5))
+
+	done := make(chan []byte, 1)
+	go func() {
+		packet, _, _ := r.ReadPacket()
+		done <- packet
+	}()
+	select {
+	case packet := <-done:
+		if !bytes.Equal(packet, opusSilenceFrame) {
+			t.Errorf("packet while idle = %x, want silence", packet)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no silence while the bot is not streaming")
+	}
+}
+
+func TestStreamServerLimitsListeners(t *testing.T) {
+	setupTestBot(t, nil)
+	url := startTestStreamServer(t, 1)
+	openStream(t, url)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second listener got %s, want 503", resp.Status)
+	}
+}
+
+func TestStreamServerStopsWithConfig(t *testing.T) {
+	setupTestBot(t, nil)
+	url := startTestStreamServer(t, 5)
+
+	if err := applyStreamServerConfig(StreamServerConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := streamListenerCount(); n != -1 {
+		t.Errorf("listener count of a stopped server = %d, want -1", n)
+	}
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("stream still served after disabling stream_server")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// voiceConn is the part of a Discord voice connection the bot uses.
+// discordVoice adapts *discordgo.VoiceConnection; tests use a fake.
+type voiceConn interface {
+	// Ready reports whether audio can be sent and received
+	Ready() bool
+	Speaking(speaking bool) error
+	// OpusSend is the channel of encoded 20ms frames to send
+	OpusSend() chan<- []byte
+	// OpusRecv is the channel of received voice packets
+	OpusRecv() <-chan *discordgo.Packet
+	// OnSpeakingUpdate registers a handler of the users starting to speak
+	OnSpeakingUpdate(handler func(ssrc uint32, userID string))
+	Disconnect() error
+}
+
+// voiceGateway joins voice channels. discordGateway uses the bot's session;
+// tests replace it to record the joins.
+type voiceGateway interface {
+	JoinVoice(guildID, channelID string, mute, deaf bool) (voiceConn, error)
+	// DisconnectAll leaves every voice channel, including connections the bot lost track of
+	DisconnectAll()
+}
+
+// gateway is the voice gateway of the running bot
+var gateway voiceGateway
+
+// discordGateway joins voice channels through a Discord session
+type discordGateway struct {
+	s *discordgo.Session
+}
+
+func (g discordGateway) JoinVoice(guildID, channelID string, mute, deaf bool) (voiceConn, error) {
+	vc, err := g.s.ChannelVoiceJoin(guildID, channelID, mute, deaf)
+	if err != nil {
+		return nil, err
+	}
+	return discordVoice{vc}, nil
+}
+
+func (g discordGateway) DisconnectAll() {
+	g.s.RLock()
+	connections := make([]*discordgo.VoiceConnection, 0, len(g.s.VoiceConnections))
+	for _, vc := range g.s.VoiceConnections {
+		connections = append(connections, vc)
+	}
+	g.s.RUnlock()
+
+	for _, vc := range connections {
+		if err := vc.Disconnect(); err != nil {
+			slog.Warn("Failed to disconnect from voice channel", "channel", vc.ChannelID, "error", err)
+		}
+	}
+}
+
+// discordVoice adapts *discordgo.VoiceConnection to voiceConn.
+// discordgo reuses the connection of a guild, so equal values mean the same connection.
+type discordVoice struct {
+	vc *discordgo.VoiceConnection
+}
+
+func (v discordVoice) Ready() bool {
+	v.vc.RLock()
+	defer v.vc.RUnlock()
+	return v.vc.Ready
+}
+
+func (v discordVoice) Speaking(speaking bool) error {
+	return v.vc.Speaking(speaking)
+}
+
+func (v discordVoice) OpusSend() chan<- []byte {
+	return v.vc.OpusSend
+}
+
+func (v discordVoice) OpusRecv() <-chan *discordgo.Packet {
+	return v.vc.OpusRecv
+}
+
+func (v discordVoice) OnSpeakingUpdate(handler func(ssrc uint32, userID string)) {
+	v.vc.AddHandler(func(_ *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+		handler(uint32(vs.SSRC), vs.UserID)
+	})
+}
+
+func (v discordVoice) Disconnect() error {
+	return v.vc.Disconnect()
+}
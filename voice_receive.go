@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"layeh.com/gopus"
+)
+
+const (
+	// Opusパケットの最大フレームサイズ（120ms @ 48kHz）
+	maxOpusFrameSize = 5760
+
+	// これ以上タイムスタンプが飛んだ場合はタイムスタンプを信用せず、録音開始からの経過時間で位置を取り直す
+	maxVoiceGap = 10 * time.Minute
+)
+
+// ssrcUserMap maps RTP SSRCs to Discord user IDs using VoiceSpeakingUpdate events
+type ssrcUserMap struct {
+	sync.RWMutex
+	users      map[uint32]string
+	registered map[voiceConn]bool
+}
+
+var ssrcUsers = &ssrcUserMap{
+	users:      make(map[uint32]string),
+	registered: make(map[voiceConn]bool),
+}
+
+// Watch registers a speaking handler on the connection (once per connection)
+func (m *ssrcUserMap) Watch(vc voiceConn) {
+	m.Lock()
+	defer m.Unlock()
+
+	// discordgoはギルドごとにVoiceConnectionを使い回し、ハンドラを削除できないため一度だけ登録する
+	if m.registered[vc] {
+		return
+	}
+	m.registered[vc] = true
+	vc.OnSpeakingUpdate(func(ssrc uint32, userID string) {
+		m.Lock()
+		m.users[ssrc] = userID
+		m.Unlock()
+	})
+}
+
+// UserID returns the user for the given SSRC, or "" if not known yet
+func (m *ssrcUserMap) UserID(ssrc uint32) string {
+	m.RLock()
+	defer m.RUnlock()
+	return m.users[ssrc]
+}
+
+// voiceReceiver decodes incoming voice packets from a voice connection
+type voiceReceiver struct {
+	vc       voiceConn
+	decoders map[uint32]*gopus.Decoder
+	playback *returnPlayback // 双方向モードの再生先（無効時はnil）
+
+	mu     sync.Mutex
+	tracks *voiceTrackRecorder
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startVoiceReceiver starts decoding v.OpusRecv in a goroutine.
+// If playback is not nil, the decoded voices are also played locally.
+func startVoiceReceiver(vc voiceConn, playback *returnPlayback) *voiceReceiver {
+	ssrcUsers.Watch(vc)
+
+	r := &voiceReceiver{
+		vc:       vc,
+		decoders: make(map[uint32]*gopus.Decoder),
+		playback: playback,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	log.Println("Voice receive mode started")
+	return r
+}
+
+// SetTracks sets (or clears with nil) the per-speaker track recorder
+func (r *voiceReceiver) SetTracks(tracks *voiceTrackRecorder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tracks = tracks
+}
+
+// Stop stops receiving and waits for the goroutine to exit
+func (r *voiceReceiver) Stop() {
+	close(r.stop)
+	<-r.done
+	if r.playback != nil {
+		r.playback.Stop()
+	}
+	log.Println("Voice receive mode stopped")
+}
+
+func (r *voiceReceiver) run() {
+	defer close(r.done)
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case p, ok := <-r.vc.OpusRecv():
+			if !ok {
+				return
+			}
+			r.handlePacket(p)
+		}
+	}
+}
+
+// handlePacket decodes one packet and passes it to the active consumers
+func (r *voiceReceiver) handlePacket(p *discordgo.Packet) {
+	dec, ok := r.decoders[p.SSRC]
+	if !ok {
+		var err error
+		dec, err = gopus.NewDecoder(outputSampleRate, outputChannels)
+		if err != nil {
+			slog.Error("Failed to create opus decoder", "ssrc", p.SSRC, "error", err)
+			return
+		}
+		r.decoders[p.SSRC] = dec
+	}
+
+	pcm, err := dec.Decode(p.Opus, maxOpusFrameSize, false)
+	if err != nil {
+		// 壊れたパケットは捨てる
+		return
+	}
+
+	r.mu.Lock()
+	tracks := r.tracks
+	r.mu.Unlock()
+
+	if tracks != nil {
+		tracks.Write(p.SSRC, p.Timestamp, pcm)
+	}
+	if r.playback != nil {
+		r.playback.Push(p.SSRC, pcm)
+	}
+}
+
+// voiceTrack is one speaker's WAV file
+type voiceTrack struct {
+	file    *wavFile
+	path    string
+	userID  string // ファイル名を決めた時点で分かっていた話者（"" = SSRCの名前で作成）
+	started bool
+	ssrc    uint32
+	baseTS  uint32 // 基準パケットのRTPタイムスタンプ
+	basePos int64  // 基準パケットのタイムライン上の位置（サンプル数）
+	written int64  // 書き込み済みのサンプル数（1チャンネルあたり）
+}
+
+// voiceTrackRecorder writes per-speaker WAV tracks aligned to the outgoing stream
+type voiceTrackRecorder struct {
+	dir     string
+	guildID string
+	started time.Time
+
+	mu     sync.Mutex
+	tracks map[string]*voiceTrack
+	closed bool
+}
+
+// newVoiceTrackRecorder creates the track directory. started is the time
+// position 0 of the outgoing recording, so tracks line up with it.
+func newVoiceTrackRecorder(dir, guildID string, started time.Time) (*voiceTrackRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create voice track directory: %v", err)
+	}
+	return &voiceTrackRecorder{
+		dir:     dir,
+		guildID: guildID,
+		started: started,
+		tracks:  make(map[string]*voiceTrack),
+	}, nil
+}
+
+// Write places decoded samples on the speaker's track at the packet's position
+func (t *voiceTrackRecorder) Write(ssrc uint32, timestamp uint32, pcm []int16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+
+	// トラックは話者ごと（再接続でSSRCが変わっても同じファイル）。
+	// SpeakingUpdateより先に届いたパケットはSSRCのトラックに書き、話者が分かったら引き継ぐ
+	ssrcKey := fmt.Sprintf("ssrc_%d", ssrc)
+	key := ssrcKey
+	if userID := ssrcUsers.UserID(ssrc); userID != "" {
+		key = userID
+		if pending, ok := t.tracks[ssrcKey]; ok {
+			delete(t.tracks, ssrcKey)
+			if _, exists := t.tracks[userID]; exists {
+				// 既に話者のトラックがある場合は、先頭の断片を話者の名前で閉じる
+				t.closeTrack(pending)
+			} else {
+				t.tracks[userID] = pending
+			}
+		}
+	}
+
+	track, ok := t.tracks[key]
+	if !ok {
+		var err error
+		track, err = t.openTrack(key, ssrcUsers.UserID(ssrc))
+		if err != nil {
+			slog.Error("Failed to create voice track", "error", err)
+			return
+		}
+		t.tracks[key] = track
+	}
+
+	// 最初のパケット、または再接続などでSSRCが変わった場合は現在時刻から位置を取り直す
+	if !track.started || track.ssrc != ssrc {
+		track.started = true
+		track.ssrc = ssrc
+		track.baseTS = timestamp
+		track.basePos = int64(time.Since(t.started) * outputSampleRate / time.Second)
+	}
+
+	// RTPタイムスタンプ（48kHz）から書き込み位置を計算
+	pos := track.basePos + int64(int32(timestamp-track.baseTS))
+	if pos-track.written > int64(maxVoiceGap/time.Second)*outputSampleRate {
+		track.baseTS = timestamp
+		track.basePos = int64(time.Since(t.started) * outputSampleRate / time.Second)
+		pos = track.basePos
+	}
+
+	// 発話のない区間は無音で埋める（録音開始から遅れて話し始めた場合は長くなる）
+	if gap := pos - track.written; gap > 0 {
+		if err := track.file.writeSilence(gap); err != nil {
+			warnLimiter.Warn("voice_track", "Failed to write voice track", "error", err)
+			return
+		}
+		track.written = pos
+	}
+
+	// 既に書き込んだ区間と重なる部分は捨てる（順序の入れ替わり対策）
+	if skip := track.written - pos; skip > 0 {
+		if skip*outputChannels >= int64(len(pcm)) {
+			return
+		}
+		pcm = pcm[skip*outputChannels:]
+	}
+
+	if err := track.file.writeSamples(pcm); err != nil {
+		warnLimiter.Warn("voice_track", "Failed to write voice track", "error", err)
+		return
+	}
+	track.written += int64(len(pcm) / outputChannels)
+}
+
+// openTrack creates the WAV file for one speaker. Tracks of unknown
+// speakers are named after key and renamed when they are closed.
+func (t *voiceTrackRecorder) openTrack(key, userID string) (*voiceTrack, error) {
+	name := key
+	if userID != "" {
+		name = t.trackName(userID)
+	}
+	path := uniqueTrackPath(t.dir, name)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create voice track file: %v", err)
+	}
+	file, err := newWAVFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	log.Printf("Recording voice track: %s", path)
+	return &voiceTrack{file: file, path: path, userID: userID}, nil
+}
+
+// trackName returns the file name of a speaker's track: "<name>_<user ID>"
+func (t *voiceTrackRecorder) trackName(userID string) string {
+	if session != nil {
+		if member, err := session.State.Member(t.guildID, userID); err == nil && member.User != nil {
+			return sanitizeFileName(member.User.Username) + "_" + userID
+		}
+	}
+	return userID
+}
+
+// uniqueTrackPath returns an unused <dir>/<name>.wav path
+func uniqueTrackPath(dir, name string) string {
+	path := filepath.Join(dir, name+".wav")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s_%d.wav", name, i))
+	}
+}
+
+// closeTrack finalizes a track file and gives a track created before its
+// speaker was known the speaker's name
+func (t *voiceTrackRecorder) closeTrack(track *voiceTrack) {
+	if err := track.file.Close(); err != nil {
+		slog.Warn("Failed to close voice track", "error", err)
+	}
+	if track.userID != "" {
+		return
+	}
+	userID := ssrcUsers.UserID(track.ssrc)
+	if userID == "" {
+		return
+	}
+	path := uniqueTrackPath(t.dir, t.trackName(userID))
+	if err := os.Rename(track.path, path); err != nil {
+		slog.Warn("Failed to rename voice track", "error", err)
+		return
+	}
+	log.Printf("Voice track renamed: %s", path)
+}
+
+// Close finalizes all track files
+func (t *voiceTrackRecorder) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for _, track := range t.tracks {
+		t.closeTrack(track)
+	}
+}
+
+// sanitizeFileName replaces characters that are not safe in file names
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		if r < 0x20 {
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// mapSSRC makes ssrcUsers report userID for ssrc until the test ends
+func mapSSRC(t *testing.T, ssrc uint32, userID string) {
+	ssrcUsers.Lock()
+	ssrcUsers.users[ssrc] = userID
+	ssrcUsers.Unlock()
+	t.Cleanup(func() {
+		ssrcUsers.Lock()
+		delete(ssrcUsers.users, ssrc)
+		ssrcUsers.Unlock()
+	})
+}
+
+// trackFiles returns the track file names and sizes in dir
+func trackFiles(t *testing.T, dir string) map[string]int64 {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]int64)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[e.Name()] = info.Size()
+	}
+	return files
+}
+
+func TestVoiceTrackKeepsSpeakerInOneFile(t *testing.T) {
+	dir := t.TempDir()
+	tracks, err := newVoiceTrackRecorder(dir, "100", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SpeakingUpdateの前に届いたパケットも同じ話者のファイルに入る
+	frame := make([]int16, 960*outputChannels)
+	tracks.Write(1001, 0, frame)
+	mapSSRC(t, 1001, "42")
+	tracks.Write(1001, 960, frame)
+	tracks.Close()
+
+	files := trackFiles(t, dir)
+	want := int64(wavHeaderSize + 2*len(frame)*2)
+	if len(files) != 1 || files["42.wav"] < want {
+		t.Errorf("track files = %v, want only 42.wav with at least %d bytes", files, want)
+	}
+}
+
+func TestVoiceTrackRenamesUnknownSpeakerOnClose(t *testing.T) {
+	dir := t.TempDir()
+	tracks, err := newVoiceTrackRecorder(dir, "100", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]int16, 960*outputChannels)
+	mapSSRC(t, 2001, "7")
+	tracks.Write(2001, 0, frame)
+	// 再接続で新しいSSRCになり、対応付けの前に届いた断片
+	tracks.Write(2002, 0, frame)
+	mapSSRC(t, 2002, "7")
+	tracks.Write(2002, 960, frame)
+	tracks.Write(2003, 0, frame)
+	tracks.Close()
+
+	var names []string
+	for name := range trackFiles(t, dir) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"7.wav", "7_1.wav", "ssrc_2003.wav"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("track files = %v, want %v", names, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ssrc_2002.wav")); !os.IsNotExist(err) {
+		t.Errorf("ssrc_2002.wav was not renamed")
+	}
+}
+
+func TestVoiceTrackLateSpeakerFillsGapInChunks(t *testing.T) {
+	dir := t.TempDir()
+	// 録音開始から30秒後に初めて話した
+	tracks, err := newVoiceTrackRecorder(dir, "100", time.Now().Add(-30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapSSRC(t, 3001, "9")
+
+	frame := make([]int16, 960*outputChannels)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	tracks.Write(3001, 0, frame)
+	runtime.ReadMemStats(&after)
+	tracks.Close()
+
+	gapBytes := int64(30 * outputSampleRate * outputChannels * 2)
+	if size := trackFiles(t, dir)["9.wav"]; size < wavHeaderSize+gapBytes {
+		t.Errorf("track is %d bytes, want the 30 s gap filled with silence", size)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("filling the gap allocated %d bytes, want fixed-size chunks", allocated)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/malgo"
+)
+
+const (
+	// 再生開始前に話者ごとに溜めておく量（ジッタ対策）
+	returnPrebufferSamples = outputSampleRate * 60 / 1000
+	// これを超えて溜まった場合は古いサンプルを捨てて遅延を抑える
+	returnMaxBufferSamples = outputSampleRate * 200 / 1000
+	// 話さなくなった話者のキューを破棄するまでの時間
+	returnSpeakerTimeout = 5 * time.Second
+)
+
+// speakerQueue is the playback buffer of a single speaker
+type speakerQueue struct {
+	samples  []int16 // インターリーブのステレオ
+	primed   bool
+	lastPush time.Time
+}
+
+// voiceMixer mixes the decoded voices of all speakers into one stereo stream
+type voiceMixer struct {
+	mu     sync.Mutex
+	queues map[uint32]*speakerQueue
+	mix    []int32
+}
+
+func newVoiceMixer() *voiceMixer {
+	return &voiceMixer{queues: make(map[uint32]*speakerQueue)}
+}
+
+// Push appends decoded stereo samples of a speaker
+func (m *voiceMixer) Push(ssrc uint32, pcm []int16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[ssrc]
+	if !ok {
+		q = &speakerQueue{}
+		m.queues[ssrc] = q
+	}
+	q.samples = append(q.samples, pcm...)
+	q.lastPush = time.Now()
+
+	if frames := len(q.samples) / outputChannels; frames > returnMaxBufferSamples {
+		q.samples = q.samples[(frames-returnPrebufferSamples)*outputChannels:]
+	}
+	if len(q.samples)/outputChannels >= returnPrebufferSamples {
+		q.primed = true
+	}
+}
+
+// Read fills out with the mix of all speakers (interleaved stereo)
+func (m *voiceMixer) Read(out []int16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cap(m.mix) < len(out) {
+		m.mix = make([]int32, len(out))
+	}
+	mix := m.mix[:len(out)]
+	for i := range mix {
+		mix[i] = 0
+	}
+
+	now := time.Now()
+	for ssrc, q := range m.queues {
+		if !q.primed {
+			if now.Sub(q.lastPush) > returnSpeakerTimeout {
+				delete(m.queues, ssrc)
+			}
+			continue
+		}
+
+		n := len(q.samples)
+		if n > len(mix) {
+			n = len(mix)
+		}
+		for i := 0; i < n; i++ {
+			mix[i] += int32(q.samples[i])
+		}
+		q.samples = q.samples[n:]
+
+		// バッファが尽きたら再びプリバッファが溜まるまで待つ
+		if len(q.samples) == 0 {
+			q.primed = false
+		}
+	}
+
+	for i, v := range mix {
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		out[i] = int16(v)
+	}
+}
+
+// returnPlayback plays the mixed channel voices on a local playback device
+type returnPlayback struct {
+	ctx    *malgo.AllocatedContext
+	device *malgo.Device
+	mixer  *voiceMixer
+}
+
+// startReturnPlayback opens the playback device for the two-way mode.
+// captureDevices are the sources of the active profile; playing on one of its
+// loopback devices would feed the players' voices back into the stream, so it is refused.
+func startReturnPlayback(deviceName string, captureDevices []ProfileDevice) (*returnPlayback, error) {
+	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize malgo context: %v", err)
+	}
+
+	p := &returnPlayback{ctx: ctx, mixer: newVoiceMixer()}
+	fail := func(err error) (*returnPlayback, error) {
+		_ = ctx.Uninit()
+		ctx.Free()
+		return nil, err
+	}
+
+	// エコー防止：ループバック元と同じデバイスには再生しない
+	playbackName, err := resolveDeviceName(ctx, deviceName)
+	if err != nil {
+		return fail(err)
+	}
+	var loopbackNames []string
+	for _, device := range captureDevices {
+		if device.Mode != "" && device.Mode != "loopback" {
+			continue
+		}
+		name, err := resolveDeviceName(ctx, device.Name)
+		if err != nil {
+			return fail(err)
+		}
+		loopbackNames = append(loopbackNames, name)
+	}
+	if isLoopbackSource(playbackName, loopbackNames) {
+		return fail(fmt.Errorf("return device '%s' is a loopback capture device; "+
+			"choose a different return_device_name (e.g. headphones) to avoid echo", playbackName))
+	}
+
+	deviceConfig := malgo.DefaultDeviceConfig(malgo.Playback)
+	deviceConfig.Playback.Format = malgo.FormatS16
+	deviceConfig.Playback.Channels = outputChannels
+	deviceConfig.SampleRate = outputSampleRate
+	deviceConfig.PeriodSizeInMilliseconds = 20
+	deviceConfig.Alsa.NoMMap = 1
+
+	if deviceName != "" {
+		info, err := findDeviceByName(ctx, deviceName)
+		if err != nil {
+			return fail(fmt.Errorf("failed to find return device '%s': %v", deviceName, err))
+		}
+		deviceConfig.Playback.DeviceID = info.ID.Pointer()
+	}
+
+	var pcm []int16
+	callbacks := malgo.DeviceCallbacks{
+		Data: func(pOutputSample, pInputSamples []byte, framecount uint32) {
+			n := int(framecount) * outputChannels
+			if cap(pcm) < n {
+				pcm = make([]int16, n)
+			}
+			pcm = pcm[:n]
+			p.mixer.Read(pcm)
+			for i, s := range pcm {
+				binary.LittleEndian.PutUint16(pOutputSample[i*2:], uint16(s))
+			}
+		},
+	}
+
+	device, err := malgo.InitDevice(ctx.Context, deviceConfig, callbacks)
+	if err != nil {
+		return fail(fmt.Errorf("failed to initialize return device: %v", err))
+	}
+	if err := device.Start(); err != nil {
+		device.Uninit()
+		return fail(fmt.Errorf("failed to start return device: %v", err))
+	}
+	p.device = device
+
+	log.Printf("Two-way mode: playing channel voices on '%s'", playbackName)
+	return p, nil
+}
+
+// Push queues decoded voice of one speaker for playback
+func (p *returnPlayback) Push(ssrc uint32, pcm []int16) {
+	p.mixer.Push(ssrc, pcm)
+}
+
+// Stop stops the playback device and releases the context
+func (p *returnPlayback) Stop() {
+	p.device.Stop()
+	p.device.Uninit()
+	_ = p.ctx.Uninit()
+	p.ctx.Free()
+	log.Println("Two-way mode stopped")
+}
+
+// isLoopbackSource reports whether the playback device is one of the loopback
+// sources. Names that could not be resolved ("") are not compared.
+func isLoopbackSource(playbackName string, loopbackNames []string) bool {
+	if playbackName == "" {
+		return false
+	}
+	for _, name := range loopbackNames {
+		if name == playbackName {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDeviceName returns the playback device name, resolving "" to the default
+// device ("" if no default device is reported)
+func resolveDeviceName(ctx *malgo.AllocatedContext, deviceName string) (string, error) {
+	if deviceName != "" {
+		return deviceName, nil
+	}
+
+	infos, err := ctx.Devices(malgo.Playback)
+	if err != nil {
+		return "", fmt.Errorf("failed to get devices: %v", err)
+	}
+	for _, info := range infos {
+		if info.IsDefault > 0 {
+			return info.Name(), nil
+		}
+	}
+	return "", nil
+}
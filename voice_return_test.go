@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestIsLoopbackSource(t *testing.T) {
+	tests := []struct {
+		playback  string
+		loopbacks []string
+		want      bool
+	}{
+		{"Speakers", []string{"Speakers"}, true},
+		{"Headphones", []string{"Speakers"}, false},
+		{"Speakers", []string{"Line In", "Speakers"}, true},
+		// 既定のデバイスが分からない場合は比較しない
+		{"", []string{""}, false},
+		{"Headphones", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackSource(tt.playback, tt.loopbacks); got != tt.want {
+			t.Errorf("isLoopbackSource(%q, %q) = %v, want %v", tt.playback, tt.loopbacks, got, tt.want)
+		}
+	}
+}